@@ -3,4 +3,6 @@
 cd glslsandbox
 export DEV ADDR AUTH_SECRET IMPORT
 export TLS_ADDR DOMAINS
+export TRUSTED_PROXIES SUBMITTER_SALT SUBMITTER_RETENTION
+export DELETE_RETENTION
 DATA_PATH=/data ./glslsandbox
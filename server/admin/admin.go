@@ -0,0 +1,249 @@
+// Package admin is a client of the admin API of a running glsl-sandbox
+// server. It lets glsladmin moderate effects without opening the database
+// file.
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrdoob/glsl-sandbox/server/store"
+)
+
+// apiError is the response of the admin API when a request fails.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// apiID is the response of the admin API when an object is created.
+type apiID struct {
+	ID int `json:"id"`
+}
+
+// Client calls the admin API of a server.
+type Client struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewClient creates a client for the server at the URL using the admin
+// token configured in it.
+func NewClient(u string, token string) (*Client, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil, fmt.Errorf("malformed admin url: %w", err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("admin url must be http or https")
+	}
+	if token == "" {
+		return nil, fmt.Errorf("admin token can not be empty")
+	}
+
+	return &Client{
+		url:   strings.TrimSuffix(u, "/") + "/api/admin",
+		token: token,
+		client: &http.Client{
+			Timeout: time.Minute,
+		},
+	}, nil
+}
+
+// Effect returns an effect with all its versions.
+func (c *Client) Effect(id int) (store.Effect, error) {
+	var e store.Effect
+	err := c.do(http.MethodGet, fmt.Sprintf("/effects/%d", id), nil, &e)
+	return e, err
+}
+
+// List returns a page of the effects matching the options.
+func (c *Client) List(opts store.ListOptions, num int, size int) ([]store.Effect, error) {
+	q := url.Values{}
+	q.Set("page", strconv.Itoa(num))
+	q.Set("limit", strconv.Itoa(size))
+	if opts.User != "" {
+		q.Set("user", opts.User)
+	}
+	if !opts.Since.IsZero() {
+		q.Set("since", opts.Since.Format(time.RFC3339Nano))
+	}
+	if opts.Hidden {
+		q.Set("hidden", "true")
+	}
+
+	var effects []store.Effect
+	err := c.do(http.MethodGet, "/effects?"+q.Encode(), nil, &effects)
+	return effects, err
+}
+
+// Hide sets the hidden state of an effect.
+func (c *Client) Hide(id int, hidden bool) error {
+	action := "unhide"
+	if hidden {
+		action = "hide"
+	}
+	return c.effectAction(id, action, nil)
+}
+
+// Lock sets the locked state of an effect.
+func (c *Client) Lock(id int, locked bool) error {
+	action := "unlock"
+	if locked {
+		action = "lock"
+	}
+	return c.effectAction(id, action, nil)
+}
+
+// Delete moves an effect to the trash.
+func (c *Client) Delete(id int) error {
+	return c.effectAction(id, "delete", nil)
+}
+
+// Restore takes an effect out of the trash.
+func (c *Client) Restore(id int) error {
+	return c.effectAction(id, "restore", nil)
+}
+
+// SetParent changes the effect an effect was forked from.
+func (c *Client) SetParent(id int, parent int, parentVersion int) error {
+	return c.effectAction(id, "parent", map[string]int{
+		"parent":         parent,
+		"parent_version": parentVersion,
+	})
+}
+
+// Purge removes the effects deleted before the retention and their
+// thumbnails. The server retention is used when it is negative and the
+// whole trash is emptied when it is 0.
+func (c *Client) Purge(retention time.Duration) ([]int, error) {
+	req := map[string]interface{}{}
+	switch {
+	case retention == 0:
+		req["all"] = true
+	case retention > 0:
+		req["retention"] = retention.String()
+	}
+
+	var res struct {
+		Purged []int `json:"purged"`
+	}
+	err := c.do(http.MethodPost, "/purge", req, &res)
+	return res.Purged, err
+}
+
+// AddBan creates a ban and returns its id.
+func (c *Client) AddBan(b store.Ban) (int, error) {
+	var res apiID
+	err := c.do(http.MethodPost, "/bans", b, &res)
+	return res.ID, err
+}
+
+// Bans returns all the bans.
+func (c *Client) Bans() ([]store.Ban, error) {
+	var list []store.Ban
+	err := c.do(http.MethodGet, "/bans", nil, &list)
+	return list, err
+}
+
+// RemoveBan deletes a ban.
+func (c *Client) RemoveBan(id int) error {
+	return c.do(http.MethodDelete, fmt.Sprintf("/bans/%d", id), nil, nil)
+}
+
+// TakeDown records a takedown, moves the effect to the trash and blocks its
+// code.
+func (c *Client) TakeDown(t store.Takedown) (int, error) {
+	var res apiID
+	err := c.do(http.MethodPost, "/takedowns", t, &res)
+	return res.ID, err
+}
+
+// Takedowns returns all the takedowns.
+func (c *Client) Takedowns() ([]store.Takedown, error) {
+	var list []store.Takedown
+	err := c.do(http.MethodGet, "/takedowns", nil, &list)
+	return list, err
+}
+
+// AddBlock creates a code block and returns its id.
+func (c *Client) AddBlock(b store.Block) (int, error) {
+	var res apiID
+	err := c.do(http.MethodPost, "/blocks", b, &res)
+	return res.ID, err
+}
+
+// Blocks returns all the code blocks.
+func (c *Client) Blocks() ([]store.Block, error) {
+	var list []store.Block
+	err := c.do(http.MethodGet, "/blocks", nil, &list)
+	return list, err
+}
+
+// RemoveBlock deletes a code block.
+func (c *Client) RemoveBlock(id int) error {
+	return c.do(http.MethodDelete, fmt.Sprintf("/blocks/%d", id), nil, nil)
+}
+
+func (c *Client) effectAction(id int, action string, req interface{}) error {
+	return c.do(http.MethodPost, fmt.Sprintf("/effects/%d/%s", id, action), req, nil)
+}
+
+// do sends a request with the JSON encoded body and decodes the response
+// in res when it is not nil. Errors with status 404 wrap store.ErrNotFound.
+func (c *Client) do(method string, p string, body interface{}, res interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("could not encode request: %w", err)
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.url+p, r)
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not call admin api: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e apiError
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&e)
+		if e.Error == "" {
+			e.Error = resp.Status
+		}
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return fmt.Errorf("%w: %s", store.ErrNotFound, e.Error)
+		case http.StatusBadRequest:
+			return fmt.Errorf("%w: %s", store.ErrInvalid, e.Error)
+		}
+		return fmt.Errorf("admin api error: %s", e.Error)
+	}
+
+	if res == nil {
+		return nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(res)
+	if err != nil {
+		return fmt.Errorf("malformed response: %w", err)
+	}
+	return nil
+}
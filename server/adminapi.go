@@ -0,0 +1,359 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrdoob/glsl-sandbox/server/store"
+)
+
+const (
+	adminAPIPageSize    = 100
+	adminAPIMaxPageSize = 1000
+)
+
+// adminAPIError is the response of the admin API when a request fails.
+type adminAPIError struct {
+	Error string `json:"error"`
+}
+
+// adminAPIID is the response of the admin API when an object is created.
+type adminAPIID struct {
+	ID int `json:"id"`
+}
+
+// adminAPIParent is the request to change the parent of an effect.
+type adminAPIParent struct {
+	Parent        int `json:"parent"`
+	ParentVersion int `json:"parent_version"`
+}
+
+// adminAPIPurge is the request to purge the trash. Retention is a positive
+// duration and the server one is used when it is empty. All empties the
+// whole trash.
+type adminAPIPurge struct {
+	Retention string `json:"retention"`
+	All       bool   `json:"all"`
+}
+
+// adminAPIPurged is the response with the purged effects.
+type adminAPIPurged struct {
+	Purged []int `json:"purged"`
+}
+
+// adminAPIRoutes registers the admin API used by glsladmin. It is only
+// available when an admin token is configured.
+func (s *Server) adminAPIRoutes() {
+	if s.adminToken == "" {
+		return
+	}
+
+	api := s.echo.Group("/api/admin", adminTokenMiddleware(s.adminToken))
+	api.GET("/effects", s.adminListHandler)
+	api.GET("/effects/:id", s.adminEffectHandler)
+	api.POST("/effects/:id/hide", s.adminEffectAction(func(c echo.Context, id int) error {
+		return s.setHidden(c, id, true)
+	}))
+	api.POST("/effects/:id/unhide", s.adminEffectAction(func(c echo.Context, id int) error {
+		return s.setHidden(c, id, false)
+	}))
+	api.POST("/effects/:id/lock", s.adminEffectAction(func(c echo.Context, id int) error {
+		return s.effects.Lock(id, true)
+	}))
+	api.POST("/effects/:id/unlock", s.adminEffectAction(func(c echo.Context, id int) error {
+		return s.effects.Lock(id, false)
+	}))
+	api.POST("/effects/:id/delete", s.adminEffectAction(func(c echo.Context, id int) error {
+		return s.effects.Delete(id)
+	}))
+	api.POST("/effects/:id/restore", s.adminEffectAction(func(c echo.Context, id int) error {
+		return s.effects.Restore(id)
+	}))
+	api.POST("/effects/:id/parent", s.adminEffectAction(func(c echo.Context, id int) error {
+		var p adminAPIParent
+		err := c.Bind(&p)
+		if err != nil {
+			return err
+		}
+		return s.effects.SetParent(id, p.Parent, p.ParentVersion)
+	}))
+	api.POST("/purge", s.adminPurgeHandler)
+	api.GET("/bans", s.adminBansHandler)
+	api.POST("/bans", s.adminBanAddHandler)
+	api.DELETE("/bans/:id", s.adminRemoveHandler(s.bans.Remove))
+	api.GET("/takedowns", s.adminTakedownsHandler)
+	api.POST("/takedowns", s.adminTakedownAddHandler)
+	api.GET("/blocks", s.adminBlocksHandler)
+	api.POST("/blocks", s.adminBlockAddHandler)
+	api.DELETE("/blocks/:id", s.adminRemoveHandler(s.takedowns.RemoveBlock))
+}
+
+// adminTokenMiddleware only lets through requests with the token in a
+// bearer Authorization header. Hashes are compared so the time does not
+// depend on the token length.
+func adminTokenMiddleware(token string) echo.MiddlewareFunc {
+	want := sha256.Sum256([]byte(token))
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			auth := c.Request().Header.Get(echo.HeaderAuthorization)
+			got, ok := strings.CutPrefix(auth, "Bearer ")
+			sum := sha256.Sum256([]byte(got))
+			if !ok || subtle.ConstantTimeCompare(want[:], sum[:]) != 1 {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+				return c.JSON(http.StatusUnauthorized, adminAPIError{Error: "not authorized"})
+			}
+			return next(c)
+		}
+	}
+}
+
+// adminAPIFail sends an error response, not found errors get status 404
+// and invalid input 400.
+func adminAPIFail(c echo.Context, err error) error {
+	code := http.StatusInternalServerError
+	var he *echo.HTTPError
+	switch {
+	case errors.Is(err, store.ErrNotFound), errors.Is(err, sql.ErrNoRows):
+		code = http.StatusNotFound
+	case errors.Is(err, store.ErrInvalid):
+		code = http.StatusBadRequest
+	case errors.As(err, &he):
+		code = he.Code
+	default:
+		c.Logger().Errorf("admin api error: %s", err.Error())
+	}
+
+	return c.JSON(code, adminAPIError{Error: err.Error()})
+}
+
+func (s *Server) adminListHandler(c echo.Context) error {
+	opts := store.ListOptions{
+		User:   c.QueryParam("user"),
+		Hidden: c.QueryParam("hidden") == "true",
+	}
+
+	if since := c.QueryParam("since"); since != "" {
+		t, err := time.Parse(time.RFC3339Nano, since)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, adminAPIError{Error: "malformed since"})
+		}
+		opts.Since = t
+	}
+
+	page := 0
+	if p := c.QueryParam("page"); p != "" {
+		var err error
+		page, err = strconv.Atoi(p)
+		if err != nil || page < 0 {
+			return c.JSON(http.StatusBadRequest, adminAPIError{Error: "malformed page"})
+		}
+	}
+
+	limit := adminAPIPageSize
+	if p := c.QueryParam("limit"); p != "" {
+		var err error
+		limit, err = strconv.Atoi(p)
+		if err != nil || limit < 1 {
+			return c.JSON(http.StatusBadRequest, adminAPIError{Error: "malformed limit"})
+		}
+		if limit > adminAPIMaxPageSize {
+			limit = adminAPIMaxPageSize
+		}
+	}
+
+	effects, err := s.effects.List(opts, page, limit)
+	if err != nil {
+		return adminAPIFail(c, err)
+	}
+	if effects == nil {
+		effects = []store.Effect{}
+	}
+
+	return c.JSON(http.StatusOK, effects)
+}
+
+func (s *Server) adminEffectHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, adminAPIError{Error: "malformed id"})
+	}
+
+	e, err := s.effects.Effect(id)
+	if err != nil {
+		return adminAPIFail(c, err)
+	}
+
+	return c.JSON(http.StatusOK, e)
+}
+
+// adminEffectAction creates a handler that runs an action on the effect in
+// the URL.
+func (s *Server) adminEffectAction(
+	action func(c echo.Context, id int) error,
+) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, adminAPIError{Error: "malformed id"})
+		}
+
+		err = action(c, id)
+		if err != nil {
+			return adminAPIFail(c, err)
+		}
+
+		return c.JSON(http.StatusOK, struct{}{})
+	}
+}
+
+// adminRemoveHandler creates a handler that removes the object in the URL.
+func (s *Server) adminRemoveHandler(remove func(id int) error) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, adminAPIError{Error: "malformed id"})
+		}
+
+		err = remove(id)
+		if err != nil {
+			return adminAPIFail(c, err)
+		}
+
+		return c.JSON(http.StatusOK, struct{}{})
+	}
+}
+
+func (s *Server) adminPurgeHandler(c echo.Context) error {
+	var p adminAPIPurge
+	err := c.Bind(&p)
+	if err != nil {
+		return adminAPIFail(c, err)
+	}
+
+	retention := s.deleteRetention
+	switch {
+	case p.All:
+		if p.Retention != "" {
+			return c.JSON(http.StatusBadRequest,
+				adminAPIError{Error: "retention can not be used with all"})
+		}
+		retention = 0
+	case p.Retention != "":
+		retention, err = time.ParseDuration(p.Retention)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, adminAPIError{Error: "malformed retention"})
+		}
+		if retention <= 0 {
+			return c.JSON(http.StatusBadRequest,
+				adminAPIError{Error: "retention must be positive, use all to empty the trash"})
+		}
+	case retention <= 0:
+		return c.JSON(http.StatusBadRequest,
+			adminAPIError{Error: "purge is disabled by DELETE_RETENTION, use all to empty the trash"})
+	}
+
+	ids, err := s.effects.Purge(time.Now().Add(-retention))
+	if err != nil {
+		return adminAPIFail(c, err)
+	}
+
+	for _, id := range ids {
+		err = s.thumbs.Remove(store.Effect{ID: id}.ImageName())
+		if err != nil {
+			c.Logger().Errorf("could not remove thumbnail: %s", err.Error())
+		}
+	}
+	if ids == nil {
+		ids = []int{}
+	}
+
+	return c.JSON(http.StatusOK, adminAPIPurged{Purged: ids})
+}
+
+func (s *Server) adminBansHandler(c echo.Context) error {
+	bans, err := s.bans.Bans()
+	if err != nil {
+		return adminAPIFail(c, err)
+	}
+	if bans == nil {
+		bans = []store.Ban{}
+	}
+
+	return c.JSON(http.StatusOK, bans)
+}
+
+func (s *Server) adminBanAddHandler(c echo.Context) error {
+	var b store.Ban
+	err := c.Bind(&b)
+	if err != nil {
+		return adminAPIFail(c, err)
+	}
+
+	id, err := s.bans.Add(b)
+	if err != nil {
+		return adminAPIFail(c, err)
+	}
+
+	return c.JSON(http.StatusOK, adminAPIID{ID: id})
+}
+
+func (s *Server) adminTakedownsHandler(c echo.Context) error {
+	list, err := s.takedowns.Takedowns()
+	if err != nil {
+		return adminAPIFail(c, err)
+	}
+	if list == nil {
+		list = []store.Takedown{}
+	}
+
+	return c.JSON(http.StatusOK, list)
+}
+
+func (s *Server) adminTakedownAddHandler(c echo.Context) error {
+	var t store.Takedown
+	err := c.Bind(&t)
+	if err != nil {
+		return adminAPIFail(c, err)
+	}
+
+	id, err := s.takedowns.TakeDown(s.effects, t)
+	if err != nil {
+		return adminAPIFail(c, err)
+	}
+
+	return c.JSON(http.StatusOK, adminAPIID{ID: id})
+}
+
+func (s *Server) adminBlocksHandler(c echo.Context) error {
+	list, err := s.takedowns.Blocks()
+	if err != nil {
+		return adminAPIFail(c, err)
+	}
+	if list == nil {
+		list = []store.Block{}
+	}
+
+	return c.JSON(http.StatusOK, list)
+}
+
+func (s *Server) adminBlockAddHandler(c echo.Context) error {
+	var b store.Block
+	err := c.Bind(&b)
+	if err != nil {
+		return adminAPIFail(c, err)
+	}
+
+	id, err := s.takedowns.AddBlock(b)
+	if err != nil {
+		return adminAPIFail(c, err)
+	}
+
+	return c.JSON(http.StatusOK, adminAPIID{ID: id})
+}
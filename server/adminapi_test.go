@@ -0,0 +1,176 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/mrdoob/glsl-sandbox/server/admin"
+	"github.com/mrdoob/glsl-sandbox/server/store"
+	"github.com/mrdoob/glsl-sandbox/server/thumb"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+func TestAdminAPI(t *testing.T) {
+	dataPath := t.TempDir()
+	db, err := sqlx.Connect(sqliteshim.ShimName,
+		"file:"+filepath.Join(dataPath, "test.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	effects, err := store.NewEffects(db)
+	require.NoError(t, err)
+	bans, err := store.NewBans(db)
+	require.NoError(t, err)
+	takedowns, err := store.NewTakedowns(db)
+	require.NoError(t, err)
+	thumbs, err := thumb.NewThumbs(filepath.Join(dataPath, pathThumbs))
+	require.NoError(t, err)
+
+	s := &Server{
+		echo:            echo.New(),
+		effects:         effects,
+		bans:            bans,
+		takedowns:       takedowns,
+		thumbs:          thumbs,
+		deleteRetention: time.Hour,
+	}
+	WithAdminToken("token")(s)
+	s.adminAPIRoutes()
+	srv := httptest.NewServer(s.echo)
+	defer srv.Close()
+
+	_, err = admin.NewClient(srv.URL, "")
+	require.Error(t, err)
+
+	bad, err := admin.NewClient(srv.URL, "bad")
+	require.NoError(t, err)
+	_, err = bad.Bans()
+	require.Error(t, err)
+
+	res, err := http.Get(srv.URL + "/api/admin/bans")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	c, err := admin.NewClient(srv.URL+"/", "token")
+	require.NoError(t, err)
+
+	id, err := effects.Add(-1, -1, "user", "code", store.Submitter{})
+	require.NoError(t, err)
+	fork, err := effects.Add(-1, -1, "other", "fork", store.Submitter{})
+	require.NoError(t, err)
+
+	e, err := c.Effect(id)
+	require.NoError(t, err)
+	require.Equal(t, "user", e.User)
+	require.Equal(t, "code", e.Versions[0].Code)
+
+	_, err = c.Effect(100)
+	require.True(t, errors.Is(err, store.ErrNotFound))
+
+	require.NoError(t, c.Hide(id, true))
+	list, err := c.List(store.ListOptions{Hidden: true}, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.Equal(t, id, list[0].ID)
+	list, err = c.List(store.ListOptions{User: "other"}, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.Equal(t, fork, list[0].ID)
+	require.NoError(t, c.Hide(id, false))
+
+	require.NoError(t, c.Lock(id, true))
+	require.NoError(t, c.SetParent(fork, id, 0))
+	// bad input is reported as such instead of as a server error
+	require.True(t, errors.Is(c.SetParent(fork, id, 5), store.ErrInvalid))
+	require.True(t, errors.Is(c.SetParent(fork, 100, 0), store.ErrInvalid))
+	require.True(t, errors.Is(c.SetParent(id, fork, 0), store.ErrInvalid))
+	e, err = effects.Effect(fork)
+	require.NoError(t, err)
+	require.Equal(t, id, e.Parent)
+
+	require.NoError(t, c.Delete(fork))
+	require.NoError(t, c.Restore(fork))
+	require.NoError(t, c.Delete(fork))
+	require.NoError(t, thumbs.Save(store.Effect{ID: fork}.ImageName(), []byte("png")))
+	purged, err := c.Purge(-1)
+	require.NoError(t, err)
+	require.Empty(t, purged)
+
+	// a zero or negative retention never empties the trash
+	for _, body := range []string{`{"retention":"0s"}`, `{"retention":"-1h"}`, `{"all":true,"retention":"1h"}`} {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/admin/purge", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer token")
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusBadRequest, res.StatusCode, body)
+	}
+	s.deleteRetention = 0
+	_, err = c.Purge(-1)
+	require.Error(t, err)
+	s.deleteRetention = time.Hour
+
+	purged, err = c.Purge(0)
+	require.NoError(t, err)
+	require.Equal(t, []int{fork}, purged)
+	_, err = os.Stat(filepath.Join(dataPath, pathThumbs, store.Effect{ID: fork}.ImageName()))
+	require.True(t, os.IsNotExist(err))
+
+	banID, err := c.AddBan(store.Ban{Value: "10.0.0.1", Reason: "spam"})
+	require.NoError(t, err)
+	banList, err := c.Bans()
+	require.NoError(t, err)
+	require.Len(t, banList, 1)
+	require.Equal(t, "spam", banList[0].Reason)
+	require.NoError(t, c.RemoveBan(banID))
+	require.True(t, errors.Is(c.RemoveBan(banID), store.ErrNotFound))
+	for _, b := range []store.Ban{
+		{Kind: store.BanIP, Value: "10.0.0.0/8"},
+		{Kind: store.BanCIDR, Value: "10.0.0.1"},
+		{Kind: "other", Value: "10.0.0.1"},
+	} {
+		_, err = c.AddBan(b)
+		require.True(t, errors.Is(err, store.ErrInvalid), b)
+	}
+
+	// the status code is also checked without the client mapping it
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/admin/bans",
+		strings.NewReader(`{"kind":"ip","value":"nope"}`))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("Content-Type", "application/json")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	_, err = c.TakeDown(store.Takedown{Effect: id})
+	require.True(t, errors.Is(err, store.ErrInvalid))
+	_, err = c.TakeDown(store.Takedown{Effect: id, Requester: "r", Reason: "legal"})
+	require.NoError(t, err)
+	tds, err := c.Takedowns()
+	require.NoError(t, err)
+	require.Len(t, tds, 1)
+	blocks, err := c.Blocks()
+	require.NoError(t, err)
+	require.Len(t, blocks, 1)
+	require.NoError(t, c.RemoveBlock(blocks[0].ID))
+	_, err = c.AddBlock(store.Block{Kind: store.BlockRegex, Value: "("})
+	require.True(t, errors.Is(err, store.ErrInvalid))
+	_, err = c.AddBlock(store.Block{Kind: "other", Value: "bad"})
+	require.True(t, errors.Is(err, store.ErrInvalid))
+	blockID, err := c.AddBlock(store.Block{Kind: store.BlockRegex, Value: "bad"})
+	require.NoError(t, err)
+	require.NotZero(t, blockID)
+}
@@ -127,7 +127,9 @@ function save() {
 		function(result) {
 			window.location.replace('/e#'+result);
 			load_url_code();
-		}, "text");
+		}, "text").fail(function(xhr) {
+			alert('Could not save: ' + (xhr.responseText || xhr.statusText));
+		});
 }
 
 function load_code(hash) {
@@ -157,11 +159,14 @@ function load_code(hash) {
 		}
 
 		effect_owner=result['user'];
+		if(result['locked'])
+			effect_owner=false;
 
 		if(am_i_owner())
 			saveButton.textContent = 'save';
 		else
 			saveButton.textContent = 'fork';
+		saveButton.title = result['locked'] ? 'effect is locked' : '';
 
 		resetSurface();
 		compile();
@@ -144,6 +144,37 @@ func (a *Auth) CheckPermissions(c echo.Context) error {
 	return nil
 }
 
+// Moderator checks if the request carries a valid token of an admin or
+// moderator. It is used in public routes that show more information to
+// moderators.
+func (a *Auth) Moderator(c echo.Context) bool {
+	cookie, err := c.Cookie(accessTokenCookieName)
+	if err != nil {
+		return false
+	}
+
+	token, err := jwt.ParseWithClaims(
+		cookie.Value,
+		new(Claims),
+		func(t *jwt.Token) (interface{}, error) {
+			if t.Method.Alg() != jwt.SigningMethodHS256.Alg() {
+				return nil, fmt.Errorf("unexpected signing method: %s", t.Method.Alg())
+			}
+			return []byte(a.secret), nil
+		},
+	)
+	if err != nil || !token.Valid {
+		return false
+	}
+
+	claims, ok := token.Claims.(*Claims)
+	if !ok {
+		return false
+	}
+
+	return claims.Role == store.RoleAdmin || claims.Role == store.RoleModerator
+}
+
 func (a *Auth) Middleware(
 	f func(error, echo.Context) error,
 ) echo.MiddlewareFunc {
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrdoob/glsl-sandbox/server/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthModerator(t *testing.T) {
+	e := echo.New()
+	auth := NewAuth(nil, "secret")
+
+	token := func(a *Auth, role store.Role) *http.Cookie {
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+		err := a.GenerateToken(c, store.User{Name: "name", Role: role})
+		require.NoError(t, err)
+		cookies := rec.Result().Cookies()
+		require.Len(t, cookies, 1)
+		return cookies[0]
+	}
+
+	moderator := func(cookie *http.Cookie) bool {
+		req := httptest.NewRequest(http.MethodGet, "/item/1.0", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		return auth.Moderator(e.NewContext(req, httptest.NewRecorder()))
+	}
+
+	require.False(t, moderator(nil))
+	require.True(t, moderator(token(auth, store.RoleAdmin)))
+	require.True(t, moderator(token(auth, store.RoleModerator)))
+	require.False(t, moderator(token(auth, store.RoleUser)))
+	require.False(t, moderator(token(NewAuth(nil, "other"), store.RoleAdmin)))
+	require.False(t, moderator(&http.Cookie{
+		Name:  accessTokenCookieName,
+		Value: "garbage",
+	}))
+}
@@ -0,0 +1,589 @@
+// Package backup creates and restores archives with a consistent snapshot
+// of the database and the thumbnails. Archives are gzip compressed tar
+// files with a manifest holding the size and checksum of each file.
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+const (
+	// DatabaseName is the name of the database file in the data path and in
+	// the archives.
+	DatabaseName = "glslsandbox.db"
+	// ThumbsDir is the name of the thumbnails directory in the data path and
+	// in the archives.
+	ThumbsDir = "thumbs"
+	// SaltName is the file in the data path and in the archives with the
+	// generated salt of submitter fingerprints. Bans of clients only match
+	// with the same salt.
+	SaltName = "submitter_salt"
+
+	manifestName  = "manifest.json"
+	formatVersion = 1
+	archivePrefix = "glslsandbox-"
+	archiveSuffix = ".tar.gz"
+	oldSuffix     = ".old"
+)
+
+// rename moves files in replace, tests change it to simulate failures.
+var rename = os.Rename
+
+// File describes a file stored in an archive.
+type File struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest is the last file of an archive and lists all the others.
+type Manifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Files     []File    `json:"files"`
+}
+
+// Create writes an archive with a snapshot of the database, the submitter
+// salt and the thumbnails in dataPath. The database snapshot is made with VACUUM INTO in
+// a temporary file inside tmpDir so it can be taken while the server is
+// running.
+func Create(w io.Writer, db *sqlx.DB, dataPath string, tmpDir string) (Manifest, error) {
+	tmp, err := os.MkdirTemp(tmpDir, ".backup-")
+	if err != nil {
+		return Manifest{}, fmt.Errorf("could not create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	snapshot := filepath.Join(tmp, DatabaseName)
+	_, err = db.Exec("VACUUM INTO ?", snapshot)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("could not snapshot database: %w", err)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	m := Manifest{
+		Version:   formatVersion,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	f, err := addFile(tw, DatabaseName, snapshot)
+	if err != nil {
+		return Manifest{}, err
+	}
+	m.Files = append(m.Files, f)
+
+	// the salt is only there when it was generated
+	salt := filepath.Join(dataPath, SaltName)
+	_, err = os.Stat(salt)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Manifest{}, fmt.Errorf("could not read submitter salt: %w", err)
+	}
+	if err == nil {
+		f, err := addFile(tw, SaltName, salt)
+		if err != nil {
+			return Manifest{}, err
+		}
+		m.Files = append(m.Files, f)
+	}
+
+	thumbs, err := os.ReadDir(filepath.Join(dataPath, ThumbsDir))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Manifest{}, fmt.Errorf("could not read thumbnails: %w", err)
+	}
+	for _, t := range thumbs {
+		if !t.Type().IsRegular() {
+			continue
+		}
+
+		f, err := addFile(tw,
+			path.Join(ThumbsDir, t.Name()),
+			filepath.Join(dataPath, ThumbsDir, t.Name()),
+		)
+		if err != nil {
+			return Manifest{}, err
+		}
+		m.Files = append(m.Files, f)
+	}
+
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return Manifest{}, fmt.Errorf("could not encode manifest: %w", err)
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Mode:    0640,
+		Size:    int64(len(data)),
+		ModTime: m.CreatedAt,
+	})
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+	if err != nil {
+		return Manifest{}, fmt.Errorf("could not write manifest: %w", err)
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return Manifest{}, fmt.Errorf("could not close archive: %w", err)
+	}
+	err = gz.Close()
+	if err != nil {
+		return Manifest{}, fmt.Errorf("could not close archive: %w", err)
+	}
+
+	return m, nil
+}
+
+// addFile copies a file to the archive and returns its description.
+func addFile(tw *tar.Writer, name string, p string) (File, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return File{}, fmt.Errorf("could not open %s: %w", name, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return File{}, fmt.Errorf("could not stat %s: %w", name, err)
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0640,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	})
+	if err != nil {
+		return File{}, fmt.Errorf("could not write %s: %w", name, err)
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tw, h), f)
+	if err != nil {
+		return File{}, fmt.Errorf("could not write %s: %w", name, err)
+	}
+
+	return File{
+		Name:   name,
+		Size:   n,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// Save creates an archive in dir named after the current time and returns
+// its path. A random suffix keeps archives saved at the same time apart.
+// The archive is written to a temporary file first so partial archives are
+// never left with the final name.
+func Save(dir string, db *sqlx.DB, dataPath string) (string, error) {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return "", fmt.Errorf("could not create backup directory: %w", err)
+	}
+
+	suffix := make([]byte, 4)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return "", fmt.Errorf("could not generate backup name: %w", err)
+	}
+	name := archivePrefix +
+		time.Now().UTC().Format("20060102-150405.000000") + "-" +
+		hex.EncodeToString(suffix) + archiveSuffix
+	p := filepath.Join(dir, name)
+
+	f, err := os.CreateTemp(dir, ".backup-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("could not create backup file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, err = Create(f, db, dataPath, dir)
+	if err != nil {
+		return "", err
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return "", fmt.Errorf("could not write backup file: %w", err)
+	}
+	err = f.Close()
+	if err != nil {
+		return "", fmt.Errorf("could not write backup file: %w", err)
+	}
+
+	err = os.Rename(f.Name(), p)
+	if err != nil {
+		return "", fmt.Errorf("could not rename backup file: %w", err)
+	}
+
+	return p, nil
+}
+
+// Verify reads a whole archive and checks its files against the manifest.
+func Verify(r io.Reader) (Manifest, error) {
+	return extract(r, "")
+}
+
+// extract reads an archive checking its files against the manifest and
+// writes them to dir when it is not empty.
+func extract(r io.Reader, dir string) (Manifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("malformed archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+
+	var m *Manifest
+	files := make(map[string]File)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Manifest{}, fmt.Errorf("malformed archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return Manifest{}, fmt.Errorf("unexpected entry %s in archive", hdr.Name)
+		}
+		if m != nil {
+			return Manifest{}, fmt.Errorf("unexpected file %s after manifest", hdr.Name)
+		}
+
+		if hdr.Name == manifestName {
+			m = new(Manifest)
+			err = json.NewDecoder(io.LimitReader(tr, 64*1024*1024)).Decode(m)
+			if err != nil {
+				return Manifest{}, fmt.Errorf("malformed manifest: %w", err)
+			}
+			continue
+		}
+
+		if !validName(hdr.Name) {
+			return Manifest{}, fmt.Errorf("unexpected file %s in archive", hdr.Name)
+		}
+		if _, ok := files[hdr.Name]; ok {
+			return Manifest{}, fmt.Errorf("duplicated file %s in archive", hdr.Name)
+		}
+
+		f, err := readFile(tr, hdr.Name, dir)
+		if err != nil {
+			return Manifest{}, err
+		}
+		files[hdr.Name] = f
+	}
+
+	if m == nil {
+		return Manifest{}, fmt.Errorf("archive has no manifest")
+	}
+	if m.Version != formatVersion {
+		return Manifest{}, fmt.Errorf("unsupported archive version %d", m.Version)
+	}
+	if len(m.Files) != len(files) {
+		return Manifest{}, fmt.Errorf("archive has %d files, manifest lists %d",
+			len(files), len(m.Files))
+	}
+	for _, f := range m.Files {
+		if files[f.Name] != f {
+			return Manifest{}, fmt.Errorf("file %s does not match the manifest", f.Name)
+		}
+	}
+	if _, ok := files[DatabaseName]; !ok {
+		return Manifest{}, fmt.Errorf("archive has no database")
+	}
+
+	return *m, nil
+}
+
+// validName checks that an archive file is the database, the salt or a
+// thumbnail.
+func validName(name string) bool {
+	if name == DatabaseName || name == SaltName {
+		return true
+	}
+
+	dir, file := path.Split(name)
+	return dir == ThumbsDir+"/" && file != "" && file != "." && file != ".."
+}
+
+// readFile reads an archive file computing its checksum and writes it to
+// dir when it is not empty.
+func readFile(r io.Reader, name string, dir string) (File, error) {
+	w := io.Discard
+	if dir != "" {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(p), 0750)
+		if err != nil {
+			return File{}, fmt.Errorf("could not create directory: %w", err)
+		}
+
+		mode := os.FileMode(0640)
+		if name == SaltName {
+			mode = 0600
+		}
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+		if err != nil {
+			return File{}, fmt.Errorf("could not create %s: %w", name, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), r)
+	if err != nil {
+		return File{}, fmt.Errorf("could not read %s: %w", name, err)
+	}
+
+	return File{
+		Name:   name,
+		Size:   n,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// Restore validates an archive and replaces the database, the salt and the
+// thumbnails in dataPath with its contents. The salt is kept when the
+// archive has none. The previous files are moved with the .old suffix while
+// restoring, and removed once everything is in place. The server must be
+// stopped while restoring.
+func Restore(archive string, dataPath string) (Manifest, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("could not open archive: %w", err)
+	}
+	defer f.Close()
+
+	tmp, err := os.MkdirTemp(dataPath, ".restore-")
+	if err != nil {
+		return Manifest{}, fmt.Errorf("could not create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	m, err := extract(f, tmp)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	err = checkDatabase(filepath.Join(tmp, DatabaseName))
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	err = os.MkdirAll(filepath.Join(tmp, ThumbsDir), 0750)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("could not create thumbnails directory: %w", err)
+	}
+
+	names := []string{DatabaseName, ThumbsDir}
+	_, err = os.Stat(filepath.Join(tmp, SaltName))
+	if err == nil {
+		names = append(names, SaltName)
+	}
+
+	// put back the files already replaced if a later one fails so the
+	// database always matches its thumbnails and salt
+	var replaced []string
+	for _, name := range names {
+		dst := filepath.Join(dataPath, name)
+		err = replace(filepath.Join(tmp, name), dst)
+		if err != nil {
+			for _, r := range replaced {
+				rerr := rollback(r)
+				if rerr != nil {
+					return Manifest{}, fmt.Errorf("%w, and %s", err, rerr.Error())
+				}
+			}
+			return Manifest{}, err
+		}
+		replaced = append(replaced, dst)
+	}
+
+	for _, r := range replaced {
+		err = os.RemoveAll(r + oldSuffix)
+		if err != nil {
+			return m, fmt.Errorf("restored backup but could not remove %s: %w", r+oldSuffix, err)
+		}
+	}
+
+	return m, nil
+}
+
+// checkDatabase runs the SQLite integrity check on a database file.
+func checkDatabase(p string) error {
+	db, err := sqlx.Open(sqliteshim.ShimName, "file:"+p)
+	if err != nil {
+		return fmt.Errorf("could not open database: %w", err)
+	}
+	defer db.Close()
+
+	var result string
+	err = db.Get(&result, "PRAGMA integrity_check")
+	if err != nil {
+		return fmt.Errorf("could not check database: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("database integrity check failed: %s", result)
+	}
+	return nil
+}
+
+// replace moves src to dst keeping the previous dst with the .old suffix.
+func replace(src string, dst string) error {
+	old := dst + oldSuffix
+	err := os.RemoveAll(old)
+	if err != nil {
+		return fmt.Errorf("could not remove %s: %w", old, err)
+	}
+
+	err = rename(dst, old)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not move %s: %w", dst, err)
+	}
+
+	err = rename(src, dst)
+	if err != nil {
+		_ = rename(old, dst)
+		return fmt.Errorf("could not move %s: %w", dst, err)
+	}
+	return nil
+}
+
+// rollback undoes replace moving the .old file back to dst. dst is removed
+// when there was no previous file.
+func rollback(dst string) error {
+	err := os.RemoveAll(dst)
+	if err != nil {
+		return fmt.Errorf("could not remove restored %s: %w", dst, err)
+	}
+
+	err = rename(dst+oldSuffix, dst)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not move back %s: %w", dst, err)
+	}
+	return nil
+}
+
+// Prune removes the oldest archives in dir keeping the newest keep ones and
+// returns the removed paths. Nothing is removed when keep is less than 1.
+func Prune(dir string, keep int) ([]string, error) {
+	if keep < 1 {
+		return nil, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read backup directory: %w", err)
+	}
+
+	var archives []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.Type().IsRegular() &&
+			strings.HasPrefix(name, archivePrefix) &&
+			strings.HasSuffix(name, archiveSuffix) {
+			archives = append(archives, name)
+		}
+	}
+	if len(archives) <= keep {
+		return nil, nil
+	}
+
+	// names contain the creation time so they sort chronologically
+	sort.Strings(archives)
+
+	var removed []string
+	for _, name := range archives[:len(archives)-keep] {
+		p := filepath.Join(dir, name)
+		err = os.Remove(p)
+		if err != nil {
+			return removed, fmt.Errorf("could not remove backup: %w", err)
+		}
+		removed = append(removed, p)
+	}
+
+	return removed, nil
+}
+
+// Scheduler creates backups periodically and removes the old ones.
+type Scheduler struct {
+	db       *sqlx.DB
+	dataPath string
+	dir      string
+	interval time.Duration
+	keep     int
+	// Logf logs the backups made and their errors.
+	Logf func(format string, args ...interface{})
+}
+
+// NewScheduler creates a scheduler that saves a backup of dataPath in dir
+// every interval keeping the newest keep ones.
+func NewScheduler(
+	db *sqlx.DB,
+	dataPath string,
+	dir string,
+	interval time.Duration,
+	keep int,
+) *Scheduler {
+	return &Scheduler{
+		db:       db,
+		dataPath: dataPath,
+		dir:      dir,
+		interval: interval,
+		keep:     keep,
+		Logf:     func(string, ...interface{}) {},
+	}
+}
+
+// Run saves backups until stop is closed. The first one is made after the
+// first interval. Nothing is saved when the interval is not positive.
+func (s *Scheduler) Run(stop <-chan struct{}) {
+	if s.interval <= 0 {
+		s.Logf("backups disabled, interval %s is not positive", s.interval)
+		return
+	}
+
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		p, err := Save(s.dir, s.db, s.dataPath)
+		if err != nil {
+			s.Logf("could not save backup: %s", err.Error())
+			continue
+		}
+		s.Logf("saved backup %s", p)
+
+		removed, err := Prune(s.dir, s.keep)
+		if err != nil {
+			s.Logf("could not remove old backups: %s", err.Error())
+		}
+		for _, r := range removed {
+			s.Logf("removed old backup %s", r)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mrdoob/glsl-sandbox/server/store"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+func newDataPath(t *testing.T) (string, *sqlx.DB, *store.Effects) {
+	t.Helper()
+
+	dataPath := t.TempDir()
+	db, err := sqlx.Connect(sqliteshim.ShimName,
+		"file:"+filepath.Join(dataPath, DatabaseName))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	effects, err := store.NewEffects(db)
+	require.NoError(t, err)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dataPath, ThumbsDir), 0750))
+	return dataPath, db, effects
+}
+
+func TestSaveRestore(t *testing.T) {
+	dataPath, db, effects := newDataPath(t)
+	id, err := effects.Add(-1, -1, "user", "code", store.Submitter{})
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dataPath, ThumbsDir, "1.png"), []byte("png"), 0640)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dataPath, SaltName), []byte("salt"), 0600)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	p, err := Save(dir, db, dataPath)
+	require.NoError(t, err)
+
+	f, err := os.Open(p)
+	require.NoError(t, err)
+	m, err := Verify(f)
+	f.Close()
+	require.NoError(t, err)
+	require.Len(t, m.Files, 3)
+	require.Equal(t, DatabaseName, m.Files[0].Name)
+	require.Equal(t, SaltName, m.Files[1].Name)
+	require.Equal(t, "thumbs/1.png", m.Files[2].Name)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	restorePath, _, _ := newDataPath(t)
+	err = os.WriteFile(filepath.Join(restorePath, SaltName), []byte("other"), 0600)
+	require.NoError(t, err)
+	_, err = Restore(p, restorePath)
+	require.NoError(t, err)
+
+	d, err := os.ReadFile(filepath.Join(restorePath, ThumbsDir, "1.png"))
+	require.NoError(t, err)
+	require.Equal(t, "png", string(d))
+	d, err = os.ReadFile(filepath.Join(restorePath, SaltName))
+	require.NoError(t, err)
+	require.Equal(t, "salt", string(d))
+	st, err := os.Stat(filepath.Join(restorePath, SaltName))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), st.Mode().Perm())
+
+	for _, name := range []string{DatabaseName, ThumbsDir, SaltName} {
+		_, err = os.Stat(filepath.Join(restorePath, name+oldSuffix))
+		require.True(t, os.IsNotExist(err))
+	}
+
+	rdb, err := sqlx.Connect(sqliteshim.ShimName,
+		"file:"+filepath.Join(restorePath, DatabaseName))
+	require.NoError(t, err)
+	defer rdb.Close()
+	restored, err := store.NewEffects(rdb)
+	require.NoError(t, err)
+	e, err := restored.Effect(id)
+	require.NoError(t, err)
+	require.Equal(t, "code", e.Versions[0].Code)
+}
+
+func TestSaveUnique(t *testing.T) {
+	dataPath, db, _ := newDataPath(t)
+	dir := t.TempDir()
+
+	p1, err := Save(dir, db, dataPath)
+	require.NoError(t, err)
+	p2, err := Save(dir, db, dataPath)
+	require.NoError(t, err)
+	require.NotEqual(t, p1, p2)
+
+	removed, err := Prune(dir, 1)
+	require.NoError(t, err)
+	require.Equal(t, []string{p1}, removed)
+}
+
+func TestRestoreRollback(t *testing.T) {
+	dataPath, db, effects := newDataPath(t)
+	_, err := effects.Add(-1, -1, "user", "code", store.Submitter{})
+	require.NoError(t, err)
+	p, err := Save(t.TempDir(), db, dataPath)
+	require.NoError(t, err)
+
+	restorePath, _, _ := newDataPath(t)
+	dbPath := filepath.Join(restorePath, DatabaseName)
+	previous, err := os.ReadFile(dbPath)
+	require.NoError(t, err)
+
+	// fail moving the restored thumbnails into place
+	rename = func(src, dst string) error {
+		if filepath.Base(dst) == ThumbsDir && filepath.Base(src) == ThumbsDir {
+			return errors.New("rename failed")
+		}
+		return os.Rename(src, dst)
+	}
+	defer func() { rename = os.Rename }()
+
+	_, err = Restore(p, restorePath)
+	require.Error(t, err)
+
+	current, err := os.ReadFile(dbPath)
+	require.NoError(t, err)
+	require.Equal(t, previous, current)
+	_, err = os.Stat(filepath.Join(restorePath, ThumbsDir))
+	require.NoError(t, err)
+}
+
+// rewrite copies an archive changing its entries with fn.
+func rewrite(t *testing.T, p string, fn func(hdr *tar.Header, data []byte) []byte) []byte {
+	t.Helper()
+
+	f, err := os.Open(p)
+	require.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+
+		data = fn(hdr, data)
+		if data == nil {
+			continue
+		}
+		hdr.Size = int64(len(data))
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err = tw.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	return buf.Bytes()
+}
+
+func TestVerifyTampered(t *testing.T) {
+	dataPath, db, _ := newDataPath(t)
+	err := os.WriteFile(filepath.Join(dataPath, ThumbsDir, "1.png"), []byte("png"), 0640)
+	require.NoError(t, err)
+	p, err := Save(t.TempDir(), db, dataPath)
+	require.NoError(t, err)
+
+	changed := rewrite(t, p, func(hdr *tar.Header, data []byte) []byte {
+		if hdr.Name == "thumbs/1.png" {
+			return []byte("gif")
+		}
+		return data
+	})
+	_, err = Verify(bytes.NewReader(changed))
+	require.Error(t, err)
+
+	missing := rewrite(t, p, func(hdr *tar.Header, data []byte) []byte {
+		if hdr.Name == "thumbs/1.png" {
+			return nil
+		}
+		return data
+	})
+	_, err = Verify(bytes.NewReader(missing))
+	require.Error(t, err)
+
+	traversal := rewrite(t, p, func(hdr *tar.Header, data []byte) []byte {
+		if hdr.Name == "thumbs/1.png" {
+			hdr.Name = "../1.png"
+		}
+		return data
+	})
+	_, err = Verify(bytes.NewReader(traversal))
+	require.Error(t, err)
+
+	noManifest := rewrite(t, p, func(hdr *tar.Header, data []byte) []byte {
+		if hdr.Name == manifestName {
+			return nil
+		}
+		return data
+	})
+	_, err = Verify(bytes.NewReader(noManifest))
+	require.Error(t, err)
+
+	// a failed restore leaves the data path untouched
+	bad := filepath.Join(t.TempDir(), "bad.tar.gz")
+	require.NoError(t, os.WriteFile(bad, changed, 0640))
+	_, err = Restore(bad, dataPath)
+	require.Error(t, err)
+	_, err = os.Stat(filepath.Join(dataPath, DatabaseName+oldSuffix))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{
+		"glslsandbox-20220101-000000.tar.gz",
+		"glslsandbox-20220102-000000.tar.gz",
+		"glslsandbox-20220103-000000.tar.gz",
+		"other.tar.gz",
+	}
+	for _, n := range names {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, n), nil, 0640))
+	}
+
+	removed, err := Prune(dir, 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(dir, names[0])}, removed)
+
+	removed, err = Prune(dir, 0)
+	require.NoError(t, err)
+	require.Empty(t, removed)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+}
+
+func TestSchedulerDisabled(t *testing.T) {
+	dataPath, db, _ := newDataPath(t)
+	dir := t.TempDir()
+
+	s := NewScheduler(db, dataPath, dir, 0, 1)
+	var logged []string
+	s.Logf = func(format string, args ...interface{}) {
+		logged = append(logged, format)
+	}
+
+	// returns without a stop channel and without panicking
+	s.Run(nil)
+	require.Len(t, logged, 1)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrdoob/glsl-sandbox/server/store"
+)
+
+// banMiddleware rejects requests from banned clients.
+func (s *Server) banMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		sub := s.submitter(c)
+		b, err := s.bans.Match(c.RealIP(), sub.IP, sub.Fingerprint)
+		if errors.Is(err, store.ErrNotFound) {
+			return next(c)
+		}
+		if err != nil {
+			c.Logger().Errorf("could not check bans: %s", err.Error())
+			return c.String(http.StatusInternalServerError, "")
+		}
+
+		c.Logger().Infof("rejected banned client %s: ban %d", c.RealIP(), b.ID)
+		return c.String(http.StatusForbidden, "banned")
+	}
+}
+
+// banItem has information about each ban displayed in the bans page.
+type banItem struct {
+	// ID is the ban identifier.
+	ID int
+	// Kind is "ip", "cidr" or "client".
+	Kind string
+	// Value is the banned address, range or client hash.
+	Value string
+	// Reason is the moderator note.
+	Reason string
+	// CreatedAt is the date the ban was added.
+	CreatedAt string
+	// ExpiresAt is the expiration date or empty if it does not expire.
+	ExpiresAt string
+	// Expired is true if the ban is no longer in effect.
+	Expired bool
+}
+
+// bansData has information about the bans page.
+type bansData struct {
+	// Bans is the list of all bans.
+	Bans []banItem
+}
+
+func (s *Server) bansHandler(c echo.Context) error {
+	list, err := s.bans.Bans()
+	if err != nil {
+		c.Logger().Errorf("could not get bans: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "error")
+	}
+
+	now := time.Now()
+	bans := make([]banItem, len(list))
+	for i, b := range list {
+		expires := ""
+		if !b.ExpiresAt.IsZero() {
+			expires = b.ExpiresAt.Format(time.RFC3339)
+		}
+		bans[i] = banItem{
+			ID:        b.ID,
+			Kind:      string(b.Kind),
+			Value:     b.Value,
+			Reason:    b.Reason,
+			CreatedAt: b.CreatedAt.Format(time.RFC3339),
+			ExpiresAt: expires,
+			Expired:   b.Expired(now),
+		}
+	}
+
+	return c.Render(http.StatusOK, "bans", bansData{Bans: bans})
+}
+
+func (s *Server) bansPostHandler(c echo.Context) error {
+	ban := store.Ban{
+		Value:  strings.TrimSpace(c.FormValue("value")),
+		Reason: c.FormValue("reason"),
+	}
+
+	duration := strings.TrimSpace(c.FormValue("duration"))
+	if duration != "" {
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			c.Logger().Errorf("malformed ban duration: %s", err.Error())
+			return c.Redirect(http.StatusSeeOther, "/admin/bans")
+		}
+		ban.ExpiresAt = time.Now().Add(d)
+	}
+
+	_, err := s.bans.Add(ban)
+	if err != nil {
+		c.Logger().Errorf("could not add ban: %s", err.Error())
+	}
+
+	return c.Redirect(http.StatusSeeOther, "/admin/bans")
+}
+
+func (s *Server) bansRemoveHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.FormValue("id"))
+	if err != nil {
+		c.Logger().Errorf("malformed ban id: %s", err.Error())
+		return c.Redirect(http.StatusSeeOther, "/admin/bans")
+	}
+
+	err = s.bans.Remove(id)
+	if err != nil {
+		c.Logger().Errorf("could not remove ban: %s", err.Error())
+	}
+
+	return c.Redirect(http.StatusSeeOther, "/admin/bans")
+}
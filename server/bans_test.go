@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/mrdoob/glsl-sandbox/server/store"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+func TestBanMiddleware(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName, ":memory:")
+	require.NoError(t, err)
+
+	bans, err := store.NewBans(db)
+	require.NoError(t, err)
+
+	_, err = bans.Add(store.Ban{Value: "203.0.113.7"})
+	require.NoError(t, err)
+	_, err = bans.Add(store.Ban{Value: "198.51.100.0/24"})
+	require.NoError(t, err)
+
+	s := &Server{
+		echo: echo.New(),
+		bans: bans,
+		salt: "salt",
+	}
+	s.echo.IPExtractor = newIPExtractor(nil)
+
+	handler := s.banMiddleware(func(c echo.Context) error {
+		return c.String(http.StatusOK, "saved")
+	})
+
+	request := func(remote, xff, agent string) int {
+		req := httptest.NewRequest(http.MethodPost, "/e", nil)
+		req.RemoteAddr = remote
+		if xff != "" {
+			req.Header.Set(echo.HeaderXForwardedFor, xff)
+		}
+		req.Header.Set("User-Agent", agent)
+		rec := httptest.NewRecorder()
+		c := s.echo.NewContext(req, rec)
+		require.NoError(t, handler(c))
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusOK, request("192.0.2.1:1000", "", "agent"))
+	require.Equal(t, http.StatusForbidden, request("203.0.113.7:1000", "", "agent"))
+	require.Equal(t, http.StatusForbidden, request("198.51.100.20:1000", "", "agent"))
+	// Forwarded headers are not trusted without proxies.
+	require.Equal(t, http.StatusForbidden,
+		request("203.0.113.7:1000", "192.0.2.1", "agent"))
+
+	req := httptest.NewRequest(http.MethodPost, "/e", nil)
+	req.RemoteAddr = "192.0.2.2:1000"
+	req.Header.Set("User-Agent", "vandal")
+	hash := s.submitter(s.echo.NewContext(req, httptest.NewRecorder())).Fingerprint
+	_, err = bans.Add(store.Ban{Value: hash})
+	require.NoError(t, err)
+
+	require.Equal(t, http.StatusForbidden, request("192.0.2.2:1000", "", "vandal"))
+	// fingerprint bans hold when the client changes address
+	require.Equal(t, http.StatusForbidden, request("192.0.2.3:1000", "", "vandal"))
+	require.Equal(t, http.StatusOK, request("192.0.2.2:1000", "", "other"))
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	changesLimit    = 100
+	changesMaxLimit = 1000
+)
+
+// changeItem is each change returned by the change feed. Version is nil
+// when the change is about the whole effect.
+type changeItem struct {
+	Seq       int    `json:"seq"`
+	Kind      string `json:"kind"`
+	Effect    int    `json:"effect"`
+	Version   *int   `json:"version,omitempty"`
+	User      string `json:"user,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+// changesResponse is the change feed page. Last is the sequence number to
+// use as since in the next request.
+type changesResponse struct {
+	Changes []changeItem `json:"changes"`
+	Last    int          `json:"last"`
+}
+
+// changesHandler returns the changes after the since sequence number so
+// mirrors can keep up to date without crawling the gallery. The user of
+// effects that are not public is not included.
+func (s *Server) changesHandler(c echo.Context) error {
+	since := 0
+	if p := c.QueryParam("since"); p != "" {
+		var err error
+		since, err = strconv.Atoi(p)
+		if err != nil || since < 0 {
+			return c.String(http.StatusBadRequest, "{}")
+		}
+	}
+
+	limit := changesLimit
+	if p := c.QueryParam("limit"); p != "" {
+		var err error
+		limit, err = strconv.Atoi(p)
+		if err != nil || limit < 1 {
+			return c.String(http.StatusBadRequest, "{}")
+		}
+		if limit > changesMaxLimit {
+			limit = changesMaxLimit
+		}
+	}
+
+	changes, err := s.effects.FeedChanges(since, limit)
+	if err != nil {
+		c.Logger().Errorf("could not get changes: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "{}")
+	}
+
+	res := changesResponse{
+		Changes: make([]changeItem, len(changes)),
+		Last:    since,
+	}
+	for i, ch := range changes {
+		var version *int
+		if ch.Version >= 0 {
+			v := ch.Version
+			version = &v
+		}
+
+		res.Changes[i] = changeItem{
+			Seq:       ch.Seq,
+			Kind:      string(ch.Kind),
+			Effect:    ch.Effect,
+			Version:   version,
+			User:      ch.User,
+			CreatedAt: ch.CreatedAt.UTC().Format(time.RFC3339),
+		}
+		res.Last = ch.Seq
+	}
+
+	data, err := json.Marshal(res)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "{}")
+	}
+
+	return c.Blob(http.StatusOK, "application/json", data)
+}
+
+// effectVersion is each version returned by the effect API. The code of
+// hidden versions is not included.
+type effectVersion struct {
+	CreatedAt time.Time `json:"created_at"`
+	Code      string    `json:"code,omitempty"`
+	Hidden    bool      `json:"hidden,omitempty"`
+}
+
+// effectResponse is the effect API response with all the information
+// needed to replicate an effect.
+type effectResponse struct {
+	ID            int             `json:"id"`
+	CreatedAt     time.Time       `json:"created_at"`
+	ModifiedAt    time.Time       `json:"modified_at"`
+	Parent        int             `json:"parent"`
+	ParentVersion int             `json:"parent_version"`
+	User          string          `json:"user"`
+	Versions      []effectVersion `json:"versions"`
+}
+
+// effectAPIHandler returns an effect and all its versions. Hidden and
+// deleted effects are not found.
+func (s *Server) effectAPIHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "{}")
+	}
+
+	e, err := s.effects.Effect(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "{}")
+	}
+	if err != nil {
+		c.Logger().Errorf("could not get effect: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "{}")
+	}
+	if e.Hidden || e.Deleted() {
+		return c.String(http.StatusNotFound, "{}")
+	}
+
+	res := effectResponse{
+		ID:            e.ID,
+		CreatedAt:     e.CreatedAt.UTC(),
+		ModifiedAt:    e.ModifiedAt.UTC(),
+		Parent:        e.Parent,
+		ParentVersion: e.ParentVersion,
+		User:          e.User,
+		Versions:      make([]effectVersion, len(e.Versions)),
+	}
+	for i, v := range e.Versions {
+		res.Versions[i] = effectVersion{
+			CreatedAt: v.CreatedAt.UTC(),
+			Hidden:    v.Hidden,
+		}
+		if !v.Hidden {
+			res.Versions[i].Code = v.Code
+		}
+	}
+
+	data, err := json.Marshal(res)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "{}")
+	}
+
+	return c.Blob(http.StatusOK, "application/json", data)
+}
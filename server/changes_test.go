@@ -0,0 +1,143 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/mrdoob/glsl-sandbox/server/store"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+func TestChanges(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName, ":memory:")
+	require.NoError(t, err)
+	effects, err := store.NewEffects(db)
+	require.NoError(t, err)
+
+	s := &Server{
+		echo:    echo.New(),
+		effects: effects,
+	}
+	s.echo.GET("/api/changes", s.changesHandler)
+
+	get := func(query string) (int, changesResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/api/changes"+query, nil)
+		rec := httptest.NewRecorder()
+		s.echo.ServeHTTP(rec, req)
+
+		var res changesResponse
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		}
+		return rec.Code, res
+	}
+
+	id, err := effects.Add(-1, -1, "user", "first", store.Submitter{})
+	require.NoError(t, err)
+	_, err = effects.AddVersion(id, "second", store.Submitter{})
+	require.NoError(t, err)
+	require.NoError(t, effects.Hide(id, true))
+	require.NoError(t, effects.Delete(id))
+
+	code, res := get("")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 4, res.Last)
+	require.Len(t, res.Changes, 4)
+	kinds := make([]string, len(res.Changes))
+	for i, ch := range res.Changes {
+		require.Equal(t, id, ch.Effect)
+		kinds[i] = ch.Kind
+	}
+	require.Equal(t, []string{"created", "version", "hidden", "deleted"}, kinds)
+	require.Equal(t, 1, *res.Changes[1].Version)
+	require.Nil(t, res.Changes[2].Version)
+	// the user of effects that are not public is left out
+	for _, ch := range res.Changes {
+		require.Empty(t, ch.User)
+	}
+
+	code, res = get("?since=1&limit=2")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, res.Changes, 2)
+	require.Equal(t, 2, res.Changes[0].Seq)
+	require.Equal(t, 3, res.Last)
+
+	code, res = get("?since=4")
+	require.Equal(t, http.StatusOK, code)
+	require.Empty(t, res.Changes)
+	require.Equal(t, 4, res.Last)
+
+	public, err := effects.Add(-1, -1, "public", "code", store.Submitter{})
+	require.NoError(t, err)
+	version, err := effects.AddVersion(public, "spam", store.Submitter{})
+	require.NoError(t, err)
+	require.NoError(t, effects.HideVersion(public, version, true))
+	code, res = get("?since=4")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, res.Changes, 3)
+	require.Equal(t, "public", res.Changes[0].User)
+	require.Equal(t, "version", res.Changes[1].Kind)
+	require.Empty(t, res.Changes[1].User)
+
+	code, _ = get("?since=x")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = get("?limit=0")
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestEffectAPI(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName, ":memory:")
+	require.NoError(t, err)
+	effects, err := store.NewEffects(db)
+	require.NoError(t, err)
+
+	s := &Server{
+		echo:    echo.New(),
+		effects: effects,
+	}
+	s.echo.GET("/api/effect/:id", s.effectAPIHandler)
+
+	get := func(id string) (int, effectResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/api/effect/"+id, nil)
+		rec := httptest.NewRecorder()
+		s.echo.ServeHTTP(rec, req)
+
+		var res effectResponse
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		}
+		return rec.Code, res
+	}
+
+	id, err := effects.Add(-1, -1, "user", "first", store.Submitter{IP: "ip"})
+	require.NoError(t, err)
+	_, err = effects.AddVersion(id, "second", store.Submitter{})
+	require.NoError(t, err)
+	require.NoError(t, effects.HideVersion(id, 1, true))
+
+	code, res := get(strconv.Itoa(id))
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, id, res.ID)
+	require.Equal(t, "user", res.User)
+	require.Equal(t, -1, res.Parent)
+	require.Len(t, res.Versions, 2)
+	require.Equal(t, "first", res.Versions[0].Code)
+	require.False(t, res.Versions[0].Hidden)
+	require.Empty(t, res.Versions[1].Code)
+	require.True(t, res.Versions[1].Hidden)
+
+	require.NoError(t, effects.Hide(id, true))
+	code, _ = get(strconv.Itoa(id))
+	require.Equal(t, http.StatusNotFound, code)
+
+	code, _ = get("100")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = get("x")
+	require.Equal(t, http.StatusBadRequest, code)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mrdoob/glsl-sandbox/server/admin"
+	"github.com/mrdoob/glsl-sandbox/server/store"
+)
+
+// moderator has the operations that can run directly on the database or
+// through the admin API of a running server.
+type moderator interface {
+	Effect(id int) (store.Effect, error)
+	List(opts store.ListOptions, num int, size int) ([]store.Effect, error)
+	Hide(id int, hidden bool) error
+	Lock(id int, locked bool) error
+	Delete(id int) error
+	Restore(id int) error
+	SetParent(id int, parent int, parentVersion int) error
+	Purge(retention time.Duration) ([]int, error)
+	AddBan(b store.Ban) (int, error)
+	Bans() ([]store.Ban, error)
+	RemoveBan(id int) error
+	TakeDown(t store.Takedown) (int, error)
+	Takedowns() ([]store.Takedown, error)
+	AddBlock(b store.Block) (int, error)
+	Blocks() ([]store.Block, error)
+	RemoveBlock(id int) error
+}
+
+var _ moderator = (*admin.Client)(nil)
+var _ moderator = (*localModerator)(nil)
+
+// localModerator runs the moderation operations on the database file.
+type localModerator struct {
+	*store.Effects
+	s *stores
+}
+
+// Purge removes the effects deleted before retention and their thumbnails.
+// The configured retention is used when it is negative and zero removes all
+// the trash. Like in the server, a configured retention of zero or less
+// disables purging.
+func (d *localModerator) Purge(retention time.Duration) ([]int, error) {
+	if retention < 0 {
+		retention = d.s.cfg.DeleteRetention
+		if retention <= 0 {
+			return nil, fmt.Errorf("purge is disabled by DELETE_RETENTION, use --all to empty the trash")
+		}
+	}
+
+	ids, err := d.Effects.Purge(time.Now().Add(-retention))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		err = d.s.thumbs.Remove(store.Effect{ID: id}.ImageName())
+		if err != nil {
+			fmt.Printf("could not remove thumbnail: %s\n", err.Error())
+		}
+	}
+
+	return ids, nil
+}
+
+func (d *localModerator) AddBan(b store.Ban) (int, error) {
+	return d.s.bans.Add(b)
+}
+
+func (d *localModerator) Bans() ([]store.Ban, error) {
+	return d.s.bans.Bans()
+}
+
+func (d *localModerator) RemoveBan(id int) error {
+	return d.s.bans.Remove(id)
+}
+
+func (d *localModerator) TakeDown(t store.Takedown) (int, error) {
+	return d.s.takedowns.TakeDown(d.Effects, t)
+}
+
+func (d *localModerator) Takedowns() ([]store.Takedown, error) {
+	return d.s.takedowns.Takedowns()
+}
+
+func (d *localModerator) AddBlock(b store.Block) (int, error) {
+	return d.s.takedowns.AddBlock(b)
+}
+
+func (d *localModerator) Blocks() ([]store.Block, error) {
+	return d.s.takedowns.Blocks()
+}
+
+func (d *localModerator) RemoveBlock(id int) error {
+	return d.s.takedowns.RemoveBlock(id)
+}
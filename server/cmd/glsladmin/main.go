@@ -5,14 +5,21 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/mrdoob/glsl-sandbox/server/admin"
+	"github.com/mrdoob/glsl-sandbox/server/backup"
+	"github.com/mrdoob/glsl-sandbox/server/mirror"
 	"github.com/mrdoob/glsl-sandbox/server/store"
+	"github.com/mrdoob/glsl-sandbox/server/thumb"
 	"github.com/uptrace/bun/driver/sqliteshim"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -24,7 +31,15 @@ var (
 )
 
 type Config struct {
-	DataPath string `envconfig:"DATA_PATH" default:"./data"`
+	DataPath        string        `envconfig:"DATA_PATH" default:"./data"`
+	DeleteRetention time.Duration `envconfig:"DELETE_RETENTION" default:"720h"`
+	// AdminURL is the address of a running server. When set moderation
+	// commands use its admin API instead of the database file.
+	AdminURL   string `envconfig:"ADMIN_URL"`
+	AdminToken string `envconfig:"ADMIN_TOKEN"`
+	// DeltaSnapshots stores imported and mirrored code as deltas like the
+	// server does.
+	DeltaSnapshots int `envconfig:"DELTA_SNAPSHOTS"`
 }
 
 func main() {
@@ -35,19 +50,112 @@ func main() {
 	}
 }
 
-type cmd func(*store.Users) error
+type stores struct {
+	cfg       Config
+	db        *sqlx.DB
+	users     *store.Users
+	bans      *store.Bans
+	effects   *store.Effects
+	takedowns *store.Takedowns
+	mirrors   *store.Mirrors
+	thumbs    *thumb.Thumbs
+	moderator moderator
+}
+
+type cmd func(*stores) error
 
 var commands = map[string]cmd{
-	"list":   list,
-	"add":    createUser,
-	"passwd": changePassword,
+	"list":     needsDatabase(list),
+	"add":      needsDatabase(createUser),
+	"passwd":   needsDatabase(changePassword),
+	"ban":      ban,
+	"effect":   effect,
+	"takedown": takedown,
+	"block":    block,
+	"mirror":   needsDatabase(mirrorSync),
+	"export":   needsDatabase(export),
+	"import":   needsDatabase(importDump),
+	"backup":   needsDatabase(backupSave),
+	"restore":  needsDatabase(backupRestore),
+	"db":       needsDatabase(database),
+}
+
+var banCommands = map[string]cmd{
+	"add":    banAdd,
+	"list":   banList,
+	"remove": banRemove,
+}
+
+var effectCommands = map[string]cmd{
+	"show":       effectShow,
+	"code":       effectCode,
+	"hide":       effectHide,
+	"unhide":     effectUnhide,
+	"list":       effectList,
+	"set-parent": effectSetParent,
+	"delete":     effectDelete,
+	"restore":    effectRestore,
+	"purge":      effectPurge,
+	"lock":       effectLock,
+	"unlock":     effectUnlock,
+}
+
+var dbCommands = map[string]cmd{
+	"check":   dbCheck,
+	"vacuum":  dbVacuum,
+	"reindex": dbReindex,
+	"stats":   dbStats,
+}
+
+var takedownCommands = map[string]cmd{
+	"add":  takedownAdd,
+	"list": takedownList,
+}
+
+var blockCommands = map[string]cmd{
+	"add":    blockAdd,
+	"code":   blockCode,
+	"list":   blockList,
+	"remove": blockRemove,
 }
 
 func usage() {
 	fmt.Println(`Usage:
 	glsladmin list -- list users
 	glsladmin add <name> [<email>] -- add new user
-	glsladmin passwd <name> -- change user password`)
+	glsladmin passwd <name> -- change user password
+	glsladmin ban add <ip|cidr|client hash> [<duration>] [<reason>] -- ban client
+	glsladmin ban list -- list bans
+	glsladmin ban remove <id> -- remove ban
+	glsladmin effect show <id> -- show effect information and versions
+	glsladmin effect code <id>[.<version>] -- print the code of a version, the last one by default
+	glsladmin effect hide <id> -- hide effect
+	glsladmin effect unhide <id> -- unhide effect
+	glsladmin effect list [--user <user>] [--since <date>] [--hidden] [--limit <n>] -- list effects, most recently modified first
+	glsladmin effect set-parent <id> <parent>[.<version>] -- change the effect it was forked from, -1 for none
+	glsladmin effect delete <id> -- move effect to the trash
+	glsladmin effect restore <id> -- take effect out of the trash
+	glsladmin effect purge [--all] [<retention>] -- remove effects deleted before retention
+	glsladmin effect lock <id> -- refuse new versions of effect
+	glsladmin effect unlock <id> -- accept new versions of effect
+	glsladmin takedown add <id> <requester> <reason> -- remove effect and block its code
+	glsladmin takedown list -- list takedowns
+	glsladmin block add <hash|regex> <value> -- block normalized code hash or pattern
+	glsladmin block code <file> -- block the code in file
+	glsladmin block list -- list blocks
+	glsladmin block remove <id> -- remove block
+	glsladmin mirror <url> [<interval>] -- copy effects from another instance, keep polling if interval is set
+	glsladmin export [--since <date>] [--include-hidden] -- write effects to stdout in import format
+	glsladmin import [--batch <n>] [--conflict skip|overwrite|renumber] [--restart] [--thumbs <dir> [--thumbs-only]] <file> -- import effects
+	glsladmin backup <dir> -- save database and thumbnails snapshot archive in dir
+	glsladmin restore <archive> -- validate archive and replace database and thumbnails, server must be stopped
+	glsladmin db check [--fix] -- check database integrity and find orphaned versions, effects and thumbnails, fix removes them
+	glsladmin db vacuum -- rebuild database file releasing unused space
+	glsladmin db reindex -- rebuild database indexes
+	glsladmin db stats -- show database size and table rows
+
+With ADMIN_URL and ADMIN_TOKEN set, ban, effect, takedown and block commands
+use the admin API of the server at ADMIN_URL instead of the database file.`)
 	fmt.Println()
 }
 
@@ -56,15 +164,9 @@ func start() error {
 	if err := envconfig.Process("GLSL_", &cfg); err != nil {
 		return fmt.Errorf("could not read environment config: %w", err)
 	}
-
-	db, err := sqlx.Open(sqliteshim.ShimName, dbURL(cfg.DataPath))
-	if err != nil {
-		return fmt.Errorf("could not open database: %w", err)
-	}
-
-	users, err := store.NewUsers(db)
-	if err != nil {
-		return fmt.Errorf("could not initialize users database: %w", err)
+	if cfg.DeltaSnapshots > store.MaxDeltaSnapshots {
+		return fmt.Errorf("DELTA_SNAPSHOTS can not be greater than %d, got %d",
+			store.MaxDeltaSnapshots, cfg.DeltaSnapshots)
 	}
 
 	if len(os.Args) < 2 {
@@ -78,20 +180,101 @@ func start() error {
 		return fmt.Errorf("bad command")
 	}
 
-	err = c(users)
+	var s *stores
+	if cfg.AdminURL != "" {
+		client, err := admin.NewClient(cfg.AdminURL, cfg.AdminToken)
+		if err != nil {
+			return err
+		}
+		s = &stores{
+			cfg:       cfg,
+			moderator: client,
+		}
+	} else {
+		var err error
+		s, err = openStores(cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := c(s)
 	if err != nil {
 		usage()
 	}
 	return err
 }
 
+// openStores opens the database and thumbnails in the data path.
+func openStores(cfg Config) (*stores, error) {
+	db, err := sqlx.Open(sqliteshim.ShimName, dbURL(cfg.DataPath))
+	if err != nil {
+		return nil, fmt.Errorf("could not open database: %w", err)
+	}
+
+	users, err := store.NewUsers(db)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize users database: %w", err)
+	}
+
+	bans, err := store.NewBans(db)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize bans database: %w", err)
+	}
+
+	effects, err := store.NewEffects(db)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize effects database: %w", err)
+	}
+	effects.DeltaSnapshots = cfg.DeltaSnapshots
+
+	takedowns, err := store.NewTakedowns(db)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize takedowns database: %w", err)
+	}
+
+	mirrors, err := store.NewMirrors(db)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize mirrors database: %w", err)
+	}
+
+	thumbs, err := thumb.NewThumbs(filepath.Join(cfg.DataPath, "thumbs"))
+	if err != nil {
+		return nil, fmt.Errorf("could not open thumbnails directory: %w", err)
+	}
+
+	s := &stores{
+		cfg:       cfg,
+		db:        db,
+		users:     users,
+		bans:      bans,
+		effects:   effects,
+		takedowns: takedowns,
+		mirrors:   mirrors,
+		thumbs:    thumbs,
+	}
+	s.moderator = &localModerator{Effects: effects, s: s}
+
+	return s, nil
+}
+
+// needsDatabase marks commands that can not use the admin API.
+func needsDatabase(c cmd) cmd {
+	return func(s *stores) error {
+		if s.db == nil {
+			return fmt.Errorf("command needs direct database access, unset ADMIN_URL to use it")
+		}
+		return c(s)
+	}
+}
+
 func dbURL(path string) string {
 	file := filepath.Join(path, dbName)
 	return fmt.Sprintf("file:%s", file)
 }
 
-func list(users *store.Users) error {
-	list, err := users.Users()
+func list(s *stores) error {
+	list, err := s.users.Users()
 	if err != nil {
 		return err
 	}
@@ -109,7 +292,7 @@ func list(users *store.Users) error {
 	return nil
 }
 
-func createUser(users *store.Users) error {
+func createUser(s *stores) error {
 	user := ""
 	email := ""
 	switch len(os.Args) {
@@ -122,7 +305,7 @@ func createUser(users *store.Users) error {
 		return ErrNotEnoughParameters
 	}
 
-	_, err := users.User(user)
+	_, err := s.users.User(user)
 	if err == nil {
 		return fmt.Errorf("user already exist")
 	} else if !errors.Is(err, store.ErrNotFound) {
@@ -142,7 +325,7 @@ func createUser(users *store.Users) error {
 		Active:    true,
 		CreatedAt: time.Now(),
 	}
-	err = users.Add(u)
+	err = s.users.Add(u)
 	if err != nil {
 		return fmt.Errorf("could not create user: %w", err)
 	}
@@ -151,7 +334,7 @@ func createUser(users *store.Users) error {
 	return nil
 }
 
-func changePassword(users *store.Users) error {
+func changePassword(s *stores) error {
 	if len(os.Args) < 3 {
 		return ErrNotEnoughParameters
 	}
@@ -162,7 +345,7 @@ func changePassword(users *store.Users) error {
 		return err
 	}
 
-	err = users.UpdateFunc(user, func(u store.User) store.User {
+	err = s.users.UpdateFunc(user, func(u store.User) store.User {
 		u.Password = hashedPassword
 		return u
 	})
@@ -174,6 +357,876 @@ func changePassword(users *store.Users) error {
 	return nil
 }
 
+func ban(s *stores) error {
+	if len(os.Args) < 3 {
+		return ErrNotEnoughParameters
+	}
+
+	c, ok := banCommands[os.Args[2]]
+	if !ok {
+		return fmt.Errorf("bad ban command")
+	}
+
+	return c(s)
+}
+
+func banAdd(s *stores) error {
+	if len(os.Args) < 4 {
+		return ErrNotEnoughParameters
+	}
+
+	b := store.Ban{
+		Value: os.Args[3],
+	}
+	if len(os.Args) > 4 && os.Args[4] != "" {
+		d, err := time.ParseDuration(os.Args[4])
+		if err != nil {
+			return fmt.Errorf("malformed duration: %w", err)
+		}
+		b.ExpiresAt = time.Now().Add(d)
+	}
+	if len(os.Args) > 5 {
+		b.Reason = strings.Join(os.Args[5:], " ")
+	}
+
+	id, err := s.moderator.AddBan(b)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("created ban %d for '%s'\n", id, b.Value)
+	return nil
+}
+
+func banList(s *stores) error {
+	list, err := s.moderator.Bans()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, b := range list {
+		expires := "never"
+		if !b.ExpiresAt.IsZero() {
+			expires = b.ExpiresAt.Format(time.RFC3339)
+		}
+		if b.Expired(now) {
+			expires = "expired"
+		}
+
+		fmt.Printf("%d %s %s %s %q\n",
+			b.ID,
+			b.Kind,
+			b.Value,
+			expires,
+			b.Reason,
+		)
+	}
+
+	return nil
+}
+
+func banRemove(s *stores) error {
+	if len(os.Args) < 4 {
+		return ErrNotEnoughParameters
+	}
+
+	id, err := strconv.Atoi(os.Args[3])
+	if err != nil {
+		return fmt.Errorf("malformed ban id: %w", err)
+	}
+
+	err = s.moderator.RemoveBan(id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("removed ban %d\n", id)
+	return nil
+}
+
+func effect(s *stores) error {
+	if len(os.Args) < 3 {
+		return ErrNotEnoughParameters
+	}
+
+	c, ok := effectCommands[os.Args[2]]
+	if !ok {
+		return fmt.Errorf("bad effect command")
+	}
+
+	return c(s)
+}
+
+func effectID() (int, error) {
+	if len(os.Args) < 4 {
+		return 0, ErrNotEnoughParameters
+	}
+
+	id, err := strconv.Atoi(os.Args[3])
+	if err != nil {
+		return 0, fmt.Errorf("malformed effect id: %w", err)
+	}
+
+	return id, nil
+}
+
+func effectShow(s *stores) error {
+	id, err := effectID()
+	if err != nil {
+		return err
+	}
+
+	e, err := s.moderator.Effect(id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("id:       %d\n", e.ID)
+	fmt.Printf("user:     %s\n", e.User)
+	fmt.Printf("created:  %s\n", e.CreatedAt.Format(time.RFC3339))
+	fmt.Printf("modified: %s\n", e.ModifiedAt.Format(time.RFC3339))
+	if e.Parent >= 0 {
+		fmt.Printf("parent:   %d.%d\n", e.Parent, e.ParentVersion)
+	}
+	fmt.Printf("state:    %s\n", effectState(e))
+	fmt.Println()
+
+	fmt.Printf("%-8s %-25s %-8s %6s %8s  %s\n",
+		"version", "created", "hidden", "spam", "bytes", "code hash")
+	for i, v := range e.Versions {
+		fmt.Printf("%-8d %-25s %-8t %6d %8d  %s\n",
+			i,
+			v.CreatedAt.Format(time.RFC3339),
+			v.Hidden,
+			v.SpamScore,
+			len(v.Code),
+			v.CodeHash,
+		)
+	}
+
+	return nil
+}
+
+// effectState describes the moderation state of an effect.
+func effectState(e store.Effect) string {
+	var state []string
+	if e.Hidden {
+		state = append(state, "hidden")
+	}
+	if e.Deleted() {
+		state = append(state, "deleted "+e.DeletedAt.Format(time.RFC3339))
+	}
+	if e.Locked {
+		state = append(state, "locked")
+	}
+	if e.Review {
+		state = append(state, "review")
+	}
+	if len(state) == 0 {
+		return "visible"
+	}
+	return strings.Join(state, ", ")
+}
+
+func effectCode(s *stores) error {
+	if len(os.Args) < 4 {
+		return ErrNotEnoughParameters
+	}
+
+	id, version, err := parseVersionID(os.Args[3])
+	if err != nil {
+		return err
+	}
+
+	e, err := s.moderator.Effect(id)
+	if err != nil {
+		return err
+	}
+
+	if version < 0 {
+		version = len(e.Versions) - 1
+	}
+	if version < 0 || version >= len(e.Versions) {
+		return fmt.Errorf("effect %d has no version %d", id, version)
+	}
+
+	fmt.Print(e.Versions[version].Code)
+	return nil
+}
+
+// parseVersionID reads an effect id with an optional version in the
+// <id>.<version> format used by the gallery links. Version is -1 when it is
+// not set.
+func parseVersionID(v string) (int, int, error) {
+	idText, versionText, found := strings.Cut(v, ".")
+
+	id, err := strconv.Atoi(idText)
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed effect id: %w", err)
+	}
+	if !found {
+		return id, -1, nil
+	}
+
+	version, err := strconv.Atoi(versionText)
+	if err != nil || version < 0 {
+		return 0, 0, fmt.Errorf("malformed version %q", versionText)
+	}
+	return id, version, nil
+}
+
+func effectHide(s *stores) error {
+	id, err := effectID()
+	if err != nil {
+		return err
+	}
+
+	err = s.moderator.Hide(id, true)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("hidden effect %d\n", id)
+	return nil
+}
+
+func effectUnhide(s *stores) error {
+	id, err := effectID()
+	if err != nil {
+		return err
+	}
+
+	err = s.moderator.Hide(id, false)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("unhidden effect %d\n", id)
+	return nil
+}
+
+func effectList(s *stores) error {
+	flags := flag.NewFlagSet("effect list", flag.ContinueOnError)
+	user := flags.String("user", "", "only effects created with this user string")
+	since := flags.String("since", "", "only effects modified from this date")
+	hidden := flags.Bool("hidden", false, "only hidden effects")
+	limit := flags.Int("limit", 100, "maximum number of effects")
+	err := flags.Parse(os.Args[3:])
+	if err != nil {
+		return err
+	}
+
+	opts := store.ListOptions{
+		User:   *user,
+		Hidden: *hidden,
+	}
+	if *since != "" {
+		opts.Since, err = parseDate(*since)
+		if err != nil {
+			return err
+		}
+	}
+
+	effects, err := s.moderator.List(opts, 0, *limit)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-8s %-25s %-8s %-20s %s\n",
+		"id", "modified", "versions", "user", "state")
+	for _, e := range effects {
+		fmt.Printf("%-8d %-25s %-8d %-20s %s\n",
+			e.ID,
+			e.ModifiedAt.Format(time.RFC3339),
+			len(e.Versions),
+			e.User,
+			effectState(e),
+		)
+	}
+
+	return nil
+}
+
+func effectSetParent(s *stores) error {
+	if len(os.Args) < 5 {
+		return ErrNotEnoughParameters
+	}
+
+	id, err := effectID()
+	if err != nil {
+		return err
+	}
+
+	parent, version, err := parseVersionID(os.Args[4])
+	if err != nil {
+		return err
+	}
+	if parent >= 0 && version < 0 {
+		version = 0
+	}
+
+	err = s.moderator.SetParent(id, parent, version)
+	if err != nil {
+		return err
+	}
+
+	if parent < 0 {
+		fmt.Printf("effect %d has no parent now\n", id)
+	} else {
+		fmt.Printf("effect %d is now a fork of %d.%d\n", id, parent, version)
+	}
+	return nil
+}
+
+func effectDelete(s *stores) error {
+	id, err := effectID()
+	if err != nil {
+		return err
+	}
+
+	err = s.moderator.Delete(id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("moved effect %d to the trash\n", id)
+	return nil
+}
+
+func effectRestore(s *stores) error {
+	id, err := effectID()
+	if err != nil {
+		return err
+	}
+
+	err = s.moderator.Restore(id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("restored effect %d\n", id)
+	return nil
+}
+
+func effectLock(s *stores) error {
+	id, err := effectID()
+	if err != nil {
+		return err
+	}
+
+	err = s.moderator.Lock(id, true)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("locked effect %d\n", id)
+	return nil
+}
+
+func effectUnlock(s *stores) error {
+	id, err := effectID()
+	if err != nil {
+		return err
+	}
+
+	err = s.moderator.Lock(id, false)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("unlocked effect %d\n", id)
+	return nil
+}
+
+func effectPurge(s *stores) error {
+	flags := flag.NewFlagSet("effect purge", flag.ContinueOnError)
+	all := flags.Bool("all", false, "remove all the effects in the trash")
+	err := flags.Parse(os.Args[3:])
+	if err != nil {
+		return err
+	}
+
+	retention := time.Duration(-1)
+	switch {
+	case *all:
+		if flags.NArg() > 0 {
+			return fmt.Errorf("retention can not be used with --all")
+		}
+		retention = 0
+	case flags.NArg() > 0:
+		retention, err = time.ParseDuration(flags.Arg(0))
+		if err != nil {
+			return fmt.Errorf("malformed retention: %w", err)
+		}
+		if retention <= 0 {
+			return fmt.Errorf("retention must be positive, use --all to empty the trash")
+		}
+	}
+
+	ids, err := s.moderator.Purge(retention)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("purged %d effects\n", len(ids))
+	return nil
+}
+
+func takedown(s *stores) error {
+	if len(os.Args) < 3 {
+		return ErrNotEnoughParameters
+	}
+
+	c, ok := takedownCommands[os.Args[2]]
+	if !ok {
+		return fmt.Errorf("bad takedown command")
+	}
+
+	return c(s)
+}
+
+func takedownAdd(s *stores) error {
+	id, err := effectID()
+	if err != nil {
+		return err
+	}
+	if len(os.Args) < 6 {
+		return ErrNotEnoughParameters
+	}
+
+	t := store.Takedown{
+		Effect:    id,
+		Requester: os.Args[4],
+		Reason:    strings.Join(os.Args[5:], " "),
+	}
+	tid, err := s.moderator.TakeDown(t)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("created takedown %d for effect %d\n", tid, id)
+	return nil
+}
+
+func takedownList(s *stores) error {
+	list, err := s.moderator.Takedowns()
+	if err != nil {
+		return err
+	}
+
+	for _, t := range list {
+		fmt.Printf("%d %d %s %q %q\n",
+			t.ID,
+			t.Effect,
+			t.CreatedAt.Format(time.RFC3339),
+			t.Requester,
+			t.Reason,
+		)
+	}
+
+	return nil
+}
+
+func block(s *stores) error {
+	if len(os.Args) < 3 {
+		return ErrNotEnoughParameters
+	}
+
+	c, ok := blockCommands[os.Args[2]]
+	if !ok {
+		return fmt.Errorf("bad block command")
+	}
+
+	return c(s)
+}
+
+func blockAdd(s *stores) error {
+	if len(os.Args) < 5 {
+		return ErrNotEnoughParameters
+	}
+
+	b := store.Block{
+		Kind:  store.BlockKind(os.Args[3]),
+		Value: os.Args[4],
+	}
+	id, err := s.moderator.AddBlock(b)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("created block %d\n", id)
+	return nil
+}
+
+func blockCode(s *stores) error {
+	if len(os.Args) < 4 {
+		return ErrNotEnoughParameters
+	}
+
+	code, err := os.ReadFile(os.Args[3])
+	if err != nil {
+		return fmt.Errorf("could not read code: %w", err)
+	}
+
+	b := store.Block{
+		Kind:  store.BlockHash,
+		Value: store.NormalizedHash(string(code)),
+	}
+	id, err := s.moderator.AddBlock(b)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("created block %d for hash %s\n", id, b.Value)
+	return nil
+}
+
+func blockList(s *stores) error {
+	list, err := s.moderator.Blocks()
+	if err != nil {
+		return err
+	}
+
+	for _, b := range list {
+		fmt.Printf("%d %s %d %s\n",
+			b.ID,
+			b.Kind,
+			b.Takedown,
+			b.Value,
+		)
+	}
+
+	return nil
+}
+
+func blockRemove(s *stores) error {
+	if len(os.Args) < 4 {
+		return ErrNotEnoughParameters
+	}
+
+	id, err := strconv.Atoi(os.Args[3])
+	if err != nil {
+		return fmt.Errorf("malformed block id: %w", err)
+	}
+
+	err = s.moderator.RemoveBlock(id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("removed block %d\n", id)
+	return nil
+}
+
+func mirrorSync(s *stores) error {
+	if len(os.Args) < 3 {
+		return ErrNotEnoughParameters
+	}
+
+	m, err := mirror.New(os.Args[2], s.effects, s.mirrors, s.thumbs)
+	if err != nil {
+		return err
+	}
+	m.Logf = func(format string, args ...interface{}) {
+		fmt.Printf(format+"\n", args...)
+	}
+
+	if len(os.Args) > 3 {
+		interval, err := time.ParseDuration(os.Args[3])
+		if err != nil {
+			return fmt.Errorf("malformed interval: %w", err)
+		}
+		if interval <= 0 {
+			return fmt.Errorf("interval must be positive, got %s", interval)
+		}
+		m.Run(nil, interval)
+		return nil
+	}
+
+	n, err := m.Sync()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("copied %d effects from %s\n", n, os.Args[2])
+	return nil
+}
+
+func export(s *stores) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	since := flags.String("since", "", "export effects modified from this date")
+	hidden := flags.Bool("include-hidden", false, "export hidden effects and versions")
+	err := flags.Parse(os.Args[2:])
+	if err != nil {
+		return err
+	}
+
+	opts := store.ExportOptions{
+		Hidden: *hidden,
+	}
+	if *since != "" {
+		opts.Since, err = parseDate(*since)
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := store.Export(os.Stdout, s.effects, opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "exported %d effects\n", n)
+	return nil
+}
+
+func importDump(s *stores) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	batch := flags.Int("batch", 1000, "effects stored in each transaction")
+	conflict := flags.String("conflict", "skip", "policy for existing effects: skip, overwrite or renumber")
+	restart := flags.Bool("restart", false, "ignore the saved position and start from the beginning")
+	thumbs := flags.String("thumbs", "", "directory with the thumbnails referenced by image_url")
+	thumbsOnly := flags.Bool("thumbs-only", false, "only copy the missing thumbnails of effects already imported")
+	err := flags.Parse(os.Args[2:])
+	if err != nil {
+		return err
+	}
+	if flags.NArg() < 1 {
+		return ErrNotEnoughParameters
+	}
+	if *thumbsOnly && *thumbs == "" {
+		return fmt.Errorf("--thumbs-only needs --thumbs")
+	}
+
+	file := flags.Arg(0)
+	checkpoint, err := store.CheckpointName(file)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("could not open import file: %w", err)
+	}
+	defer f.Close()
+
+	if *restart && !*thumbsOnly {
+		err = s.effects.ResetImport(checkpoint)
+		if err != nil {
+			return err
+		}
+	}
+
+	opts := store.ImportOptions{
+		Batch:      *batch,
+		Conflict:   store.Conflict(*conflict),
+		Checkpoint: checkpoint,
+		Progress:   printImportStats,
+		Error: func(e store.ImportError) {
+			fmt.Fprintln(os.Stderr, e.Error())
+		},
+	}
+	if *thumbs != "" {
+		opts.Thumbs = s.thumbs
+		opts.ThumbsSource = *thumbs
+		opts.ThumbsOnly = *thumbsOnly
+		opts.MissingThumb = func(e store.ImportError) {
+			fmt.Fprintf(os.Stderr, "missing %s\n", e.Error())
+		}
+	}
+
+	_, err = store.ImportWith(f, s.effects, opts)
+	return err
+}
+
+func printImportStats(s store.ImportStats) {
+	fmt.Printf("line %d: %d imported, %d overwritten, %d renumbered, %d skipped, %d failed, %d thumbnails, %d missing thumbnails\n",
+		s.Line,
+		s.Imported,
+		s.Overwritten,
+		s.Renumbered,
+		s.Skipped,
+		s.Failed,
+		s.Thumbs,
+		s.MissingThumbs,
+	)
+}
+
+// parseDate reads a date in RFC 3339 or YYYY-MM-DD format.
+func parseDate(d string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, d)
+	if err == nil {
+		return t, nil
+	}
+
+	t, err = time.ParseInLocation("2006-01-02", d, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed date: %w", err)
+	}
+	return t, nil
+}
+
+func backupSave(s *stores) error {
+	if len(os.Args) < 3 {
+		return ErrNotEnoughParameters
+	}
+
+	p, err := backup.Save(os.Args[2], s.db, s.cfg.DataPath)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("saved backup %s\n", p)
+	return nil
+}
+
+func backupRestore(s *stores) error {
+	if len(os.Args) < 3 {
+		return ErrNotEnoughParameters
+	}
+
+	// the database file is replaced so it can not be kept open
+	err := s.db.Close()
+	if err != nil {
+		return fmt.Errorf("could not close database: %w", err)
+	}
+
+	m, err := backup.Restore(os.Args[2], s.cfg.DataPath)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("restored backup from %s with %d files\n",
+		m.CreatedAt.Format(time.RFC3339), len(m.Files))
+	return nil
+}
+
+func database(s *stores) error {
+	if len(os.Args) < 3 {
+		return ErrNotEnoughParameters
+	}
+
+	c, ok := dbCommands[os.Args[2]]
+	if !ok {
+		return fmt.Errorf("bad db command")
+	}
+
+	return c(s)
+}
+
+func dbCheck(s *stores) error {
+	flags := flag.NewFlagSet("db check", flag.ContinueOnError)
+	fix := flags.Bool("fix", false, "remove orphaned versions, effects and thumbnails")
+	err := flags.Parse(os.Args[3:])
+	if err != nil {
+		return err
+	}
+
+	problems, err := store.IntegrityCheck(s.db)
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Printf("integrity: %s\n", p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("database integrity check failed")
+	}
+	fmt.Println("integrity: ok")
+
+	var o store.Orphans
+	if *fix {
+		o, err = s.effects.FixOrphans(s.thumbs)
+	} else {
+		o, err = s.effects.Orphans(s.thumbs)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, id := range o.Versions {
+		fmt.Printf("versions of missing effect %d\n", id)
+	}
+	for _, id := range o.Empty {
+		fmt.Printf("effect %d has no versions\n", id)
+	}
+	for _, name := range o.Thumbs {
+		fmt.Printf("thumbnail %s has no effect\n", name)
+	}
+	for _, name := range o.Unknown {
+		fmt.Printf("unknown file %s in thumbnails\n", name)
+	}
+	for _, id := range o.MissingThumbs {
+		fmt.Printf("effect %d has no thumbnail\n", id)
+	}
+
+	fmt.Printf("%d orphaned versions, %d effects without versions, %d orphaned thumbnails, %d unknown files, %d missing thumbnails\n",
+		len(o.Versions), len(o.Empty), len(o.Thumbs), len(o.Unknown), len(o.MissingThumbs))
+	if *fix && o.Found() {
+		fmt.Println("removed orphaned versions, effects and thumbnails, unknown files and missing thumbnails are left as they are")
+	}
+
+	return nil
+}
+
+func dbVacuum(s *stores) error {
+	before, err := store.Stats(s.db)
+	if err != nil {
+		return err
+	}
+
+	err = store.Vacuum(s.db)
+	if err != nil {
+		return err
+	}
+
+	after, err := store.Stats(s.db)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("database size %d -> %d bytes\n", before.Size, after.Size)
+	return nil
+}
+
+func dbReindex(s *stores) error {
+	err := store.Reindex(s.db)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("rebuilt indexes")
+	return nil
+}
+
+func dbStats(s *stores) error {
+	stats, err := store.Stats(s.db)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("size: %d bytes\n", stats.Size)
+	fmt.Printf("free: %d bytes\n", stats.Free)
+	fmt.Println()
+	fmt.Printf("%-20s %10s %14s\n", "table", "rows", "bytes")
+	for _, t := range stats.Tables {
+		fmt.Printf("%-20s %10d %14d\n", t.Name, t.Rows, t.Bytes)
+	}
+
+	code, err := s.effects.CodeStats()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println()
+	fmt.Printf("code: %d versions, %d distinct, %d stored as deltas\n",
+		code.Versions, code.Blobs, code.Deltas)
+	fmt.Printf("code: %d bytes stored for %d bytes of versions, %d bytes saved\n",
+		code.Stored, code.Bytes, code.Saved())
+
+	return nil
+}
+
 func genPassword() (string, []byte, error) {
 	b := make([]byte, 16)
 	_, err := rand.Read(b)
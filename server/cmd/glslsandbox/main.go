@@ -7,25 +7,39 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/mrdoob/glsl-sandbox/server"
+	"github.com/mrdoob/glsl-sandbox/server/backup"
 	"github.com/mrdoob/glsl-sandbox/server/store"
+	"github.com/mrdoob/glsl-sandbox/server/thumb"
 	"github.com/uptrace/bun/driver/sqliteshim"
 )
 
 const dbName = "glslsandbox.db"
 
 type Config struct {
-	DataPath   string `envconfig:"DATA_PATH" default:"./data"`
-	Import     string `envconfig:"IMPORT"`
-	AuthSecret string `envconfig:"AUTH_SECRET" default:"secret"`
-	Addr       string `envconfig:"ADDR" default:":8888"`
-	TLSAddr    string `envconfig:"TLS_ADDR"`
-	Domains    string `envconfig:"DOMAINS" default:"www.glslsandbox.com,glslsandbox.com"`
-	Dev        bool   `envconfig:"DEV" default:"true"`
-	ReadOnly   bool   `envconfig:"READ_ONLY" default:"false"`
+	DataPath           string        `envconfig:"DATA_PATH" default:"./data"`
+	Import             string        `envconfig:"IMPORT"`
+	ImportThumbs       string        `envconfig:"IMPORT_THUMBS"`
+	AuthSecret         string        `envconfig:"AUTH_SECRET" default:"secret"`
+	Addr               string        `envconfig:"ADDR" default:":8888"`
+	TLSAddr            string        `envconfig:"TLS_ADDR"`
+	Domains            string        `envconfig:"DOMAINS" default:"www.glslsandbox.com,glslsandbox.com"`
+	Dev                bool          `envconfig:"DEV" default:"true"`
+	ReadOnly           bool          `envconfig:"READ_ONLY" default:"false"`
+	TrustedProxies     string        `envconfig:"TRUSTED_PROXIES"`
+	SubmitterSalt      string        `envconfig:"SUBMITTER_SALT"`
+	SubmitterRetention time.Duration `envconfig:"SUBMITTER_RETENTION" default:"2160h"`
+	DeleteRetention    time.Duration `envconfig:"DELETE_RETENTION" default:"720h"`
+	BackupPath         string        `envconfig:"BACKUP_PATH"`
+	BackupInterval     time.Duration `envconfig:"BACKUP_INTERVAL" default:"24h"`
+	BackupKeep         int           `envconfig:"BACKUP_KEEP" default:"7"`
+	AdminToken         string        `envconfig:"ADMIN_TOKEN"`
+	DeltaSnapshots     int           `envconfig:"DELTA_SNAPSHOTS"`
+	BaseURL            string        `envconfig:"BASE_URL"`
 }
 
 func main() {
@@ -40,6 +54,13 @@ func start() error {
 	if err := envconfig.Process("GLSL_", &cfg); err != nil {
 		return fmt.Errorf("could not read environment config: %w", err)
 	}
+	if cfg.BackupPath != "" && cfg.BackupInterval <= 0 {
+		return fmt.Errorf("BACKUP_INTERVAL must be positive, got %s", cfg.BackupInterval)
+	}
+	if cfg.DeltaSnapshots > store.MaxDeltaSnapshots {
+		return fmt.Errorf("DELTA_SNAPSHOTS can not be greater than %d, got %d",
+			store.MaxDeltaSnapshots, cfg.DeltaSnapshots)
+	}
 
 	err := os.MkdirAll(filepath.Join(cfg.DataPath, "thumbs"), 0770)
 	if err != nil {
@@ -55,12 +76,28 @@ func start() error {
 	if err != nil {
 		return fmt.Errorf("could not initialize effects database: %w", err)
 	}
+	effects.DeltaSnapshots = cfg.DeltaSnapshots
 
 	users, err := store.NewUsers(db)
 	if err != nil {
 		return fmt.Errorf("could not initialize users database: %w", err)
 	}
 
+	bans, err := store.NewBans(db)
+	if err != nil {
+		return fmt.Errorf("could not initialize bans database: %w", err)
+	}
+
+	takedowns, err := store.NewTakedowns(db)
+	if err != nil {
+		return fmt.Errorf("could not initialize takedowns database: %w", err)
+	}
+
+	webhooks, err := store.NewWebhooks(db)
+	if err != nil {
+		return fmt.Errorf("could not initialize webhooks database: %w", err)
+	}
+
 	auth := server.NewAuth(users, cfg.AuthSecret)
 
 	err = createUser(auth, users)
@@ -69,21 +106,53 @@ func start() error {
 	}
 
 	if cfg.Import != "" {
-		err = importDatabase(effects, cfg.Import)
+		err = importDatabase(effects, cfg.Import, cfg.ImportThumbs, cfg.DataPath)
 		if err != nil {
 			return fmt.Errorf("could not import database: %w", err)
 		}
 	}
 
+	salt := cfg.SubmitterSalt
+	if salt == "" {
+		salt, err = submitterSalt(cfg.DataPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	opts := []server.Option{server.WithWebhooks(webhooks)}
+	if cfg.AdminToken != "" {
+		opts = append(opts, server.WithAdminToken(cfg.AdminToken))
+	}
+	if cfg.BaseURL != "" {
+		opts = append(opts, server.WithBaseURL(cfg.BaseURL))
+	}
+	if cfg.BackupPath != "" {
+		opts = append(opts, server.WithBackups(backup.NewScheduler(
+			db,
+			cfg.DataPath,
+			cfg.BackupPath,
+			cfg.BackupInterval,
+			cfg.BackupKeep,
+		)))
+	}
+
 	s, err := server.New(
 		cfg.Addr,
 		cfg.TLSAddr,
 		cfg.Domains,
 		effects,
+		bans,
+		takedowns,
 		auth,
 		cfg.DataPath,
 		cfg.Dev,
 		cfg.ReadOnly,
+		cfg.TrustedProxies,
+		salt,
+		cfg.SubmitterRetention,
+		cfg.DeleteRetention,
+		opts...,
 	)
 	if err != nil {
 		return fmt.Errorf("could not create server: %w", err)
@@ -98,18 +167,46 @@ func dbURL(path string) string {
 	return fmt.Sprintf("file:%s", file)
 }
 
-func importDatabase(effects *store.Effects, file string) error {
+func importDatabase(
+	effects *store.Effects,
+	file string,
+	thumbsSource string,
+	dataPath string,
+) error {
+	checkpoint, err := store.CheckpointName(file)
+	if err != nil {
+		return err
+	}
 	f, err := os.Open(file)
 	if err != nil {
 		return fmt.Errorf("could not open import file: %w", err)
 	}
 	defer f.Close()
 
-	err = store.Import(f, effects)
+	opts := store.ImportOptions{
+		Checkpoint: checkpoint,
+		Error: func(e store.ImportError) {
+			fmt.Printf("could not import %s\n", e.Error())
+		},
+	}
+	if thumbsSource != "" {
+		opts.Thumbs, err = thumb.NewThumbs(filepath.Join(dataPath, "thumbs"))
+		if err != nil {
+			return fmt.Errorf("could not open thumbnails directory: %w", err)
+		}
+		opts.ThumbsSource = thumbsSource
+		opts.MissingThumb = func(e store.ImportError) {
+			fmt.Printf("missing %s\n", e.Error())
+		}
+	}
+
+	stats, err := store.ImportWith(f, effects, opts)
 	if err != nil {
 		return fmt.Errorf("could not import effects: %w", err)
 	}
 
+	fmt.Printf("imported %d effects, skipped %d, failed %d, %d missing thumbnails\n",
+		stats.Imported, stats.Skipped, stats.Failed, stats.MissingThumbs)
 	return nil
 }
 
@@ -134,3 +231,34 @@ func createUser(auth *server.Auth, users *store.Users) error {
 	fmt.Printf("created user 'admin' with password '%s'", password)
 	return nil
 }
+
+// submitterSalt returns the salt stored in the data path, generating a
+// random one the first time.
+func submitterSalt(dataPath string) (string, error) {
+	p := filepath.Join(dataPath, backup.SaltName)
+	data, err := os.ReadFile(p)
+	if err == nil {
+		if len(data) == 0 {
+			return "", fmt.Errorf("submitter salt file %s is empty", p)
+		}
+		return string(data), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("could not read submitter salt: %w", err)
+	}
+
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("could not generate submitter salt: %w", err)
+	}
+	salt := hex.EncodeToString(b)
+
+	err = os.WriteFile(p, []byte(salt), 0600)
+	if err != nil {
+		return "", fmt.Errorf("could not write submitter salt: %w", err)
+	}
+
+	fmt.Printf("generated submitter salt in %s\n", p)
+	return salt, nil
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// versionItem has information about each version displayed in the effect
+// admin page.
+type versionItem struct {
+	// Version is the version number.
+	Version int
+	// CreatedAt is the date the version was saved.
+	CreatedAt string
+	// CodeHash is the hash of the version code.
+	CodeHash string
+	// Submitter is the fingerprint hash of the submitter.
+	Submitter string
+	// SubmitterIP is the IP hash of the submitter.
+	SubmitterIP string
+	// Hidden tells if the version has been moderated.
+	Hidden bool
+	// SpamScore is how likely the version is spam.
+	SpamScore int
+	// SpamReasons lists why the version got its spam score.
+	SpamReasons string
+}
+
+// effectData has information about the effect admin page.
+type effectData struct {
+	// ID is the effect identifier.
+	ID int
+	// Image holds the thumbnail name.
+	Image string
+	// User is the user string of the effect.
+	User string
+	// Parent is the parent effect in "id.version" format or empty.
+	Parent string
+	// CreatedAt is the date the effect was created.
+	CreatedAt string
+	// Hidden tells if the whole effect has been moderated.
+	Hidden bool
+	// DeletedAt is the date the effect was moved to the trash or empty.
+	DeletedAt string
+	// Locked tells if the effect refuses new versions.
+	Locked bool
+	// Review tells if the effect is waiting for moderation.
+	Review bool
+	// Versions holds all the effect versions.
+	Versions []versionItem
+}
+
+func (s *Server) effectAdminHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "invalid id")
+	}
+
+	e, err := s.effects.Effect(id)
+	if err != nil {
+		c.Logger().Errorf("could not get effect: %s", err.Error())
+		return c.String(http.StatusNotFound, "not found")
+	}
+
+	parent := ""
+	if e.Parent > 0 {
+		parent = fmt.Sprintf("%d.%d", e.Parent, e.ParentVersion)
+	}
+
+	versions := make([]versionItem, len(e.Versions))
+	for i, v := range e.Versions {
+		versions[i] = versionItem{
+			Version:     i,
+			CreatedAt:   v.CreatedAt.Format(time.RFC3339),
+			CodeHash:    v.CodeHash,
+			Submitter:   v.Submitter.Fingerprint,
+			SubmitterIP: v.Submitter.IP,
+			Hidden:      v.Hidden,
+			SpamScore:   v.SpamScore,
+			SpamReasons: strings.Join(v.SpamReasons, ", "),
+		}
+	}
+
+	deleted := ""
+	if e.Deleted() {
+		deleted = e.DeletedAt.Format(time.RFC3339)
+	}
+
+	d := effectData{
+		ID:        e.ID,
+		Image:     path.Join("/thumbs", e.ImageName()),
+		User:      e.User,
+		Parent:    parent,
+		CreatedAt: e.CreatedAt.Format(time.RFC3339),
+		Hidden:    e.Hidden,
+		DeletedAt: deleted,
+		Locked:    e.Locked,
+		Review:    e.Review,
+		Versions:  versions,
+	}
+
+	return c.Render(http.StatusOK, "effect", d)
+}
+
+func (s *Server) effectAdminPostHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "invalid id")
+	}
+	url := fmt.Sprintf("/admin/effect/%d", id)
+
+	values, err := c.FormParams()
+	if err != nil {
+		c.Logger().Errorf("malformed form: %s", err.Error())
+		return c.Redirect(http.StatusSeeOther, url)
+	}
+
+	on := make(map[int]struct{})
+	for n, v := range values {
+		if !strings.HasPrefix(n, "hidden_") {
+			continue
+		}
+		if len(v) != 1 || v[0] != "on" {
+			continue
+		}
+
+		version, err := strconv.Atoi(strings.TrimPrefix(n, "hidden_"))
+		if err != nil {
+			continue
+		}
+		on[version] = struct{}{}
+	}
+
+	e, err := s.effects.Effect(id)
+	if err != nil {
+		c.Logger().Errorf("could not get effect: %s", err.Error())
+		return c.Redirect(http.StatusSeeOther, url)
+	}
+
+	for _, d := range values["versions"] {
+		version, err := strconv.Atoi(d)
+		if err != nil || version < 0 || version >= len(e.Versions) {
+			continue
+		}
+
+		_, hidden := on[version]
+		if e.Versions[version].Hidden == hidden {
+			continue
+		}
+
+		err = s.effects.HideVersion(id, version, hidden)
+		if err != nil {
+			c.Logger().Errorf("could not update version: %s", err.Error())
+			continue
+		}
+		s.emitHide(c, id, &version, hidden)
+	}
+
+	err = s.effects.Lock(id, values.Get("locked") == "on")
+	if err != nil {
+		c.Logger().Errorf("could not lock effect: %s", err.Error())
+	}
+
+	return c.Redirect(http.StatusSeeOther, url)
+}
+
+func (s *Server) effectDeleteHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "invalid id")
+	}
+
+	err = s.effects.Delete(id)
+	if err != nil {
+		c.Logger().Errorf("could not delete effect: %s", err.Error())
+	}
+
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/admin/effect/%d", id))
+}
+
+func (s *Server) effectRestoreHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "invalid id")
+	}
+
+	err = s.effects.Restore(id)
+	if err != nil {
+		c.Logger().Errorf("could not restore effect: %s", err.Error())
+	}
+
+	return c.Redirect(http.StatusSeeOther, "/admin/trash")
+}
+
+// trashEffect has information about each effect displayed in the trash.
+type trashEffect struct {
+	// ID is the effect identifier.
+	ID int
+	// Image holds the thumbnail name.
+	Image string
+	// DeletedAt is the date the effect was moved to the trash.
+	DeletedAt string
+	// PurgeAt is the date the effect will be permanently removed or empty if
+	// purging is disabled.
+	PurgeAt string
+}
+
+// trashData has information about the trash page.
+type trashData struct {
+	// Effects is an array with the deleted effects for the page.
+	Effects []trashEffect
+	// Page holds the current page number.
+	Page int
+	// IsPrevious is true if there is a previous page.
+	IsPrevious bool
+	// PreviousPage is the previous page URL.
+	PreviousPage string
+	// IsNext is true if there is a next page.
+	IsNext bool
+	// NextPage is the next page URL.
+	NextPage string
+}
+
+func (s *Server) trashHandler(c echo.Context) error {
+	page, err := strconv.Atoi(c.QueryParam("page"))
+	if err != nil || page < 0 {
+		page = 0
+	}
+
+	p, err := s.effects.Deleted(page, perPage)
+	if err != nil {
+		c.Logger().Errorf("could not get deleted effects: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "error")
+	}
+
+	effects := make([]trashEffect, len(p))
+	for i, e := range p {
+		purge := ""
+		if s.deleteRetention > 0 {
+			purge = e.DeletedAt.Add(s.deleteRetention).Format(time.RFC3339)
+		}
+		effects[i] = trashEffect{
+			ID:        e.ID,
+			Image:     path.Join("/thumbs", e.ImageName()),
+			DeletedAt: e.DeletedAt.Format(time.RFC3339),
+			PurgeAt:   purge,
+		}
+	}
+
+	d := trashData{
+		Effects:      effects,
+		Page:         page,
+		IsPrevious:   page > 0,
+		PreviousPage: fmt.Sprintf("/admin/trash?page=%d", page-1),
+		IsNext:       len(effects) == perPage,
+		NextPage:     fmt.Sprintf("/admin/trash?page=%d", page+1),
+	}
+
+	return c.Render(http.StatusOK, "trash", d)
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrdoob/glsl-sandbox/server/backup"
+	"github.com/mrdoob/glsl-sandbox/server/store"
+	"github.com/mrdoob/glsl-sandbox/server/webhook"
+)
+
+// SaveValidator is called before an effect or version is saved. It can
+// modify the query or reject it returning an error. The error message is
+// sent to the client with status 403 unless it is an *echo.HTTPError.
+type SaveValidator func(c echo.Context, q *SaveQuery) error
+
+// SaveListener is called after an effect or version is saved. It runs in
+// the request goroutine so slow work should be done in the background.
+type SaveListener func(c echo.Context, id int, version int)
+
+// Option modifies the server when it is created.
+type Option func(*Server)
+
+// WithSaveValidator adds a validator run before saving. Validators are run
+// in the order they are added.
+func WithSaveValidator(v SaveValidator) Option {
+	return func(s *Server) {
+		s.validators = append(s.validators, v)
+	}
+}
+
+// WithSaveListener adds a listener notified after saving.
+func WithSaveListener(l SaveListener) Option {
+	return func(s *Server) {
+		s.listeners = append(s.listeners, l)
+	}
+}
+
+// WithScorer adds a spam scorer to the default ones.
+func WithScorer(sc Scorer) Option {
+	return func(s *Server) {
+		s.scorers = append(s.scorers, sc)
+	}
+}
+
+// WithBackups saves periodic backups with the scheduler while the server
+// runs.
+func WithBackups(b *backup.Scheduler) Option {
+	return func(s *Server) {
+		s.backups = b
+	}
+}
+
+// WithWebhooks stores webhooks in hooks and delivers the events of the
+// server to them.
+func WithWebhooks(hooks *store.Webhooks) Option {
+	return func(s *Server) {
+		s.hooks = hooks
+		s.webhooks = webhook.New(hooks)
+	}
+}
+
+// WithAdminToken enables the admin API under /api/admin for clients that
+// send the token as a bearer Authorization header.
+func WithAdminToken(token string) Option {
+	return func(s *Server) {
+		s.adminToken = token
+	}
+}
+
+// WithBaseURL sets the public address of the server used to build the
+// absolute URLs sent in webhooks.
+func WithBaseURL(u string) Option {
+	return func(s *Server) {
+		s.baseURL = u
+	}
+}
+
+// validateSave runs the validators and returns the error of the first one
+// that rejects the query.
+func (s *Server) validateSave(c echo.Context, q *SaveQuery) error {
+	for _, v := range s.validators {
+		err := v(c, q)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rejectSave sends the response for a query rejected by a validator.
+func rejectSave(c echo.Context, err error) error {
+	c.Logger().Infof("save rejected by validator: %s", err.Error())
+
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return c.String(he.Code, fmt.Sprint(he.Message))
+	}
+	return c.String(http.StatusForbidden, err.Error())
+}
+
+// notifySave calls the listeners with the saved effect and version.
+func (s *Server) notifySave(c echo.Context, id int, version int) {
+	for _, l := range s.listeners {
+		l(c, id, version)
+	}
+}
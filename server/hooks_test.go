@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/mrdoob/glsl-sandbox/server/store"
+	"github.com/mrdoob/glsl-sandbox/server/webhook"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+func TestSaveHooks(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName, ":memory:")
+	require.NoError(t, err)
+	effects, err := store.NewEffects(db)
+	require.NoError(t, err)
+	takedowns, err := store.NewTakedowns(db)
+	require.NoError(t, err)
+
+	dataPath := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dataPath, pathThumbs), 0750))
+
+	var saved []string
+	s := &Server{
+		echo:      echo.New(),
+		effects:   effects,
+		takedowns: takedowns,
+		dataPath:  dataPath,
+		salt:      "salt",
+	}
+	for _, o := range []Option{
+		WithSaveValidator(func(c echo.Context, q *SaveQuery) error {
+			if strings.Contains(q.Code, "forbidden") {
+				return fmt.Errorf("forbidden code")
+			}
+			return nil
+		}),
+		WithSaveValidator(func(c echo.Context, q *SaveQuery) error {
+			if q.User == "" {
+				return echo.NewHTTPError(http.StatusBadRequest, "missing user")
+			}
+			q.Code = "// checked\n" + q.Code
+			return nil
+		}),
+		WithSaveListener(func(c echo.Context, id int, version int) {
+			saved = append(saved, fmt.Sprintf("%d.%d", id, version))
+		}),
+	} {
+		o(s)
+	}
+
+	image := "data:image/png;base64," +
+		base64.StdEncoding.EncodeToString(testPNG(t, false))
+	save := func(q SaveQuery) (int, string) {
+		q.Image = image
+		body, err := json.Marshal(q)
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/e", strings.NewReader(string(body)))
+		rec := httptest.NewRecorder()
+		c := s.echo.NewContext(req, rec)
+		require.NoError(t, s.saveHandler(c))
+		return rec.Code, rec.Body.String()
+	}
+
+	code, body := save(SaveQuery{Code: "forbidden", User: "user"})
+	require.Equal(t, http.StatusForbidden, code)
+	require.Equal(t, "forbidden code", body)
+
+	code, body = save(SaveQuery{Code: "main"})
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Equal(t, "missing user", body)
+	require.Empty(t, saved)
+
+	code, body = save(SaveQuery{Code: "main", User: "user"})
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "1.0", body)
+
+	code, body = save(SaveQuery{Code: "other", User: "user", CodeID: "1.0"})
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "1.1", body)
+	require.Equal(t, []string{"1.0", "1.1"}, saved)
+
+	e, err := effects.Effect(1)
+	require.NoError(t, err)
+	require.Equal(t, "// checked\nmain", e.Versions[0].Code)
+}
+
+func TestAbsoluteURL(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/e", nil)
+	req.Host = "example.com:8888"
+	s := &Server{echo: echo.New(), domains: []string{""}}
+	c := s.echo.NewContext(req, httptest.NewRecorder())
+
+	require.Equal(t, "http://example.com:8888/e#1.0", s.absoluteURL(c, "/e#1.0"))
+
+	s.domains = []string{"glslsandbox.com", "www.glslsandbox.com"}
+	require.Equal(t, "https://glslsandbox.com/e#1.0", s.absoluteURL(c, "/e#1.0"))
+
+	WithBaseURL("https://mirror.example/")(s)
+	require.Equal(t, "https://mirror.example/thumbs/1.png",
+		s.absoluteURL(c, "/thumbs/1.png"))
+}
+
+func TestWithWebhooks(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName, ":memory:")
+	require.NoError(t, err)
+	hooks, err := store.NewWebhooks(db)
+	require.NoError(t, err)
+
+	s := &Server{echo: echo.New()}
+	c := s.echo.NewContext(httptest.NewRequest(http.MethodPost, "/e", nil), httptest.NewRecorder())
+	require.Nil(t, s.webhooks)
+	// events are dropped without webhooks
+	s.emit(c, webhook.EventEffectCreated, nil)
+
+	WithWebhooks(hooks)(s)
+	require.Equal(t, hooks, s.hooks)
+	require.NotNil(t, s.webhooks)
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// parseTrustedProxies parses a comma separated list of CIDRs or single IPs
+// of the reverse proxies allowed to set X-Forwarded-For.
+func parseTrustedProxies(proxies string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range strings.Split(proxies, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address: %s", p)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{
+				IP:   ip,
+				Mask: net.CIDRMask(bits, bits),
+			})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy range: %w", err)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// newIPExtractor returns the function used to resolve the client address of
+// a request. X-Forwarded-For is only honored when the request comes from one
+// of the trusted proxies, and then the nearest untrusted hop is used. With no
+// trusted proxies the connection address is always used so clients can not
+// spoof their address.
+func newIPExtractor(proxies []*net.IPNet) echo.IPExtractor {
+	if len(proxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, p := range proxies {
+		options = append(options, echo.TrustIPRange(p))
+	}
+
+	return echo.ExtractIPFromXFFHeader(options...)
+}
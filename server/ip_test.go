@@ -0,0 +1,112 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	nets, err := parseTrustedProxies("")
+	require.NoError(t, err)
+	require.Len(t, nets, 0)
+
+	nets, err = parseTrustedProxies("10.0.0.0/8, 192.168.1.2,::1")
+	require.NoError(t, err)
+	require.Len(t, nets, 3)
+	require.Equal(t, "10.0.0.0/8", nets[0].String())
+	require.Equal(t, "192.168.1.2/32", nets[1].String())
+	require.Equal(t, "::1/128", nets[2].String())
+
+	_, err = parseTrustedProxies("10.0.0.0/8,proxy")
+	require.Error(t, err)
+
+	_, err = parseTrustedProxies("10.0.0.0/33")
+	require.Error(t, err)
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies string
+		remote  string
+		xff     []string
+		ip      string
+	}{
+		{
+			name:   "no proxies, no header",
+			remote: "203.0.113.7:1234",
+			ip:     "203.0.113.7",
+		},
+		{
+			name:   "no proxies, spoofed header",
+			remote: "203.0.113.7:1234",
+			xff:    []string{"198.51.100.1"},
+			ip:     "203.0.113.7",
+		},
+		{
+			name:    "untrusted peer, spoofed header",
+			proxies: "10.0.0.0/8",
+			remote:  "203.0.113.7:1234",
+			xff:     []string{"198.51.100.1"},
+			ip:      "203.0.113.7",
+		},
+		{
+			name:    "private peer is not trusted by default",
+			proxies: "10.0.0.0/8",
+			remote:  "192.168.1.1:1234",
+			xff:     []string{"198.51.100.1"},
+			ip:      "192.168.1.1",
+		},
+		{
+			name:    "trusted proxy",
+			proxies: "10.0.0.0/8",
+			remote:  "10.0.0.1:1234",
+			xff:     []string{"203.0.113.7"},
+			ip:      "203.0.113.7",
+		},
+		{
+			name:    "trusted proxy, spoofed header",
+			proxies: "10.0.0.0/8",
+			remote:  "10.0.0.1:1234",
+			xff:     []string{"198.51.100.1, 203.0.113.7"},
+			ip:      "203.0.113.7",
+		},
+		{
+			name:    "trusted proxy chain",
+			proxies: "10.0.0.0/8,192.168.1.2",
+			remote:  "10.0.0.1:1234",
+			xff:     []string{"198.51.100.1, 203.0.113.7", "192.168.1.2"},
+			ip:      "203.0.113.7",
+		},
+		{
+			name:    "trusted proxy, malformed header",
+			proxies: "10.0.0.0/8",
+			remote:  "10.0.0.1:1234",
+			xff:     []string{"203.0.113.7, garbage"},
+			ip:      "10.0.0.1",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nets, err := parseTrustedProxies(test.proxies)
+			require.NoError(t, err)
+
+			e := echo.New()
+			e.IPExtractor = newIPExtractor(nets)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = test.remote
+			for _, x := range test.xff {
+				req.Header.Add(echo.HeaderXForwardedFor, x)
+			}
+
+			c := e.NewContext(req, httptest.NewRecorder())
+			require.Equal(t, test.ip, c.RealIP())
+		})
+	}
+}
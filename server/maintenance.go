@@ -0,0 +1,77 @@
+package server
+
+import (
+	"time"
+
+	"github.com/mrdoob/glsl-sandbox/server/store"
+)
+
+const (
+	maintenanceInterval = time.Hour
+	// deliveriesRetention is how long finished webhook deliveries are kept.
+	deliveriesRetention = 30 * 24 * time.Hour
+)
+
+// maintenance periodically erases old submitter information, purges the
+// effects that have been in the trash longer than the retention period and
+// removes old webhook deliveries.
+func (s *Server) maintenance() {
+	for {
+		s.expireSubmitters()
+		s.purgeDeleted()
+		s.pruneDeliveries()
+		time.Sleep(maintenanceInterval)
+	}
+}
+
+func (s *Server) pruneDeliveries() {
+	if s.hooks == nil {
+		return
+	}
+
+	n, err := s.hooks.PruneDeliveries(time.Now().Add(-deliveriesRetention))
+	if err != nil {
+		s.echo.Logger.Errorf("could not prune webhook deliveries: %s", err.Error())
+		return
+	}
+	if n > 0 {
+		s.echo.Logger.Infof("removed %d old webhook deliveries", n)
+	}
+}
+
+func (s *Server) expireSubmitters() {
+	if s.retention <= 0 {
+		return
+	}
+
+	n, err := s.effects.ExpireSubmitters(time.Now().Add(-s.retention))
+	if err != nil {
+		s.echo.Logger.Errorf("could not expire submitters: %s", err.Error())
+		return
+	}
+	if n > 0 {
+		s.echo.Logger.Infof("expired submitter information of %d versions", n)
+	}
+}
+
+func (s *Server) purgeDeleted() {
+	if s.deleteRetention <= 0 {
+		return
+	}
+
+	ids, err := s.effects.Purge(time.Now().Add(-s.deleteRetention))
+	if err != nil {
+		s.echo.Logger.Errorf("could not purge effects: %s", err.Error())
+		return
+	}
+
+	for _, id := range ids {
+		err = s.thumbs.Remove(store.Effect{ID: id}.ImageName())
+		if err != nil {
+			s.echo.Logger.Errorf("could not remove thumbnail: %s", err.Error())
+		}
+	}
+	if len(ids) > 0 {
+		s.echo.Logger.Infof("purged %d deleted effects", len(ids))
+	}
+}
@@ -0,0 +1,265 @@
+// Package mirror replicates the effects of another glsl-sandbox instance
+// using its change feed. Combined with read only mode it can be used to run
+// regional mirrors.
+package mirror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mrdoob/glsl-sandbox/server/store"
+	"github.com/mrdoob/glsl-sandbox/server/thumb"
+)
+
+const changesLimit = 1000
+
+var errNotFound = errors.New("not found")
+
+// change is each entry of the /api/changes response.
+type change struct {
+	Seq    int    `json:"seq"`
+	Kind   string `json:"kind"`
+	Effect int    `json:"effect"`
+}
+
+// changesPage is the /api/changes response.
+type changesPage struct {
+	Changes []change `json:"changes"`
+	Last    int      `json:"last"`
+}
+
+// version is each version of the /api/effect response.
+type version struct {
+	CreatedAt time.Time `json:"created_at"`
+	Code      string    `json:"code"`
+	Hidden    bool      `json:"hidden"`
+}
+
+// effect is the /api/effect response.
+type effect struct {
+	ID            int       `json:"id"`
+	CreatedAt     time.Time `json:"created_at"`
+	ModifiedAt    time.Time `json:"modified_at"`
+	Parent        int       `json:"parent"`
+	ParentVersion int       `json:"parent_version"`
+	User          string    `json:"user"`
+	Versions      []version `json:"versions"`
+}
+
+// Mirror copies effects, versions and thumbnails from a source instance.
+type Mirror struct {
+	source  string
+	effects *store.Effects
+	mirrors *store.Mirrors
+	thumbs  *thumb.Thumbs
+	client  *http.Client
+	// Logf logs progress and errors that do not stop mirroring.
+	Logf func(format string, args ...interface{})
+}
+
+// New creates a mirror of the instance at the source URL.
+func New(
+	source string,
+	effects *store.Effects,
+	mirrors *store.Mirrors,
+	thumbs *thumb.Thumbs,
+) (*Mirror, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("malformed source url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("source url must be http or https")
+	}
+
+	return &Mirror{
+		source:  strings.TrimSuffix(source, "/"),
+		effects: effects,
+		mirrors: mirrors,
+		thumbs:  thumbs,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+		Logf: func(string, ...interface{}) {},
+	}, nil
+}
+
+// Sync copies the effects changed in the source since the last sync and
+// returns how many were copied. The position is saved after each page of
+// changes so an interrupted sync continues from the last complete page.
+func (m *Mirror) Sync() (int, error) {
+	since, err := m.mirrors.Position(m.source)
+	if err != nil {
+		return 0, err
+	}
+
+	copied := 0
+	for {
+		var page changesPage
+		query := fmt.Sprintf("/api/changes?since=%d&limit=%d", since, changesLimit)
+		err = m.get(query, &page)
+		if err != nil {
+			return copied, fmt.Errorf("could not get changes: %w", err)
+		}
+
+		seen := make(map[int]bool)
+		for _, c := range page.Changes {
+			if seen[c.Effect] {
+				continue
+			}
+			seen[c.Effect] = true
+
+			err = m.copy(c.Effect)
+			if err != nil {
+				return copied, fmt.Errorf("could not copy effect %d: %w", c.Effect, err)
+			}
+			copied++
+		}
+
+		if page.Last > since {
+			since = page.Last
+			err = m.mirrors.SetPosition(m.source, since)
+			if err != nil {
+				return copied, err
+			}
+			m.Logf("mirrored %s up to change %d", m.source, since)
+		}
+
+		if len(page.Changes) < changesLimit {
+			return copied, nil
+		}
+	}
+}
+
+// Run syncs every interval until stop is closed. With an interval that is
+// not positive it only syncs once.
+func (m *Mirror) Run(stop <-chan struct{}, interval time.Duration) {
+	if interval <= 0 {
+		_, err := m.Sync()
+		if err != nil {
+			m.Logf("could not mirror %s: %s", m.source, err.Error())
+		}
+		return
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		_, err := m.Sync()
+		if err != nil {
+			m.Logf("could not mirror %s: %s", m.source, err.Error())
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// copy replaces the local copy of an effect with the one in the source.
+// Effects no longer public in the source are hidden.
+func (m *Mirror) copy(id int) error {
+	var e effect
+	err := m.get(fmt.Sprintf("/api/effect/%d", id), &e)
+	if errors.Is(err, errNotFound) {
+		err = m.effects.Hide(id, true)
+		if errors.Is(err, store.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if e.ID != id {
+		return fmt.Errorf("source returned effect %d", e.ID)
+	}
+
+	n := store.Effect{
+		ID:            e.ID,
+		CreatedAt:     e.CreatedAt,
+		ModifiedAt:    e.ModifiedAt,
+		Parent:        e.Parent,
+		ParentVersion: e.ParentVersion,
+		User:          e.User,
+		Versions:      make([]store.Version, len(e.Versions)),
+	}
+	for i, v := range e.Versions {
+		n.Versions[i] = store.Version{
+			CreatedAt: v.CreatedAt,
+			Code:      v.Code,
+			Hidden:    v.Hidden,
+		}
+	}
+
+	err = m.effects.PutEffect(n)
+	if err != nil {
+		return err
+	}
+
+	return m.thumb(n.ImageName())
+}
+
+// thumb copies a thumbnail normalized like uploaded ones. Missing and
+// invalid thumbnails are logged and skipped.
+func (m *Mirror) thumb(name string) error {
+	res, err := m.client.Get(m.source + "/thumbs/" + name)
+	if err != nil {
+		return fmt.Errorf("could not get thumbnail: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		m.Logf("thumbnail %s not found in %s", name, m.source)
+		return nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not get thumbnail: status %d", res.StatusCode)
+	}
+
+	// one byte over the limit is enough for Normalize to reject it
+	data, err := io.ReadAll(io.LimitReader(res.Body, thumb.MaxBytes+1))
+	if err != nil {
+		return fmt.Errorf("could not read thumbnail: %w", err)
+	}
+
+	data, err = thumb.Normalize(data)
+	if err != nil {
+		m.Logf("thumbnail %s from %s: %s", name, m.source, err.Error())
+		return nil
+	}
+
+	return m.thumbs.Save(name, data)
+}
+
+// get requests a source API path and decodes its JSON response.
+func (m *Mirror) get(p string, v interface{}) error {
+	res, err := m.client.Get(m.source + p)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", res.StatusCode)
+	}
+
+	err = json.NewDecoder(res.Body).Decode(v)
+	if err != nil {
+		return fmt.Errorf("malformed response: %w", err)
+	}
+	return nil
+}
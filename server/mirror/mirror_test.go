@@ -0,0 +1,183 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mrdoob/glsl-sandbox/server/store"
+	"github.com/mrdoob/glsl-sandbox/server/thumb"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+// source is a fake instance serving the APIs used by the mirror.
+type source struct {
+	mu      sync.Mutex
+	changes []change
+	effects map[int]effect
+	thumbs  map[string][]byte
+}
+
+func (s *source) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/api/changes":
+		since, _ := strconv.Atoi(r.URL.Query().Get("since"))
+		page := changesPage{Changes: []change{}, Last: since}
+		for _, c := range s.changes {
+			if c.Seq > since {
+				page.Changes = append(page.Changes, c)
+				page.Last = c.Seq
+			}
+		}
+		_ = json.NewEncoder(w).Encode(page)
+
+	case strings.HasPrefix(r.URL.Path, "/api/effect/"):
+		id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/effect/"))
+		e, ok := s.effects[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(e)
+
+	case strings.HasPrefix(r.URL.Path, "/thumbs/"):
+		d, ok := s.thumbs[strings.TrimPrefix(r.URL.Path, "/thumbs/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(d)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	created := time.Date(2022, time.March, 1, 0, 0, 0, 0, time.UTC)
+	var img bytes.Buffer
+	require.NoError(t, png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 400, 200))))
+	src := &source{
+		changes: []change{
+			{Seq: 1, Kind: "created", Effect: 1},
+			{Seq: 2, Kind: "created", Effect: 2},
+			{Seq: 3, Kind: "version", Effect: 1},
+		},
+		effects: map[int]effect{
+			1: {
+				ID:            1,
+				CreatedAt:     created,
+				ModifiedAt:    created.Add(time.Hour),
+				Parent:        -1,
+				ParentVersion: -1,
+				User:          "user",
+				Versions: []version{
+					{CreatedAt: created, Code: "first"},
+					{CreatedAt: created.Add(time.Hour), Hidden: true},
+				},
+			},
+			2: {
+				ID:            2,
+				CreatedAt:     created,
+				ModifiedAt:    created,
+				Parent:        1,
+				ParentVersion: 0,
+				User:          "fork",
+				Versions: []version{
+					{CreatedAt: created, Code: "fork"},
+				},
+			},
+		},
+		thumbs: map[string][]byte{
+			"1.png": img.Bytes(),
+			"2.png": []byte("not a png"),
+		},
+	}
+	srv := httptest.NewServer(src)
+	defer srv.Close()
+
+	db, err := sqlx.Connect(sqliteshim.ShimName, ":memory:")
+	require.NoError(t, err)
+	effects, err := store.NewEffects(db)
+	require.NoError(t, err)
+	mirrors, err := store.NewMirrors(db)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	thumbs, err := thumb.NewThumbs(dir)
+	require.NoError(t, err)
+
+	_, err = New("ftp://example.com", effects, mirrors, thumbs)
+	require.Error(t, err)
+
+	m, err := New(srv.URL+"/", effects, mirrors, thumbs)
+	require.NoError(t, err)
+
+	n, err := m.Sync()
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	e, err := effects.Effect(1)
+	require.NoError(t, err)
+	require.Equal(t, "user", e.User)
+	require.Len(t, e.Versions, 2)
+	require.Equal(t, "first", e.Versions[0].Code)
+	require.True(t, e.Versions[1].Hidden)
+	require.True(t, e.ModifiedAt.Equal(created.Add(time.Hour)))
+
+	e, err = effects.Effect(2)
+	require.NoError(t, err)
+	require.Equal(t, 1, e.Parent)
+	require.False(t, e.Hidden)
+
+	// thumbnails are normalized and invalid ones skipped
+	normalized, err := thumb.Normalize(img.Bytes())
+	require.NoError(t, err)
+	d, err := os.ReadFile(filepath.Join(dir, "1.png"))
+	require.NoError(t, err)
+	require.Equal(t, normalized, d)
+	_, err = os.Stat(filepath.Join(dir, "2.png"))
+	require.True(t, os.IsNotExist(err))
+
+	seq, err := mirrors.Position(srv.URL)
+	require.NoError(t, err)
+	require.Equal(t, 3, seq)
+
+	n, err = m.Sync()
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	src.mu.Lock()
+	delete(src.effects, 2)
+	src.changes = append(src.changes,
+		change{Seq: 4, Kind: "hidden", Effect: 2},
+		change{Seq: 5, Kind: "purged", Effect: 3},
+	)
+	src.mu.Unlock()
+
+	n, err = m.Sync()
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	e, err = effects.Effect(2)
+	require.NoError(t, err)
+	require.True(t, e.Hidden)
+
+	seq, err = mirrors.Position(srv.URL)
+	require.NoError(t, err)
+	require.Equal(t, 5, seq)
+}
@@ -3,28 +3,41 @@ package server
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/labstack/gommon/log"
+	"github.com/mrdoob/glsl-sandbox/server/backup"
 	"github.com/mrdoob/glsl-sandbox/server/store"
+	"github.com/mrdoob/glsl-sandbox/server/thumb"
+	"github.com/mrdoob/glsl-sandbox/server/webhook"
 	"golang.org/x/crypto/acme/autocert"
 )
 
 const (
-	pathGallery = "./server/assets/gallery.html"
-	pathThumbs  = "thumbs"
-	pathCerts   = "certs"
-	perPage     = 50
+	pathGallery   = "./server/assets/gallery.html"
+	pathBans      = "./server/assets/bans.html"
+	pathEffect    = "./server/assets/effect.html"
+	pathTrash     = "./server/assets/trash.html"
+	pathTakedowns = "./server/assets/takedowns.html"
+	pathReview    = "./server/assets/review.html"
+	pathWebhooks  = "./server/assets/webhooks.html"
+	pathIndex     = "./static/index.html"
+	pathThumbs    = "thumbs"
+	pathCerts     = "certs"
+	perPage       = 50
 )
 
 var ErrInvalidData = fmt.Errorf("invalid data")
@@ -46,7 +59,9 @@ func prepareTemplate() (*template.Template, error) {
 			return ""
 		},
 	})
-	tpl, err := tpl.ParseFiles(pathGallery)
+	tpl, err := tpl.ParseFiles(
+		pathGallery, pathBans, pathEffect, pathTrash, pathTakedowns,
+		pathReview, pathWebhooks)
 	if err != nil {
 		fmt.Println("template error", err.Error())
 		return nil, err
@@ -70,15 +85,36 @@ func (t *Template) Render(
 }
 
 type Server struct {
-	addr     string
-	tlsAddr  string
-	domains  []string
-	echo     *echo.Echo
-	template *Template
-	effects  *store.Effects
-	auth     *Auth
-	dataPath string
-	readOnly bool
+	addr      string
+	tlsAddr   string
+	domains   []string
+	echo      *echo.Echo
+	template  *Template
+	effects   *store.Effects
+	bans      *store.Bans
+	takedowns *store.Takedowns
+	hooks     *store.Webhooks
+	webhooks  *webhook.Dispatcher
+	auth      *Auth
+	dataPath  string
+	readOnly  bool
+	clientIP  echo.IPExtractor
+	// salt is used to hash submitter information.
+	salt string
+	// retention is how long submitter information is kept.
+	retention time.Duration
+	// deleteRetention is how long deleted effects are kept in the trash.
+	deleteRetention time.Duration
+	thumbs          *thumb.Thumbs
+	scorers         []Scorer
+	validators      []SaveValidator
+	listeners       []SaveListener
+	stream          *broker
+	backups         *backup.Scheduler
+	// adminToken enables the admin API when it is not empty.
+	adminToken string
+	// baseURL is the public address used in webhook payloads.
+	baseURL string
 }
 
 func New(
@@ -86,10 +122,17 @@ func New(
 	tlsAddr string,
 	domains string,
 	e *store.Effects,
+	bans *store.Bans,
+	takedowns *store.Takedowns,
 	auth *Auth,
 	dataPath string,
 	dev bool,
 	readOnly bool,
+	trustedProxies string,
+	salt string,
+	retention time.Duration,
+	deleteRetention time.Duration,
+	opts ...Option,
 ) (*Server, error) {
 	var tpl *template.Template
 	if !dev {
@@ -100,11 +143,25 @@ func New(
 		}
 	}
 
+	if salt == "" {
+		return nil, fmt.Errorf("submitter salt can not be empty")
+	}
+
 	if tlsAddr != "" && domains == "" {
 		return nil, fmt.Errorf("cannot specify TLS_ADDR without DOMAINS")
 	}
 
-	return &Server{
+	proxies, err := parseTrustedProxies(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	thumbs, err := thumb.NewThumbs(filepath.Join(dataPath, pathThumbs))
+	if err != nil {
+		return nil, fmt.Errorf("could not open thumbnails directory: %w", err)
+	}
+
+	s := &Server{
 		addr:    addr,
 		tlsAddr: tlsAddr,
 		domains: strings.Split(domains, ","),
@@ -112,11 +169,26 @@ func New(
 		template: &Template{
 			templates: tpl,
 		},
-		effects:  e,
-		auth:     auth,
-		dataPath: dataPath,
-		readOnly: readOnly,
-	}, nil
+		effects:         e,
+		bans:            bans,
+		takedowns:       takedowns,
+		auth:            auth,
+		dataPath:        dataPath,
+		readOnly:        readOnly,
+		clientIP:        newIPExtractor(proxies),
+		salt:            salt,
+		retention:       retention,
+		deleteRetention: deleteRetention,
+		thumbs:          thumbs,
+		stream:          newBroker(),
+	}
+	s.scorers = defaultScorers(e, pathIndex, s.echo.Logger)
+
+	for _, o := range opts {
+		o(s)
+	}
+
+	return s, nil
 }
 
 func (s *Server) Start() error {
@@ -125,6 +197,16 @@ func (s *Server) Start() error {
 		return err
 	}
 
+	go s.maintenance()
+	if s.webhooks != nil {
+		s.webhooks.Errorf = s.echo.Logger.Errorf
+		go s.webhooks.Run(nil)
+	}
+	if s.backups != nil {
+		s.backups.Logf = s.echo.Logger.Infof
+		go s.backups.Run(nil)
+	}
+
 	if s.tlsAddr != "" {
 		go func() {
 			err := s.echo.Start(s.addr)
@@ -151,6 +233,7 @@ func (s *Server) setup() error {
 		s.echo.Pre(middleware.HTTPSRedirect())
 	}
 
+	s.echo.IPExtractor = s.clientIP
 	s.echo.Use(middleware.Recover())
 	s.echo.Renderer = s.template
 	s.echo.Logger.SetLevel(log.DEBUG)
@@ -166,7 +249,7 @@ func (s *Server) routes() {
 	s.echo.GET("/e_", s.effectHandler_)
 
 	if !s.readOnly {
-		s.echo.POST("/e", s.saveHandler)
+		s.echo.POST("/e", s.saveHandler, s.banMiddleware)
 	}
 
 	cors := middleware.CORSWithConfig(middleware.CORSConfig{
@@ -174,6 +257,9 @@ func (s *Server) routes() {
 		AllowOrigins: []string{"*"},
 	})
 	s.echo.GET("/item/:id", s.itemHandler, cors)
+	s.echo.GET("/api/stream", s.streamHandler, cors)
+	s.echo.GET("/api/changes", s.changesHandler, cors)
+	s.echo.GET("/api/effect/:id", s.effectAPIHandler, cors)
 
 	s.echo.Static("/thumbs", filepath.Join(s.dataPath, pathThumbs))
 	s.echo.Static("/css", "./server/assets/css")
@@ -192,6 +278,27 @@ func (s *Server) routes() {
 
 	admin.GET("", s.adminHandler)
 	admin.POST("", s.adminPostHandler)
+	admin.GET("/effect/:id", s.effectAdminHandler)
+	admin.POST("/effect/:id", s.effectAdminPostHandler)
+	admin.POST("/effect/:id/delete", s.effectDeleteHandler)
+	admin.POST("/effect/:id/restore", s.effectRestoreHandler)
+	admin.GET("/trash", s.trashHandler)
+	admin.GET("/bans", s.bansHandler)
+	admin.POST("/bans", s.bansPostHandler)
+	admin.POST("/bans/remove", s.bansRemoveHandler)
+	admin.GET("/review", s.reviewHandler)
+	admin.POST("/review", s.reviewPostHandler)
+	if s.hooks != nil {
+		admin.GET("/webhooks", s.webhooksHandler)
+		admin.POST("/webhooks", s.webhooksPostHandler)
+		admin.POST("/webhooks/remove", s.webhooksRemoveHandler)
+	}
+	admin.GET("/takedowns", s.takedownsHandler)
+	admin.POST("/takedowns", s.takedownsPostHandler)
+	admin.POST("/blocks", s.blocksPostHandler)
+	admin.POST("/blocks/remove", s.blocksRemoveHandler)
+
+	s.adminAPIRoutes()
 }
 
 func (s *Server) indexHandler(c echo.Context) error {
@@ -206,12 +313,23 @@ func (s *Server) adminHandler(c echo.Context) error {
 type galleryEffect struct {
 	// ID is the effect identifyier.
 	ID int
-	// Version is the latest effect version.
+	// Version is the latest visible effect version.
 	Version int
 	// Image holds the thumbnail name.
 	Image string
 	// Hidden tells if the effect has been moderated.
 	Hidden bool
+	// Submitter is the fingerprint hash of the displayed version submitter.
+	// Only set in the admin page.
+	Submitter string
+	// SubmitterIP is the IP hash of the displayed version submitter. Only
+	// set in the admin page.
+	SubmitterIP string
+	// User is the user string of the effect. Only set in the admin page.
+	User string
+	// CodeHash is the code hash of the displayed version. Only set in the
+	// admin page.
+	CodeHash string
 }
 
 // galleryData has information about the current gallery page.
@@ -264,14 +382,32 @@ func (s *Server) indexRender(c echo.Context, admin bool) error {
 		return c.String(http.StatusInternalServerError, "error")
 	}
 
-	effects := make([]galleryEffect, len(p))
-	for i, e := range p {
-		effects[i] = galleryEffect{
+	effects := make([]galleryEffect, 0, len(p))
+	for _, e := range p {
+		version := e.LastVisibleVersion()
+		if version < 0 {
+			if !admin {
+				continue
+			}
+			version = len(e.Versions) - 1
+		}
+
+		g := galleryEffect{
 			ID:      e.ID,
-			Version: len(e.Versions) - 1,
+			Version: version,
 			Image:   path.Join("/thumbs", e.ImageName()),
 			Hidden:  e.Hidden,
 		}
+
+		if admin && version >= 0 {
+			v := e.Versions[version]
+			g.Submitter = v.Submitter.Fingerprint
+			g.SubmitterIP = v.Submitter.IP
+			g.User = e.User
+			g.CodeHash = v.CodeHash
+		}
+
+		effects = append(effects, g)
 	}
 
 	url := "/"
@@ -291,7 +427,7 @@ func (s *Server) indexRender(c echo.Context, admin bool) error {
 		Effects:      effects,
 		URL:          url,
 		Page:         page,
-		IsNext:       len(effects) == perPage,
+		IsNext:       len(p) == perPage,
 		NextPage:     nextPage,
 		IsPrevious:   page > 0,
 		PreviousPage: previousPage,
@@ -303,7 +439,7 @@ func (s *Server) indexRender(c echo.Context, admin bool) error {
 }
 
 func (s *Server) effectHandler(c echo.Context) error {
-	return c.File("./static/index.html")
+	return c.File(pathIndex)
 }
 
 func (s *Server) effectHandler_(c echo.Context) error {
@@ -314,6 +450,7 @@ type itemResponse struct {
 	Code   string `json:"code"`
 	User   string `json:"user"`
 	Parent string `json:"parent,omitempty"`
+	Locked bool   `json:"locked,omitempty"`
 }
 
 func (s *Server) itemHandler(c echo.Context) error {
@@ -323,12 +460,16 @@ func (s *Server) itemHandler(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "{}")
 	}
 
-	effect, err := s.effects.Effect(id)
+	effect, err := s.effects.EffectVersion(id, version)
+	if errors.Is(err, store.ErrNotFound) {
+		return c.String(http.StatusNotFound, "{}")
+	}
 	if err != nil {
 		return c.String(http.StatusBadRequest, "{}")
 	}
 
-	if version >= len(effect.Versions) || version < 0 {
+	hidden := effect.Deleted() || effect.Versions[0].Hidden
+	if hidden && !s.auth.Moderator(c) {
 		return c.String(http.StatusNotFound, "{}")
 	}
 
@@ -338,9 +479,10 @@ func (s *Server) itemHandler(c echo.Context) error {
 	}
 
 	item := itemResponse{
-		Code:   effect.Versions[version].Code,
+		Code:   effect.Versions[0].Code,
 		User:   effect.User,
 		Parent: parent,
+		Locked: effect.Locked,
 	}
 
 	data, err := json.Marshal(item)
@@ -351,7 +493,9 @@ func (s *Server) itemHandler(c echo.Context) error {
 	return c.Blob(http.StatusOK, "application/json", data)
 }
 
-type saveQuery struct {
+// SaveQuery is the body sent by the editor to save an effect or a new
+// version of it.
+type SaveQuery struct {
 	Code   string `json:"code"`
 	Image  string `json:"image"`
 	User   string `json:"user"`
@@ -371,13 +515,18 @@ func (s *Server) saveHandler(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, "")
 	}
 
-	var save saveQuery
+	var save SaveQuery
 	err = json.Unmarshal(data, &save)
 	if err != nil {
 		c.Logger().Errorf("could not parse json: %s", err.Error())
 		return c.String(http.StatusBadRequest, "")
 	}
 
+	err = s.validateSave(c, &save)
+	if err != nil {
+		return rejectSave(c, err)
+	}
+
 	parts := strings.Split(save.Image, ",")
 	if len(parts) != 2 {
 		c.Logger().Errorf("malformed encoded image")
@@ -391,6 +540,35 @@ func (s *Server) saveHandler(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "")
 	}
 
+	img, err = thumb.Normalize(img)
+	if errors.Is(err, thumb.ErrInvalid) {
+		c.Logger().Errorf("rejected image: %s", err.Error())
+		return c.String(http.StatusBadRequest, "")
+	}
+	if err != nil {
+		c.Logger().Errorf("could not normalize image: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "")
+	}
+
+	b, err := s.takedowns.Check(save.Code)
+	switch {
+	case err == nil:
+		c.Logger().Infof("rejected blocked code: block %d", b.ID)
+		return c.String(http.StatusUnavailableForLegalReasons,
+			"this code has been removed and can not be published again")
+	case !errors.Is(err, store.ErrNotFound):
+		c.Logger().Errorf("could not check blocks: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "")
+	}
+
+	submitter := s.submitter(c)
+	score, reasons := s.spamScore(c, Submission{
+		Code:      save.Code,
+		Image:     img,
+		Submitter: submitter,
+		Base:      s.baseCodeHash(save),
+	})
+
 	var id, version int
 	if save.CodeID == "" {
 		parent, parentVersion, err := idVersion(save.Parent)
@@ -398,7 +576,8 @@ func (s *Server) saveHandler(c echo.Context) error {
 			parent, parentVersion = -1, -1
 		}
 
-		id, err = s.effects.Add(parent, parentVersion, save.User, save.Code)
+		id, err = s.effects.Add(
+			parent, parentVersion, save.User, save.Code, submitter)
 		if err != nil {
 			c.Logger().Errorf("could not save new effect: %s", err.Error())
 			return c.String(http.StatusInternalServerError, "")
@@ -416,7 +595,12 @@ func (s *Server) saveHandler(c echo.Context) error {
 			return c.String(http.StatusBadRequest, "")
 		}
 
-		version, err = s.effects.AddVersion(id, save.Code)
+		version, err = s.effects.AddVersion(id, save.Code, submitter)
+		if errors.Is(err, store.ErrLocked) {
+			c.Logger().Infof("rejected version of locked effect %d", id)
+			return c.String(http.StatusForbidden,
+				"this effect is locked, save it as a new effect instead")
+		}
 		if err != nil {
 			c.Logger().Errorf("could not save new version: %s", err.Error())
 			return c.String(http.StatusInternalServerError, "")
@@ -429,6 +613,13 @@ func (s *Server) saveHandler(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, "")
 	}
 
+	s.flagSpam(c, id, version, score, reasons)
+	if score < spamHideScore {
+		s.emitSave(c, id, version)
+	}
+	s.stream.notify()
+	s.notifySave(c, id, version)
+
 	answer := fmt.Sprintf("%d.%d", id, version)
 	return c.String(http.StatusOK, answer)
 }
@@ -446,6 +637,11 @@ func (s *Server) adminPostHandler(c echo.Context) error {
 
 	}
 
+	if values.Get("bulk") != "" {
+		s.bulkHide(c, values)
+		return c.Redirect(http.StatusSeeOther, url)
+	}
+
 	on := make(map[int]struct{})
 	for n, v := range values {
 		if !strings.HasPrefix(n, "hidden_") {
@@ -466,7 +662,7 @@ func (s *Server) adminPostHandler(c echo.Context) error {
 		}
 		on[id] = struct{}{}
 
-		err = s.effects.Hide(id, true)
+		err = s.setHidden(c, id, true)
 		if err != nil {
 			c.Logger().Errorf("could not hide effect: %s", err.Error())
 		}
@@ -483,7 +679,7 @@ func (s *Server) adminPostHandler(c echo.Context) error {
 			continue
 		}
 
-		err = s.effects.Hide(id, false)
+		err = s.setHidden(c, id, false)
 		if err != nil {
 			c.Logger().Errorf("could not unhide effect: %s", err.Error())
 		}
@@ -492,6 +688,75 @@ func (s *Server) adminPostHandler(c echo.Context) error {
 	return c.Redirect(http.StatusSeeOther, url)
 }
 
+// bulkHide hides or unhides all the effects selected by the "bulk" and
+// "value" form fields. The "action" field is either "hide" or "unhide".
+// Selecting by creation time uses the "from" and "to" fields instead of
+// "value".
+func (s *Server) bulkHide(c echo.Context, values url.Values) {
+	hidden := values.Get("action") != "unhide"
+	value := strings.TrimSpace(values.Get("value"))
+
+	var n int
+	var err error
+	switch values.Get("bulk") {
+	case "submitter":
+		n, err = s.effects.HideSubmitter(value, hidden)
+	case "user":
+		n, err = s.effects.HideUser(value, hidden)
+	case "forks":
+		var id int
+		id, err = strconv.Atoi(value)
+		if err == nil {
+			n, err = s.effects.HideForks(id, hidden)
+		}
+	case "code":
+		n, err = s.effects.HideCode(value, hidden)
+	case "created":
+		var from, to time.Time
+		from, err = parseFormTime(values.Get("from"))
+		if err != nil {
+			break
+		}
+		to, err = parseFormTime(values.Get("to"))
+		if err != nil {
+			break
+		}
+		value = fmt.Sprintf("%s - %s", from, to)
+		n, err = s.effects.HideCreated(from, to, hidden)
+	default:
+		err = fmt.Errorf("unknown bulk action %s", values.Get("bulk"))
+	}
+	if err != nil {
+		c.Logger().Errorf("could not apply bulk action: %s", err.Error())
+		return
+	}
+
+	c.Logger().Infof("bulk %s by %s %q changed %d effects",
+		values.Get("action"), values.Get("bulk"), value, n)
+
+	if n > 0 {
+		event := webhook.EventEffectsBulkUnhidden
+		if hidden {
+			event = webhook.EventEffectsBulkHidden
+		}
+		s.emit(c, event, bulkEvent{
+			Bulk:  values.Get("bulk"),
+			Value: value,
+			Count: n,
+		})
+	}
+}
+
+// parseFormTime parses the value of a datetime-local input in the server
+// time zone.
+func parseFormTime(v string) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01-02T15:04", v, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed time: %w", err)
+	}
+	return t, nil
+}
+
 type loginData struct {
 	Name     string `form:"name"`
 	Password string `form:"password"`
@@ -535,6 +800,26 @@ func saveImage(path string, data []byte) error {
 	return nil
 }
 
+// baseCodeHash returns the code hash of the version a save starts from: the
+// parent version of a new effect or the edited version of an existing one.
+// It is empty when the version is not known.
+func (s *Server) baseCodeHash(save SaveQuery) string {
+	param := save.Parent
+	if save.CodeID != "" {
+		param = save.CodeID
+	}
+
+	id, version, err := idVersion(param)
+	if err != nil {
+		return ""
+	}
+	e, err := s.effects.EffectVersion(id, version)
+	if err != nil {
+		return ""
+	}
+	return e.Versions[0].CodeHash
+}
+
 func idVersion(param string) (int, int, error) {
 	var idString, versionString string
 	parts := strings.Split(strings.TrimPrefix(param, "#"), ".")
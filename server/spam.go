@@ -0,0 +1,328 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/png"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrdoob/glsl-sandbox/server/store"
+	"github.com/mrdoob/glsl-sandbox/server/thumb"
+)
+
+const (
+	// spamReviewScore is the score that queues an effect for review.
+	spamReviewScore = 50
+	// spamHideScore is the score that hides a version.
+	spamHideScore = 100
+
+	repeatWindow = 10 * time.Minute
+	repeatLimit  = 5
+	urlLimit     = 3
+)
+
+// Submission is the information scorers use to rate a save.
+type Submission struct {
+	// Code is the shader source.
+	Code string
+	// Image is the decoded thumbnail.
+	Image []byte
+	// Submitter has the hashed client information.
+	Submitter store.Submitter
+	// Base is the code hash of the version the code starts from, the parent
+	// version of a fork or the edited version. It is empty when unknown.
+	Base string
+}
+
+// Scorer rates how likely a submission is spam. It returns 0 if it looks
+// fine or a positive score and a short reason.
+type Scorer interface {
+	Score(sub Submission) (int, string, error)
+}
+
+// ScorerFunc adapts a function to the Scorer interface.
+type ScorerFunc func(sub Submission) (int, string, error)
+
+func (f ScorerFunc) Score(sub Submission) (int, string, error) {
+	return f(sub)
+}
+
+// defaultScorers returns the scorers used by the server. The default
+// shader is read from the example in the editor page. The example scorer is
+// skipped when the page can not be read.
+func defaultScorers(effects *store.Effects, page string, logger echo.Logger) []Scorer {
+	scorers := []Scorer{
+		duplicateScorer(effects),
+		ScorerFunc(urlScorer),
+		repeatScorer(effects),
+		ScorerFunc(blankScorer),
+	}
+
+	example, err := exampleScorer(page)
+	if err != nil {
+		logger.Warnf("example spam scorer disabled: %s", err.Error())
+		return scorers
+	}
+
+	return append([]Scorer{example}, scorers...)
+}
+
+var exampleRegexp = regexp.MustCompile(
+	`(?s)<script id="example" type="x-shader/x-fragment">(.*?)</script>`)
+
+// exampleScorer flags code that is the unmodified default shader.
+func exampleScorer(page string) (Scorer, error) {
+	data, err := os.ReadFile(page)
+	if err != nil {
+		return nil, fmt.Errorf("could not read example shader: %w", err)
+	}
+
+	m := exampleRegexp.FindSubmatch(data)
+	if m == nil {
+		return nil, fmt.Errorf("example shader not found in %s", page)
+	}
+	hash := store.NormalizedHash(string(m[1]))
+
+	return ScorerFunc(func(sub Submission) (int, string, error) {
+		if store.NormalizedHash(sub.Code) == hash {
+			return 100, "example", nil
+		}
+		return 0, "", nil
+	}), nil
+}
+
+// duplicateScorer flags code identical to an already stored version. Code
+// saved unchanged from the version it starts from, like a fork that was not
+// edited yet, is not flagged.
+func duplicateScorer(effects *store.Effects) Scorer {
+	return ScorerFunc(func(sub Submission) (int, string, error) {
+		hash := store.CodeHash(sub.Code)
+		if hash == sub.Base {
+			return 0, "", nil
+		}
+
+		n, err := effects.CountCode(hash)
+		if err != nil {
+			return 0, "", err
+		}
+		if n > 0 {
+			return 60, "duplicate", nil
+		}
+		return 0, "", nil
+	})
+}
+
+var urlRegexp = regexp.MustCompile(`(?i)(https?://|www\.)`)
+
+// urlScorer flags code stuffed with links.
+func urlScorer(sub Submission) (int, string, error) {
+	n := len(urlRegexp.FindAllStringIndex(sub.Code, -1))
+	if n >= urlLimit {
+		return 20 * n, "urls", nil
+	}
+	return 0, "", nil
+}
+
+// repeatScorer flags clients that save many versions in a short time.
+func repeatScorer(effects *store.Effects) Scorer {
+	return ScorerFunc(func(sub Submission) (int, string, error) {
+		since := time.Now().Add(-repeatWindow)
+		n, err := effects.CountSubmitter(sub.Submitter.Fingerprint, since)
+		if err != nil {
+			return 0, "", err
+		}
+		if n >= repeatLimit {
+			return 50, "repeat", nil
+		}
+		return 0, "", nil
+	})
+}
+
+// blankScorer flags thumbnails with a single color.
+func blankScorer(sub Submission) (int, string, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(sub.Image))
+	if err != nil {
+		return 0, "", fmt.Errorf("could not decode thumbnail: %w", err)
+	}
+	if cfg.Width > thumb.MaxWidth || cfg.Height > thumb.MaxHeight {
+		return 0, "", fmt.Errorf("thumbnail of %dx%d is too big", cfg.Width, cfg.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(sub.Image))
+	if err != nil {
+		return 0, "", fmt.Errorf("could not decode thumbnail: %w", err)
+	}
+
+	bounds := img.Bounds()
+	r0, g0, b0, a0 := img.At(bounds.Min.X, bounds.Min.Y).RGBA()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if r != r0 || g != g0 || b != b0 || a != a0 {
+				return 0, "", nil
+			}
+		}
+	}
+
+	return 40, "blank", nil
+}
+
+// spamScore runs all the scorers and returns the total score and reasons.
+// Scorers that fail are skipped.
+func (s *Server) spamScore(c echo.Context, sub Submission) (int, []string) {
+	var score int
+	var reasons []string
+	for _, sc := range s.scorers {
+		n, reason, err := sc.Score(sub)
+		if err != nil {
+			c.Logger().Errorf("could not score submission: %s", err.Error())
+			continue
+		}
+		if n <= 0 {
+			continue
+		}
+		score += n
+		reasons = append(reasons, reason)
+	}
+
+	return score, reasons
+}
+
+// flagSpam stores the score of a saved version, hiding it or queueing the
+// effect for review when it is high enough.
+func (s *Server) flagSpam(
+	c echo.Context, id, version, score int, reasons []string,
+) {
+	if score <= 0 {
+		return
+	}
+
+	err := s.effects.SetSpam(id, version, score, reasons)
+	if err != nil {
+		c.Logger().Errorf("could not store spam score: %s", err.Error())
+	}
+
+	if score >= spamHideScore {
+		err = s.effects.HideVersion(id, version, true)
+		if err != nil {
+			c.Logger().Errorf("could not hide spam: %s", err.Error())
+		} else {
+			s.emitHide(c, id, &version, true)
+		}
+	}
+
+	if score >= spamReviewScore {
+		err = s.effects.Review(id, true)
+		if err != nil {
+			c.Logger().Errorf("could not queue effect for review: %s", err.Error())
+		}
+	}
+}
+
+// reviewEffect has information about each effect displayed in the review
+// page.
+type reviewEffect struct {
+	// ID is the effect identifier.
+	ID int
+	// Image holds the thumbnail name.
+	Image string
+	// User is the user string of the effect.
+	User string
+	// ModifiedAt is the date of the last version.
+	ModifiedAt string
+	// Score is the highest spam score of its versions.
+	Score int
+	// Reasons lists why the versions got their scores.
+	Reasons string
+}
+
+// reviewData has information about the review page.
+type reviewData struct {
+	// Effects is an array with the effects waiting for review.
+	Effects []reviewEffect
+	// Page holds the current page number.
+	Page int
+	// IsPrevious is true if there is a previous page.
+	IsPrevious bool
+	// PreviousPage is the previous page URL.
+	PreviousPage string
+	// IsNext is true if there is a next page.
+	IsNext bool
+	// NextPage is the next page URL.
+	NextPage string
+}
+
+func (s *Server) reviewHandler(c echo.Context) error {
+	page, err := strconv.Atoi(c.QueryParam("page"))
+	if err != nil || page < 0 {
+		page = 0
+	}
+
+	p, err := s.effects.Reviews(page, perPage)
+	if err != nil {
+		c.Logger().Errorf("could not get effects for review: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "error")
+	}
+
+	effects := make([]reviewEffect, len(p))
+	for i, e := range p {
+		score := 0
+		var reasons []string
+		seen := make(map[string]struct{})
+		for _, v := range e.Versions {
+			if v.SpamScore > score {
+				score = v.SpamScore
+			}
+			for _, r := range v.SpamReasons {
+				if _, ok := seen[r]; !ok {
+					seen[r] = struct{}{}
+					reasons = append(reasons, r)
+				}
+			}
+		}
+
+		effects[i] = reviewEffect{
+			ID:         e.ID,
+			Image:      path.Join("/thumbs", e.ImageName()),
+			User:       e.User,
+			ModifiedAt: e.ModifiedAt.Format(time.RFC3339),
+			Score:      score,
+			Reasons:    strings.Join(reasons, ", "),
+		}
+	}
+
+	d := reviewData{
+		Effects:      effects,
+		Page:         page,
+		IsPrevious:   page > 0,
+		PreviousPage: fmt.Sprintf("/admin/review?page=%d", page-1),
+		IsNext:       len(effects) == perPage,
+		NextPage:     fmt.Sprintf("/admin/review?page=%d", page+1),
+	}
+
+	return c.Render(http.StatusOK, "review", d)
+}
+
+// reviewPostHandler takes an effect out of the review queue.
+func (s *Server) reviewPostHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.FormValue("id"))
+	if err != nil {
+		c.Logger().Errorf("malformed effect id: %s", err.Error())
+		return c.Redirect(http.StatusSeeOther, "/admin/review")
+	}
+
+	err = s.effects.Review(id, false)
+	if err != nil {
+		c.Logger().Errorf("could not update effect: %s", err.Error())
+	}
+
+	return c.Redirect(http.StatusSeeOther, "/admin/review")
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/mrdoob/glsl-sandbox/server/store"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+func testPNG(t *testing.T, blank bool) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 20; x++ {
+			c := color.RGBA{A: 255}
+			if !blank {
+				c.R = uint8(x * 10)
+			}
+			img.Set(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+// bigPNG returns a small file with an image bigger than thumbnails can be.
+func bigPNG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, 5000, 5000))))
+	return buf.Bytes()
+}
+
+func TestSpamScorers(t *testing.T) {
+	n, _, err := urlScorer(Submission{Code: "// http://a.example"})
+	require.NoError(t, err)
+	require.Zero(t, n)
+	n, reason, err := urlScorer(Submission{
+		Code: "// http://a.example https://b.example www.c.example",
+	})
+	require.NoError(t, err)
+	require.Equal(t, 60, n)
+	require.Equal(t, "urls", reason)
+
+	n, _, err = blankScorer(Submission{Image: testPNG(t, false)})
+	require.NoError(t, err)
+	require.Zero(t, n)
+	n, reason, err = blankScorer(Submission{Image: testPNG(t, true)})
+	require.NoError(t, err)
+	require.Equal(t, 40, n)
+	require.Equal(t, "blank", reason)
+	_, _, err = blankScorer(Submission{Image: bigPNG(t)})
+	require.Error(t, err)
+	_, _, err = blankScorer(Submission{Image: []byte("garbage")})
+	require.Error(t, err)
+
+	page := filepath.Join(t.TempDir(), "index.html")
+	err = os.WriteFile(page, []byte(`<html>
+<script id="example" type="x-shader/x-fragment">
+void main() {
+	gl_FragColor = vec4(1.0);
+}
+</script>
+</html>`), 0600)
+	require.NoError(t, err)
+
+	example, err := exampleScorer(page)
+	require.NoError(t, err)
+	n, reason, err = example.Score(Submission{
+		Code: "void main() { gl_FragColor = vec4(1.0); }",
+	})
+	require.NoError(t, err)
+	require.Equal(t, 100, n)
+	require.Equal(t, "example", reason)
+	n, _, err = example.Score(Submission{Code: "void main() {}"})
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	_, err = exampleScorer(filepath.Join(t.TempDir(), "missing.html"))
+	require.Error(t, err)
+
+	db, err := sqlx.Connect(sqliteshim.ShimName, ":memory:")
+	require.NoError(t, err)
+	effects, err := store.NewEffects(db)
+	require.NoError(t, err)
+
+	// a missing page only disables the example scorer
+	scorers := defaultScorers(effects, filepath.Join(t.TempDir(), "missing.html"), echo.New().Logger)
+	require.Len(t, scorers, 4)
+	require.Len(t, defaultScorers(effects, page, echo.New().Logger), 5)
+
+	sub := store.Submitter{Fingerprint: "fingerprint"}
+	_, err = effects.Add(-1, -1, "user", "code", sub)
+	require.NoError(t, err)
+
+	n, reason, err = duplicateScorer(effects).Score(Submission{Code: "code"})
+	require.NoError(t, err)
+	require.Equal(t, 60, n)
+	require.Equal(t, "duplicate", reason)
+	n, _, err = duplicateScorer(effects).Score(Submission{Code: "other"})
+	require.NoError(t, err)
+	require.Zero(t, n)
+	// unchanged forks are not duplicates
+	n, _, err = duplicateScorer(effects).Score(Submission{
+		Code: "code",
+		Base: store.CodeHash("code"),
+	})
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	repeat := repeatScorer(effects)
+	for i := 1; i < repeatLimit; i++ {
+		n, _, err = repeat.Score(Submission{Submitter: sub})
+		require.NoError(t, err)
+		require.Zero(t, n)
+		_, err = effects.Add(-1, -1, "user", fmt.Sprint(i), sub)
+		require.NoError(t, err)
+	}
+	n, reason, err = repeat.Score(Submission{Submitter: sub})
+	require.NoError(t, err)
+	require.Equal(t, 50, n)
+	require.Equal(t, "repeat", reason)
+}
+
+func TestSpamScore(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName, ":memory:")
+	require.NoError(t, err)
+	effects, err := store.NewEffects(db)
+	require.NoError(t, err)
+
+	s := &Server{
+		echo:    echo.New(),
+		effects: effects,
+		scorers: []Scorer{
+			ScorerFunc(func(sub Submission) (int, string, error) {
+				if strings.Contains(sub.Code, "spam") {
+					return 60, "spam", nil
+				}
+				return 0, "", nil
+			}),
+			ScorerFunc(func(sub Submission) (int, string, error) {
+				return 0, "", fmt.Errorf("broken")
+			}),
+			ScorerFunc(urlScorer),
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/e", nil)
+	c := s.echo.NewContext(req, httptest.NewRecorder())
+
+	score, reasons := s.spamScore(c, Submission{Code: "fine"})
+	require.Zero(t, score)
+	require.Empty(t, reasons)
+
+	code := "spam http:// http:// http://"
+	score, reasons = s.spamScore(c, Submission{Code: code})
+	require.Equal(t, 120, score)
+	require.Equal(t, []string{"spam", "urls"}, reasons)
+
+	id, err := effects.Add(-1, -1, "user", code, store.Submitter{})
+	require.NoError(t, err)
+	s.flagSpam(c, id, 0, score, reasons)
+
+	e, err := effects.Effect(id)
+	require.NoError(t, err)
+	require.True(t, e.Review)
+	require.True(t, e.Versions[0].Hidden)
+	require.Equal(t, 120, e.Versions[0].SpamScore)
+
+	id, err = effects.Add(-1, -1, "user", "spam", store.Submitter{})
+	require.NoError(t, err)
+	s.flagSpam(c, id, 0, 60, []string{"spam"})
+
+	e, err = effects.Effect(id)
+	require.NoError(t, err)
+	require.True(t, e.Review)
+	require.False(t, e.Versions[0].Hidden)
+}
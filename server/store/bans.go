@@ -0,0 +1,233 @@
+package store
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type BanKind string
+
+const (
+	BanIP     BanKind = "ip"
+	BanCIDR   BanKind = "cidr"
+	BanClient BanKind = "client"
+)
+
+// Ban blocks a client from submitting content. Value is an IP address, a
+// CIDR or a hashed client identifier depending on Kind. A zero ExpiresAt
+// means the ban does not expire.
+type Ban struct {
+	ID        int       `db:"id"`
+	Kind      BanKind   `db:"kind"`
+	Value     string    `db:"value"`
+	Reason    string    `db:"reason"`
+	CreatedAt time.Time `db:"created_at"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// Expired returns true if the ban is no longer in effect at time t.
+func (b Ban) Expired(t time.Time) bool {
+	return !b.ExpiresAt.IsZero() && !t.Before(b.ExpiresAt)
+}
+
+// Matches checks if the ban applies to the client address or any of its
+// hashed identifiers.
+func (b Ban) Matches(ip string, clients ...string) bool {
+	switch b.Kind {
+	case BanIP:
+		a, v := net.ParseIP(ip), net.ParseIP(b.Value)
+		return a != nil && v != nil && a.Equal(v)
+	case BanCIDR:
+		a := net.ParseIP(ip)
+		_, n, err := net.ParseCIDR(b.Value)
+		return a != nil && err == nil && n.Contains(a)
+	case BanClient:
+		for _, c := range clients {
+			if c != "" && c == b.Value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// BanKindOf guesses the kind of ban from its value.
+func BanKindOf(value string) BanKind {
+	if net.ParseIP(value) != nil {
+		return BanIP
+	}
+	if _, _, err := net.ParseCIDR(value); err == nil {
+		return BanCIDR
+	}
+	return BanClient
+}
+
+const (
+	sqlCreateBans = `
+CREATE TABLE IF NOT EXISTS bans (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	kind TEXT,
+	value TEXT,
+	reason TEXT,
+	created_at TIMESTAMP,
+	expires_at TIMESTAMP
+)
+`
+)
+
+type Bans struct {
+	db *sqlx.DB
+}
+
+func NewBans(db *sqlx.DB) (*Bans, error) {
+	b := &Bans{
+		db: db,
+	}
+	err := b.Init()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (s *Bans) Init() error {
+	_, err := s.db.Exec(sqlCreateBans)
+	if err != nil {
+		return fmt.Errorf("could not create table bans: %w", err)
+	}
+	return nil
+}
+
+const (
+	sqlSelectBans = `
+SELECT * FROM bans
+	ORDER BY id
+`
+
+	sqlInsertBan = `
+INSERT INTO bans (
+	kind,
+	value,
+	reason,
+	created_at,
+	expires_at
+) VALUES(
+	:kind,
+	:value,
+	:reason,
+	:created_at,
+	:expires_at
+)
+`
+
+	sqlDeleteBan = `
+DELETE FROM bans
+	WHERE id = ?
+`
+)
+
+// Add stores a new ban and returns its identifier. When the kind is empty
+// it is guessed from the value.
+func (s *Bans) Add(ban Ban) (int, error) {
+	ban.Value = strings.TrimSpace(ban.Value)
+	if ban.Value == "" {
+		return 0, fmt.Errorf("%w: empty ban value", ErrInvalid)
+	}
+	if ban.Kind == "" {
+		ban.Kind = BanKindOf(ban.Value)
+	}
+
+	switch ban.Kind {
+	case BanIP:
+		if net.ParseIP(ban.Value) == nil {
+			return 0, fmt.Errorf("%w: invalid ip address: %s", ErrInvalid, ban.Value)
+		}
+	case BanCIDR:
+		if _, _, err := net.ParseCIDR(ban.Value); err != nil {
+			return 0, fmt.Errorf("%w: invalid cidr: %s", ErrInvalid, err.Error())
+		}
+	case BanClient:
+	default:
+		return 0, fmt.Errorf("%w: invalid ban kind: %s", ErrInvalid, ban.Kind)
+	}
+
+	if ban.CreatedAt.IsZero() {
+		ban.CreatedAt = time.Now()
+	}
+
+	r, err := s.db.NamedExec(sqlInsertBan, ban)
+	if err != nil {
+		return 0, fmt.Errorf("could not add ban: %w", err)
+	}
+	id, err := r.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("could not get ban id: %w", err)
+	}
+	return int(id), nil
+}
+
+// Bans returns all the bans, expired ones included.
+func (s *Bans) Bans() ([]Ban, error) {
+	rows, err := s.db.Queryx(sqlSelectBans)
+	if err != nil {
+		return nil, fmt.Errorf("could not get bans: %w", err)
+	}
+	defer rows.Close()
+
+	var bans []Ban
+	for rows.Next() {
+		var b Ban
+		err = rows.StructScan(&b)
+		if err != nil {
+			return nil, fmt.Errorf("could not read ban: %w", err)
+		}
+		bans = append(bans, b)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("could not get bans: %w", rows.Err())
+	}
+
+	return bans, nil
+}
+
+// Remove deletes a ban.
+func (s *Bans) Remove(id int) error {
+	r, err := s.db.Exec(sqlDeleteBan, id)
+	if err != nil {
+		return fmt.Errorf("could not delete ban: %w", err)
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not get affected rows: %w", err)
+	}
+	if n < 1 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Match returns the first active ban that applies to the client address or
+// any of its hashed identifiers. ErrNotFound is returned when the client is
+// not banned.
+func (s *Bans) Match(ip string, clients ...string) (Ban, error) {
+	bans, err := s.Bans()
+	if err != nil {
+		return Ban{}, err
+	}
+
+	now := time.Now()
+	for _, b := range bans {
+		if b.Expired(now) {
+			continue
+		}
+		if b.Matches(ip, clients...) {
+			return b, nil
+		}
+	}
+
+	return Ban{}, ErrNotFound
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+func TestBanKindOf(t *testing.T) {
+	require.Equal(t, BanIP, BanKindOf("192.168.1.1"))
+	require.Equal(t, BanIP, BanKindOf("2001:db8::1"))
+	require.Equal(t, BanCIDR, BanKindOf("10.0.0.0/8"))
+	require.Equal(t, BanClient, BanKindOf("0a1b2c3d"))
+}
+
+func TestBans(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName, testDatabase)
+	require.NoError(t, err)
+
+	bans, err := NewBans(db)
+	require.NoError(t, err)
+
+	_, err = bans.Match("192.168.1.1", "client")
+	require.True(t, errors.Is(err, ErrNotFound))
+
+	_, err = bans.Add(Ban{Value: ""})
+	require.True(t, errors.Is(err, ErrInvalid))
+	_, err = bans.Add(Ban{Kind: BanIP, Value: "10.0.0.0/8"})
+	require.True(t, errors.Is(err, ErrInvalid))
+	_, err = bans.Add(Ban{Kind: BanCIDR, Value: "10.0.0.1"})
+	require.True(t, errors.Is(err, ErrInvalid))
+	_, err = bans.Add(Ban{Kind: "other", Value: "10.0.0.1"})
+	require.True(t, errors.Is(err, ErrInvalid))
+
+	ipID, err := bans.Add(Ban{Value: "192.168.1.1", Reason: "spam"})
+	require.NoError(t, err)
+	_, err = bans.Add(Ban{Value: "10.0.0.0/8"})
+	require.NoError(t, err)
+	_, err = bans.Add(Ban{Value: "client"})
+	require.NoError(t, err)
+	_, err = bans.Add(Ban{
+		Value:     "172.16.0.1",
+		ExpiresAt: time.Now().Add(-time.Hour),
+	})
+	require.NoError(t, err)
+
+	list, err := bans.Bans()
+	require.NoError(t, err)
+	require.Len(t, list, 4)
+	require.Equal(t, BanIP, list[0].Kind)
+	require.Equal(t, "spam", list[0].Reason)
+	require.True(t, list[0].ExpiresAt.IsZero())
+	require.False(t, list[0].CreatedAt.IsZero())
+	require.Equal(t, BanCIDR, list[1].Kind)
+	require.Equal(t, BanClient, list[2].Kind)
+	require.True(t, list[3].Expired(time.Now()))
+
+	b, err := bans.Match("192.168.1.1", "")
+	require.NoError(t, err)
+	require.Equal(t, ipID, b.ID)
+
+	b, err = bans.Match("10.1.2.3", "")
+	require.NoError(t, err)
+	require.Equal(t, BanCIDR, b.Kind)
+
+	b, err = bans.Match("192.168.1.2", "client")
+	require.NoError(t, err)
+	require.Equal(t, BanClient, b.Kind)
+
+	_, err = bans.Match("172.16.0.1", "other")
+	require.True(t, errors.Is(err, ErrNotFound))
+
+	err = bans.Remove(ipID)
+	require.NoError(t, err)
+	_, err = bans.Match("192.168.1.1", "")
+	require.True(t, errors.Is(err, ErrNotFound))
+
+	err = bans.Remove(ipID)
+	require.True(t, errors.Is(err, ErrNotFound))
+}
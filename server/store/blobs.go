@@ -0,0 +1,438 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Version code is stored once in code_blobs keyed by its hash. The code
+// column of versions is left empty for versions with a blob, and is only
+// read for rows not migrated yet.
+//
+// With delta storage a blob can instead hold a compressed delta against the
+// blob in base. Its code is empty, depth counts the deltas to the nearest
+// full blob and size is the length of the code it rebuilds.
+const (
+	sqlCreateCodeBlobs = `
+CREATE TABLE IF NOT EXISTS code_blobs (
+	hash TEXT PRIMARY KEY,
+	code TEXT,
+	base TEXT NOT NULL DEFAULT '',
+	delta BLOB,
+	depth INTEGER NOT NULL DEFAULT 0,
+	size INTEGER
+)
+`
+
+	sqlIndexCodeBlobsBase = `
+CREATE INDEX IF NOT EXISTS idx_code_blobs_base ON code_blobs (base)
+`
+
+	sqlSelectCodeBlob = `
+SELECT code, base, delta FROM code_blobs
+	WHERE hash = ?
+`
+
+	sqlSelectCodeBlobDepth = `
+SELECT depth FROM code_blobs
+	WHERE hash = ?
+`
+
+	sqlInsertCodeDelta = `
+INSERT OR IGNORE INTO code_blobs (hash, code, base, delta, depth, size)
+	VALUES (?, '', ?, ?, ?, ?)
+`
+
+	sqlSelectCodeBlobsBase = `
+SELECT DISTINCT base FROM code_blobs
+	WHERE hash IN (?) AND base != ''
+`
+
+	sqlInsertCodeBlob = `
+INSERT OR IGNORE INTO code_blobs (hash, code)
+	VALUES (?, ?)
+`
+
+	sqlMigrateCodeBlobs = `
+INSERT OR IGNORE INTO code_blobs (hash, code)
+	SELECT code_hash, code FROM versions
+		WHERE code != '' AND code_hash != ''
+`
+
+	sqlClearMigratedCode = `
+UPDATE versions
+	SET code = ''
+	WHERE code != '' AND
+		code_hash IN (SELECT hash FROM code_blobs)
+`
+
+	sqlSelectVersionsCodeHash = `
+SELECT DISTINCT code_hash FROM versions
+	WHERE effect IN (?)
+`
+
+	sqlSelectUnusedBaseDeltas = `
+SELECT hash FROM code_blobs
+	WHERE base IN (?) AND
+		NOT EXISTS (SELECT 1 FROM versions WHERE versions.code_hash = code_blobs.base)
+`
+
+	sqlUpdateCodeBlobFull = `
+UPDATE code_blobs
+	SET code = ?, base = '', delta = NULL, depth = 0
+	WHERE hash = ?
+`
+
+	sqlSelectUnusedCodeBlobs = `
+SELECT hash FROM code_blobs
+	WHERE NOT EXISTS (SELECT 1 FROM versions WHERE versions.code_hash = code_blobs.hash)
+`
+
+	sqlDeleteUnusedCodeBlobs = `
+DELETE FROM code_blobs
+	WHERE hash IN (?) AND
+		NOT EXISTS (SELECT 1 FROM versions WHERE versions.code_hash = code_blobs.hash) AND
+		NOT EXISTS (SELECT 1 FROM code_blobs AS deltas WHERE deltas.base = code_blobs.hash)
+`
+
+	sqlSelectVersionsCodeSize = `
+SELECT
+	COUNT(*),
+	IFNULL(SUM(IFNULL(code_blobs.size,
+		LENGTH(CAST(COALESCE(code_blobs.code, versions.code) AS BLOB)))), 0),
+	IFNULL(SUM(LENGTH(CAST(versions.code AS BLOB))), 0)
+	FROM versions
+	LEFT JOIN code_blobs ON code_blobs.hash = versions.code_hash
+`
+
+	sqlSelectCodeBlobsSize = `
+SELECT
+	COUNT(*),
+	IFNULL(SUM(base != ''), 0),
+	IFNULL(SUM(LENGTH(CAST(code AS BLOB)) + IFNULL(LENGTH(delta), 0)), 0)
+	FROM code_blobs
+`
+)
+
+// maxDeltaChain limits the deltas followed to rebuild code so a corrupted
+// database can not loop forever.
+const maxDeltaChain = 1024
+
+// MaxDeltaSnapshots is the largest DeltaSnapshots interval. Longer chains
+// could not be read back.
+const MaxDeltaSnapshots = maxDeltaChain
+
+// CodeStats has the space used by version code. Bytes is the size of the
+// code of all versions and Stored the size actually stored after removing
+// duplicates and compressing deltas. Deltas is the number of blobs stored as
+// deltas.
+type CodeStats struct {
+	Versions int64
+	Blobs    int64
+	Deltas   int64
+	Bytes    int64
+	Stored   int64
+}
+
+// Saved returns the space saved storing each distinct code once and as
+// deltas.
+func (c CodeStats) Saved() int64 {
+	return c.Bytes - c.Stored
+}
+
+// CodeStats returns how much space version code uses.
+func (s *Effects) CodeStats() (CodeStats, error) {
+	var c CodeStats
+	var inline int64
+	err := s.db.QueryRowx(sqlSelectVersionsCodeSize).Scan(&c.Versions, &c.Bytes, &inline)
+	if err != nil {
+		return CodeStats{}, fmt.Errorf("could not get versions code size: %w", err)
+	}
+
+	var blobBytes int64
+	err = s.db.QueryRowx(sqlSelectCodeBlobsSize).Scan(&c.Blobs, &c.Deltas, &blobBytes)
+	if err != nil {
+		return CodeStats{}, fmt.Errorf("could not get code blobs size: %w", err)
+	}
+	c.Stored = blobBytes + inline
+
+	return c, nil
+}
+
+// migrateCodeBlobs moves the code stored in versions to code_blobs. It
+// needs the code hashes filled by hashVersions.
+func (s *Effects) migrateCodeBlobs() error {
+	return s.transaction(func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(sqlMigrateCodeBlobs)
+		if err != nil {
+			return fmt.Errorf("could not copy code to blobs: %w", err)
+		}
+
+		_, err = tx.Exec(sqlClearMigratedCode)
+		if err != nil {
+			return fmt.Errorf("could not clear migrated code: %w", err)
+		}
+		return nil
+	})
+}
+
+// insertVersion stores a version with its code in code_blobs. When
+// snapshots is greater than zero new code is stored as a delta against the
+// code with hash base.
+func insertVersion(tx *sqlx.Tx, v sqliteVersion, snapshots int, base string) error {
+	err := insertCode(tx, v.CodeHash, v.Code, snapshots, base)
+	if err != nil {
+		return err
+	}
+
+	v.Code = ""
+	_, err = tx.NamedExec(sqlInsertVersion, v)
+	if err != nil {
+		return fmt.Errorf("could not insert version: %w", err)
+	}
+	return nil
+}
+
+// insertCode adds code to code_blobs if it is not there yet. It is stored
+// in full when there is no base, when the chain of deltas would reach
+// snapshots links or when the delta is not smaller than the code.
+func insertCode(tx *sqlx.Tx, hash string, code string, snapshots int, base string) error {
+	full := func() error {
+		_, err := tx.Exec(sqlInsertCodeBlob, hash, code)
+		if err != nil {
+			return fmt.Errorf("could not insert code: %w", err)
+		}
+		return nil
+	}
+
+	if snapshots <= 0 || base == "" || base == hash {
+		return full()
+	}
+	if snapshots > MaxDeltaSnapshots {
+		snapshots = MaxDeltaSnapshots
+	}
+
+	var depth int
+	err := tx.Get(&depth, sqlSelectCodeBlobDepth, hash)
+	if err == nil {
+		// already stored
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("could not get code blob: %w", err)
+	}
+
+	err = tx.Get(&depth, sqlSelectCodeBlobDepth, base)
+	if errors.Is(err, sql.ErrNoRows) {
+		return full()
+	}
+	if err != nil {
+		return fmt.Errorf("could not get code blob: %w", err)
+	}
+	if depth+1 >= snapshots {
+		return full()
+	}
+
+	baseCode, err := newCodeResolver(tx).resolve(base)
+	if err != nil {
+		return err
+	}
+	delta, err := makeDelta([]byte(baseCode), []byte(code))
+	if err != nil {
+		return err
+	}
+	if len(delta) >= len(code) {
+		return full()
+	}
+
+	_, err = tx.Exec(sqlInsertCodeDelta, hash, base, delta, depth+1, len(code))
+	if err != nil {
+		return fmt.Errorf("could not insert code delta: %w", err)
+	}
+	return nil
+}
+
+// codeResolver rebuilds the code of blobs stored as deltas. It remembers the
+// code already rebuilt as the versions of an effect share most of their
+// chains.
+type codeResolver struct {
+	q    sqlx.Queryer
+	code map[string]string
+}
+
+func newCodeResolver(q sqlx.Queryer) *codeResolver {
+	return &codeResolver{
+		q:    q,
+		code: make(map[string]string),
+	}
+}
+
+// version fills the code of a version read with sqlSelectVersionColumns.
+func (r *codeResolver) version(v *sqliteVersion) error {
+	if v.CodeBase == "" {
+		r.code[v.CodeHash] = v.Code
+		return nil
+	}
+
+	base, err := r.resolve(v.CodeBase)
+	if err != nil {
+		return err
+	}
+	code, err := applyDelta([]byte(base), v.CodeDelta)
+	if err != nil {
+		return fmt.Errorf("could not rebuild code %s: %w", v.CodeHash, err)
+	}
+	v.Code = string(code)
+	r.code[v.CodeHash] = v.Code
+	return nil
+}
+
+// resolve returns the code of a blob following its deltas to the nearest
+// full blob.
+func (r *codeResolver) resolve(hash string) (string, error) {
+	type link struct {
+		hash  string
+		delta []byte
+	}
+
+	var chain []link
+	var code string
+	for {
+		if c, ok := r.code[hash]; ok {
+			code = c
+			break
+		}
+		if len(chain) > maxDeltaChain {
+			return "", fmt.Errorf("delta chain of code %s is too long", hash)
+		}
+
+		var blob struct {
+			Code  string `db:"code"`
+			Base  string `db:"base"`
+			Delta []byte `db:"delta"`
+		}
+		err := sqlx.Get(r.q, &blob, sqlSelectCodeBlob, hash)
+		if err != nil {
+			return "", fmt.Errorf("could not get code %s: %w", hash, err)
+		}
+
+		if blob.Base == "" {
+			code = blob.Code
+			r.code[hash] = code
+			break
+		}
+		chain = append(chain, link{hash: hash, delta: blob.Delta})
+		hash = blob.Base
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		data, err := applyDelta([]byte(code), chain[i].delta)
+		if err != nil {
+			return "", fmt.Errorf("could not rebuild code %s: %w", chain[i].hash, err)
+		}
+		code = string(data)
+		r.code[chain[i].hash] = code
+	}
+
+	return code, nil
+}
+
+// versionsCodeHash returns the code hashes used by the versions of the
+// effects.
+func versionsCodeHash(tx *sqlx.Tx, ids []int) ([]string, error) {
+	query, args, err := sqlx.In(sqlSelectVersionsCodeHash, ids)
+	if err != nil {
+		return nil, fmt.Errorf("could not construct code hash query: %w", err)
+	}
+
+	var hashes []string
+	err = tx.Select(&hashes, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not get code hashes: %w", err)
+	}
+	return hashes, nil
+}
+
+// deleteUnusedCode removes the blobs of the hashes that no version uses.
+// Deltas based on them are stored in full first so removed code does not
+// stay as the base of other effects' code. The bases of removed deltas are
+// checked afterwards as they may not be used anymore.
+func deleteUnusedCode(tx *sqlx.Tx, hashes []string) error {
+	for len(hashes) > 0 {
+		err := rebaseDeltas(tx, hashes)
+		if err != nil {
+			return err
+		}
+
+		query, args, err := sqlx.In(sqlSelectCodeBlobsBase, hashes)
+		if err != nil {
+			return fmt.Errorf("could not construct bases query: %w", err)
+		}
+		var bases []string
+		err = tx.Select(&bases, query, args...)
+		if err != nil {
+			return fmt.Errorf("could not get code bases: %w", err)
+		}
+
+		query, args, err = sqlx.In(sqlDeleteUnusedCodeBlobs, hashes)
+		if err != nil {
+			return fmt.Errorf("could not construct delete query: %w", err)
+		}
+		_, err = tx.Exec(query, args...)
+		if err != nil {
+			return fmt.Errorf("could not delete unused code: %w", err)
+		}
+
+		hashes = bases
+	}
+	return nil
+}
+
+// deleteAllUnusedCode removes all the blobs that no version uses.
+func deleteAllUnusedCode(tx *sqlx.Tx) error {
+	var hashes []string
+	err := tx.Select(&hashes, sqlSelectUnusedCodeBlobs)
+	if err != nil {
+		return fmt.Errorf("could not get unused code: %w", err)
+	}
+	return deleteUnusedCode(tx, hashes)
+}
+
+// rebaseDeltas stores in full the deltas based on the hashes that no
+// version uses. The depth of the deltas based on them is not updated, it
+// only makes a snapshot come earlier.
+func rebaseDeltas(tx *sqlx.Tx, hashes []string) error {
+	query, args, err := sqlx.In(sqlSelectUnusedBaseDeltas, hashes)
+	if err != nil {
+		return fmt.Errorf("could not construct deltas query: %w", err)
+	}
+	var deltas []string
+	err = tx.Select(&deltas, query, args...)
+	if err != nil {
+		return fmt.Errorf("could not get deltas: %w", err)
+	}
+	if len(deltas) == 0 {
+		return nil
+	}
+
+	// rebuild all of them before changing any
+	r := newCodeResolver(tx)
+	code := make([]string, len(deltas))
+	for i, hash := range deltas {
+		code[i], err = r.resolve(hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, hash := range deltas {
+		_, err = tx.Exec(sqlUpdateCodeBlobFull, code[i], hash)
+		if err != nil {
+			return fmt.Errorf("could not store code in full: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+func countRows(t *testing.T, db *sqlx.DB, query string) int {
+	t.Helper()
+	var n int
+	require.NoError(t, db.Get(&n, query))
+	return n
+}
+
+func TestCodeBlobs(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName,
+		"file:"+filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	s, err := NewEffects(db)
+	require.NoError(t, err)
+
+	id, err := s.Add(-1, -1, "user", "shared", Submitter{})
+	require.NoError(t, err)
+	fork, err := s.Add(id, 0, "user", "shared", Submitter{})
+	require.NoError(t, err)
+	_, err = s.AddVersion(fork, "changed", Submitter{})
+	require.NoError(t, err)
+
+	require.Equal(t, 2, countRows(t, db, "SELECT COUNT(*) FROM code_blobs"))
+	require.Equal(t, 0, countRows(t, db, "SELECT COUNT(*) FROM versions WHERE code != ''"))
+
+	e, err := s.Effect(fork)
+	require.NoError(t, err)
+	require.Equal(t, "shared", e.Versions[0].Code)
+	require.Equal(t, "changed", e.Versions[1].Code)
+
+	es, err := s.Page(0, 10, false)
+	require.NoError(t, err)
+	require.Len(t, es, 2)
+	for _, e := range es {
+		require.Equal(t, "shared", e.Versions[0].Code)
+	}
+
+	stats, err := s.CodeStats()
+	require.NoError(t, err)
+	require.Equal(t, CodeStats{
+		Versions: 3,
+		Blobs:    2,
+		Bytes:    int64(2*len("shared") + len("changed")),
+		Stored:   int64(len("shared") + len("changed")),
+	}, stats)
+	require.Equal(t, int64(len("shared")), stats.Saved())
+
+	// purging the fork keeps the code still used by the original
+	require.NoError(t, s.Delete(fork))
+	ids, err := s.Purge(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, []int{fork}, ids)
+	require.Equal(t, 1, countRows(t, db, "SELECT COUNT(*) FROM code_blobs"))
+	e, err = s.Effect(id)
+	require.NoError(t, err)
+	require.Equal(t, "shared", e.Versions[0].Code)
+
+	// replacing an effect removes the code of its old versions
+	e.Versions[0].Code = "replaced"
+	require.NoError(t, s.PutEffect(e))
+	require.Equal(t, 1, countRows(t, db, "SELECT COUNT(*) FROM code_blobs"))
+	e, err = s.Effect(id)
+	require.NoError(t, err)
+	require.Equal(t, "replaced", e.Versions[0].Code)
+}
+
+func TestCodeBlobsMigration(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName,
+		"file:"+filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	s, err := NewEffects(db)
+	require.NoError(t, err)
+
+	// versions stored before code blobs existed, one of them before code
+	// hashes existed
+	id, err := s.Add(-1, -1, "user", "old", Submitter{})
+	require.NoError(t, err)
+	db.MustExec("UPDATE versions SET code = 'old', code_hash = ''")
+	insert := "INSERT INTO versions (version, effect, created_at, code, code_hash) VALUES (?, ?, ?, ?, ?)"
+	db.MustExec(insert, 1, id, sqlTime(time.Now()), "old", CodeHash("old"))
+	db.MustExec(insert, 2, id, sqlTime(time.Now()), "new", CodeHash("new"))
+	db.MustExec("DELETE FROM code_blobs")
+
+	e, err := s.Effect(id)
+	require.NoError(t, err)
+	require.Equal(t, "old", e.Versions[0].Code)
+	require.Equal(t, "new", e.Versions[2].Code)
+
+	s, err = NewEffects(db)
+	require.NoError(t, err)
+
+	require.Equal(t, 2, countRows(t, db, "SELECT COUNT(*) FROM code_blobs"))
+	require.Equal(t, 0, countRows(t, db, "SELECT COUNT(*) FROM versions WHERE code != ''"))
+
+	e, err = s.Effect(id)
+	require.NoError(t, err)
+	require.Len(t, e.Versions, 3)
+	require.Equal(t, "old", e.Versions[0].Code)
+	require.Equal(t, "old", e.Versions[1].Code)
+	require.Equal(t, "new", e.Versions[2].Code)
+	require.Equal(t, CodeHash("old"), e.Versions[0].CodeHash)
+}
+
+func TestCodeDeltas(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName,
+		"file:"+filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	s, err := NewEffects(db)
+	require.NoError(t, err)
+	s.DeltaSnapshots = 3
+
+	codes := shaderVersions(6)
+	id, err := s.Add(-1, -1, "user", codes[0], Submitter{})
+	require.NoError(t, err)
+	for _, c := range codes[1:] {
+		_, err = s.AddVersion(id, c, Submitter{})
+		require.NoError(t, err)
+	}
+	forkCode := codes[3] + "\n// fork\n"
+	fork, err := s.Add(id, 3, "user", forkCode, Submitter{})
+	require.NoError(t, err)
+
+	// full, delta, delta, full, delta, delta, and the fork a delta
+	require.Equal(t, 7, countRows(t, db, "SELECT COUNT(*) FROM code_blobs"))
+	require.Equal(t, 5, countRows(t, db, "SELECT COUNT(*) FROM code_blobs WHERE base != ''"))
+	require.Equal(t, 2, countRows(t, db, "SELECT MAX(depth) FROM code_blobs"))
+
+	e, err := s.Effect(id)
+	require.NoError(t, err)
+	require.Len(t, e.Versions, len(codes))
+	for i, c := range codes {
+		require.Equal(t, c, e.Versions[i].Code)
+	}
+
+	for i, c := range codes {
+		e, err = s.EffectVersion(id, i)
+		require.NoError(t, err)
+		require.Len(t, e.Versions, 1)
+		require.Equal(t, c, e.Versions[0].Code)
+	}
+	_, err = s.EffectVersion(id, len(codes))
+	require.ErrorIs(t, err, ErrNotFound)
+
+	es, err := s.Page(0, 10, false)
+	require.NoError(t, err)
+	require.Len(t, es, 2)
+	require.Equal(t, forkCode, es[0].Versions[0].Code)
+
+	stats, err := s.CodeStats()
+	require.NoError(t, err)
+	require.Equal(t, int64(5), stats.Deltas)
+	require.Less(t, stats.Stored, stats.Bytes)
+
+	// the fork is stored in full when the code it is based on goes
+	require.NoError(t, s.Delete(id))
+	_, err = s.Purge(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 1, countRows(t, db, "SELECT COUNT(*) FROM code_blobs"))
+	require.Equal(t, 0, countRows(t, db, "SELECT COUNT(*) FROM code_blobs WHERE base != ''"))
+	e, err = s.Effect(fork)
+	require.NoError(t, err)
+	require.Equal(t, forkCode, e.Versions[0].Code)
+
+	require.NoError(t, s.Delete(fork))
+	_, err = s.Purge(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 0, countRows(t, db, "SELECT COUNT(*) FROM code_blobs"))
+}
+
+func TestCodeDeltasSharedBase(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName,
+		"file:"+filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	s, err := NewEffects(db)
+	require.NoError(t, err)
+	s.DeltaSnapshots = 10
+
+	codes := shaderVersions(3)
+	id, err := s.Add(-1, -1, "user", codes[0], Submitter{})
+	require.NoError(t, err)
+	_, err = s.AddVersion(id, codes[1], Submitter{})
+	require.NoError(t, err)
+
+	// another effect with the same code shares its delta
+	other, err := s.Add(-1, -1, "other", codes[1], Submitter{})
+	require.NoError(t, err)
+	_, err = s.AddVersion(other, codes[2], Submitter{})
+	require.NoError(t, err)
+
+	require.NoError(t, s.Delete(id))
+	_, err = s.Purge(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	hash := CodeHash(codes[0])
+	require.Equal(t, 0, countRows(t, db,
+		"SELECT COUNT(*) FROM code_blobs WHERE hash = '"+hash+"'"))
+	e, err := s.Effect(other)
+	require.NoError(t, err)
+	require.Equal(t, codes[1], e.Versions[0].Code)
+	require.Equal(t, codes[2], e.Versions[1].Code)
+}
@@ -0,0 +1,283 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// bsonMaxDocument is the largest document accepted. MongoDB documents are
+// limited to 16 MiB.
+const bsonMaxDocument = 16 << 20
+
+// bsonMaxDepth is the deepest nesting of documents and arrays accepted.
+// MongoDB limits it to 100.
+const bsonMaxDepth = 100
+
+// isBSON tells if the start of a dump is a BSON document. JSON text can not
+// start with bytes lower than tab so its first four bytes read as a
+// document size are always too big.
+func isBSON(r *bufio.Reader) bool {
+	b, err := r.Peek(5)
+	if err != nil {
+		return false
+	}
+
+	size := binary.LittleEndian.Uint32(b)
+	return size >= 5 && size <= bsonMaxDocument
+}
+
+// readBSON reads a whole BSON document including its size.
+func readBSON(r *bufio.Reader) ([]byte, error) {
+	var size [4]byte
+	_, err := io.ReadFull(r, size[:])
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated document")
+		}
+		return nil, err
+	}
+
+	n := binary.LittleEndian.Uint32(size[:])
+	if n < 5 || n > bsonMaxDocument {
+		return nil, fmt.Errorf("malformed document size %d", n)
+	}
+
+	doc := make([]byte, n)
+	copy(doc, size[:])
+	_, err = io.ReadFull(r, doc[4:])
+	if err != nil {
+		return nil, fmt.Errorf("truncated document: %w", err)
+	}
+
+	return doc, nil
+}
+
+// bsonToJSON converts a BSON document to Extended JSON so it can be read
+// like the lines of a JSON dump.
+func bsonToJSON(doc []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := writeBSONDocument(&buf, doc, false, 1)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeBSONDocument writes a document or array as JSON and returns the
+// number of bytes read. depth is the nesting level of the document.
+func writeBSONDocument(w *bytes.Buffer, doc []byte, array bool, depth int) (int, error) {
+	if depth > bsonMaxDepth {
+		return 0, fmt.Errorf("document nested deeper than %d levels", bsonMaxDepth)
+	}
+	if len(doc) < 5 {
+		return 0, fmt.Errorf("truncated document")
+	}
+	size := int(binary.LittleEndian.Uint32(doc))
+	if size < 5 || size > len(doc) || doc[size-1] != 0 {
+		return 0, fmt.Errorf("malformed document size %d", size)
+	}
+
+	open, end := byte('{'), byte('}')
+	if array {
+		open, end = '[', ']'
+	}
+
+	w.WriteByte(open)
+	p := 4
+	for i := 0; doc[p] != 0; i++ {
+		kind := doc[p]
+		p++
+
+		name := bytes.IndexByte(doc[p:size-1], 0)
+		if name < 0 {
+			return 0, fmt.Errorf("malformed element name")
+		}
+		key := string(doc[p : p+name])
+		p += name + 1
+
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		if !array {
+			writeJSONString(w, key)
+			w.WriteByte(':')
+		}
+
+		n, err := writeBSONValue(w, kind, doc[p:size-1], depth)
+		if err != nil {
+			return 0, fmt.Errorf("element %q: %w", key, err)
+		}
+		p += n
+		if p >= size {
+			return 0, fmt.Errorf("truncated document")
+		}
+	}
+	w.WriteByte(end)
+
+	return size, nil
+}
+
+// writeBSONValue writes an element value as JSON and returns the number of
+// bytes read. depth is the nesting level of the document it belongs to.
+func writeBSONValue(w *bytes.Buffer, kind byte, b []byte, depth int) (int, error) {
+	need := func(n int) error {
+		if len(b) < n {
+			return fmt.Errorf("truncated value")
+		}
+		return nil
+	}
+
+	switch kind {
+	case 0x01: // double
+		if err := need(8); err != nil {
+			return 0, err
+		}
+		f := math.Float64frombits(binary.LittleEndian.Uint64(b))
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			fmt.Fprintf(w, `{"$numberDouble":%q}`, strconv.FormatFloat(f, 'g', -1, 64))
+		} else {
+			w.WriteString(strconv.FormatFloat(f, 'f', -1, 64))
+		}
+		return 8, nil
+
+	case 0x02, 0x0D, 0x0E: // string, javascript, symbol
+		s, n, err := bsonString(b)
+		if err != nil {
+			return 0, err
+		}
+		if kind == 0x0D {
+			w.WriteString(`{"$code":`)
+			writeJSONString(w, s)
+			w.WriteByte('}')
+		} else {
+			writeJSONString(w, s)
+		}
+		return n, nil
+
+	case 0x03, 0x04: // document, array
+		return writeBSONDocument(w, b, kind == 0x04, depth+1)
+
+	case 0x05: // binary
+		if err := need(5); err != nil {
+			return 0, err
+		}
+		n := int(binary.LittleEndian.Uint32(b))
+		if n < 0 || len(b) < 5+n {
+			return 0, fmt.Errorf("truncated binary")
+		}
+		fmt.Fprintf(w, `{"$binary":{"base64":"%s","subType":"%02x"}}`,
+			base64.StdEncoding.EncodeToString(b[5:5+n]), b[4])
+		return 5 + n, nil
+
+	case 0x06, 0x0A: // undefined, null
+		w.WriteString("null")
+		return 0, nil
+
+	case 0x07: // object id
+		if err := need(12); err != nil {
+			return 0, err
+		}
+		fmt.Fprintf(w, `{"$oid":"%s"}`, hex.EncodeToString(b[:12]))
+		return 12, nil
+
+	case 0x08: // boolean
+		if err := need(1); err != nil {
+			return 0, err
+		}
+		if b[0] == 0 {
+			w.WriteString("false")
+		} else {
+			w.WriteString("true")
+		}
+		return 1, nil
+
+	case 0x09: // datetime
+		if err := need(8); err != nil {
+			return 0, err
+		}
+		fmt.Fprintf(w, `{"$date":%d}`, int64(binary.LittleEndian.Uint64(b)))
+		return 8, nil
+
+	case 0x0B: // regular expression
+		pattern, n, err := bsonCString(b)
+		if err != nil {
+			return 0, err
+		}
+		options, m, err := bsonCString(b[n:])
+		if err != nil {
+			return 0, err
+		}
+		w.WriteString(`{"$regularExpression":{"pattern":`)
+		writeJSONString(w, pattern)
+		w.WriteString(`,"options":`)
+		writeJSONString(w, options)
+		w.WriteString("}}")
+		return n + m, nil
+
+	case 0x10: // int32
+		if err := need(4); err != nil {
+			return 0, err
+		}
+		fmt.Fprintf(w, "%d", int32(binary.LittleEndian.Uint32(b)))
+		return 4, nil
+
+	case 0x11: // timestamp
+		if err := need(8); err != nil {
+			return 0, err
+		}
+		fmt.Fprintf(w, `{"$timestamp":{"t":%d,"i":%d}}`,
+			binary.LittleEndian.Uint32(b[4:]), binary.LittleEndian.Uint32(b))
+		return 8, nil
+
+	case 0x12: // int64
+		if err := need(8); err != nil {
+			return 0, err
+		}
+		fmt.Fprintf(w, "%d", int64(binary.LittleEndian.Uint64(b)))
+		return 8, nil
+
+	case 0x7F: // max key
+		w.WriteString(`{"$maxKey":1}`)
+		return 0, nil
+
+	case 0xFF: // min key
+		w.WriteString(`{"$minKey":1}`)
+		return 0, nil
+	}
+
+	return 0, fmt.Errorf("unsupported type 0x%02x", kind)
+}
+
+// bsonString reads a length prefixed string.
+func bsonString(b []byte) (string, int, error) {
+	if len(b) < 5 {
+		return "", 0, fmt.Errorf("truncated string")
+	}
+	n := int(binary.LittleEndian.Uint32(b))
+	if n < 1 || len(b) < 4+n || b[3+n] != 0 {
+		return "", 0, fmt.Errorf("malformed string")
+	}
+	return string(b[4 : 3+n]), 4 + n, nil
+}
+
+// bsonCString reads a zero terminated string.
+func bsonCString(b []byte) (string, int, error) {
+	n := bytes.IndexByte(b, 0)
+	if n < 0 {
+		return "", 0, fmt.Errorf("malformed string")
+	}
+	return string(b[:n]), n + 1, nil
+}
+
+func writeJSONString(w *bytes.Buffer, s string) {
+	b, _ := json.Marshal(s)
+	w.Write(b)
+}
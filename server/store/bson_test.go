@@ -0,0 +1,237 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+// bsonElement is a key and an encoded value used to build test documents.
+type bsonElement struct {
+	kind  byte
+	key   string
+	value []byte
+}
+
+func bsonDoc(elements ...bsonElement) []byte {
+	var body bytes.Buffer
+	for _, e := range elements {
+		body.WriteByte(e.kind)
+		body.WriteString(e.key)
+		body.WriteByte(0)
+		body.Write(e.value)
+	}
+	body.WriteByte(0)
+
+	doc := make([]byte, 4, 4+body.Len())
+	binary.LittleEndian.PutUint32(doc, uint32(4+body.Len()))
+	return append(doc, body.Bytes()...)
+}
+
+func bsonStr(key, s string) bsonElement {
+	v := make([]byte, 4, 5+len(s))
+	binary.LittleEndian.PutUint32(v, uint32(len(s)+1))
+	v = append(append(v, s...), 0)
+	return bsonElement{0x02, key, v}
+}
+
+func bsonInt32(key string, i int32) bsonElement {
+	v := make([]byte, 4)
+	binary.LittleEndian.PutUint32(v, uint32(i))
+	return bsonElement{0x10, key, v}
+}
+
+func bsonInt64(key string, i int64) bsonElement {
+	v := make([]byte, 8)
+	binary.LittleEndian.PutUint64(v, uint64(i))
+	return bsonElement{0x12, key, v}
+}
+
+func bsonDouble(key string, f float64) bsonElement {
+	v := make([]byte, 8)
+	binary.LittleEndian.PutUint64(v, math.Float64bits(f))
+	return bsonElement{0x01, key, v}
+}
+
+func bsonDate(key string, t time.Time) bsonElement {
+	v := make([]byte, 8)
+	binary.LittleEndian.PutUint64(v, uint64(t.UnixMilli()))
+	return bsonElement{0x09, key, v}
+}
+
+func bsonBool(key string, b bool) bsonElement {
+	if b {
+		return bsonElement{0x08, key, []byte{1}}
+	}
+	return bsonElement{0x08, key, []byte{0}}
+}
+
+func bsonSub(key string, array bool, doc []byte) bsonElement {
+	if array {
+		return bsonElement{0x04, key, doc}
+	}
+	return bsonElement{0x03, key, doc}
+}
+
+func TestBSONToJSON(t *testing.T) {
+	oid := bsonElement{0x07, "oid", []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}}
+	doc := bsonDoc(
+		bsonInt32("i", -5),
+		bsonInt64("l", 1<<40),
+		bsonDouble("d", 1.5),
+		bsonStr("s", "a \"quoted\"\nline"),
+		bsonBool("b", true),
+		bsonElement{0x0A, "n", nil},
+		oid,
+		bsonDate("t", time.UnixMilli(1374639571037)),
+		bsonSub("a", true, bsonDoc(bsonInt32("0", 1), bsonStr("1", "x"))),
+		bsonSub("o", false, bsonDoc(bsonBool("f", false))),
+	)
+
+	j, err := bsonToJSON(doc)
+	require.NoError(t, err)
+	require.Equal(t, `{"i":-5,"l":1099511627776,"d":1.5,`+
+		`"s":"a \"quoted\"\nline","b":true,"n":null,`+
+		`"oid":{"$oid":"000102030405060708090a0b"},`+
+		`"t":{"$date":1374639571037},"a":[1,"x"],"o":{"f":false}}`, string(j))
+
+	_, err = bsonToJSON(bsonDoc(bsonElement{0x13, "dec", make([]byte, 16)}))
+	require.Error(t, err)
+
+	// string length past the end of the document
+	truncated := bsonDoc(bsonStr("s", "value"))
+	binary.LittleEndian.PutUint32(truncated[7:], 100)
+	_, err = bsonToJSON(truncated)
+	require.Error(t, err)
+
+	// element name running into the end of the document
+	_, err = bsonToJSON([]byte("%\x00\x00\x00\t0000000000000000000000000000000\x00"))
+	require.Error(t, err)
+}
+
+func TestReadBSONMaxSize(t *testing.T) {
+	size := make([]byte, 5)
+	binary.LittleEndian.PutUint32(size, 16<<20+1)
+	_, err := readBSON(bufio.NewReader(bytes.NewReader(size)))
+	require.ErrorContains(t, err, "malformed document size")
+}
+
+func TestBSONMaxDepth(t *testing.T) {
+	nested := func(depth int) []byte {
+		doc := bsonDoc()
+		for i := 1; i < depth; i++ {
+			doc = bsonDoc(bsonSub("a", i%2 == 0, doc))
+		}
+		return doc
+	}
+
+	_, err := bsonToJSON(nested(bsonMaxDepth))
+	require.NoError(t, err)
+
+	_, err = bsonToJSON(nested(bsonMaxDepth + 1))
+	require.ErrorContains(t, err, "nested deeper")
+
+	_, err = bsonToJSON(nested(1000))
+	require.Error(t, err)
+}
+
+func bsonEffect(id int64, user string, created time.Time, codes ...string) []byte {
+	var versions []bsonElement
+	for i, c := range codes {
+		versions = append(versions, bsonSub(string(rune('0'+i)), false, bsonDoc(
+			bsonDate("created_at", created),
+			bsonStr("code", c),
+		)))
+	}
+
+	return bsonDoc(
+		bsonInt64("_id", id),
+		bsonDate("created_at", created),
+		bsonStr("image_url", "/thumbs/1.png"),
+		bsonDate("modified_at", created),
+		bsonDouble("parent", 0),
+		bsonInt32("parent_version", 0),
+		bsonStr("user", user),
+		bsonSub("versions", true, bsonDoc(versions...)),
+	)
+}
+
+func TestImportBSON(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName, testDatabase)
+	require.NoError(t, err)
+	s, err := NewEffects(db)
+	require.NoError(t, err)
+
+	created := time.Date(2013, time.July, 24, 4, 19, 31, 37000000, time.UTC)
+	var dump bytes.Buffer
+	dump.Write(bsonEffect(10140, "user", created, "first", "second"))
+	dump.Write(bsonDoc(
+		bsonInt64("_id", 10141),
+		bsonElement{0x13, "bad", make([]byte, 16)},
+	))
+	dump.Write(bsonEffect(10142, "other", created, "code"))
+
+	var lines []int
+	stats, err := ImportWith(&dump, s, ImportOptions{
+		Error: func(e ImportError) {
+			lines = append(lines, e.Line)
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, ImportStats{Line: 3, Imported: 2, Failed: 1}, stats)
+	require.Equal(t, []int{2}, lines)
+
+	e, err := s.Effect(10140)
+	require.NoError(t, err)
+	require.Equal(t, "user", e.User)
+	require.Equal(t, -1, e.Parent)
+	require.True(t, created.Equal(e.CreatedAt))
+	require.Len(t, e.Versions, 2)
+	require.Equal(t, "second", e.Versions[1].Code)
+	require.True(t, created.Equal(e.Versions[1].CreatedAt))
+
+	e, err = s.Effect(10142)
+	require.NoError(t, err)
+	require.Equal(t, "other", e.User)
+
+	_, err = ImportWith(bytes.NewReader(bsonEffect(1, "u", created, "c")[:20]), s, ImportOptions{})
+	require.Error(t, err)
+}
+
+func TestImportExtendedJSON(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName, testDatabase)
+	require.NoError(t, err)
+	s, err := NewEffects(db)
+	require.NoError(t, err)
+
+	dump := strings.Join([]string{
+		`{"_id":{"$numberInt":"1"},"created_at":{"$date":"2013-07-24T04:19:31.037Z"},` +
+			`"modified_at":{"$date":{"$numberLong":"1374639571037"}},` +
+			`"parent":{"$numberLong":"0"},"parent_version":{"$numberInt":"0"},"user":"relaxed",` +
+			`"versions":[{"created_at":{"$date":"2013-07-24T06:19:31.037+02:00"},"code":"code"}]}`,
+		`{"_id":{"$numberDouble":"2.5"},"user":"bad"}`,
+		`{"_id":3,"created_at":{"$date":"yesterday"},"user":"bad"}`,
+	}, "\n")
+
+	stats, err := ImportWith(strings.NewReader(dump), s, ImportOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.Imported)
+	require.Equal(t, 2, stats.Failed)
+
+	created := time.UnixMilli(1374639571037)
+	e, err := s.Effect(1)
+	require.NoError(t, err)
+	require.Equal(t, "relaxed", e.User)
+	require.True(t, created.Equal(e.CreatedAt))
+	require.True(t, created.Equal(e.ModifiedAt))
+	require.True(t, created.Equal(e.Versions[0].CreatedAt))
+	require.Equal(t, -1, e.Parent)
+}
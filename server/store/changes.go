@@ -0,0 +1,219 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type ChangeKind string
+
+const (
+	ChangeCreated  ChangeKind = "created"
+	ChangeVersion  ChangeKind = "version"
+	ChangeHidden   ChangeKind = "hidden"
+	ChangeUnhidden ChangeKind = "unhidden"
+	ChangeDeleted  ChangeKind = "deleted"
+	ChangeRestored ChangeKind = "restored"
+	ChangePurged   ChangeKind = "purged"
+	ChangeParent   ChangeKind = "parent"
+)
+
+func hideKind(hidden bool) ChangeKind {
+	if hidden {
+		return ChangeHidden
+	}
+	return ChangeUnhidden
+}
+
+// Change is an entry of the change sequence. Seq increases with every
+// change so readers can resume from the last one they saw. Version is -1
+// when the change affects the whole effect.
+type Change struct {
+	Seq       int        `db:"seq"`
+	Kind      ChangeKind `db:"kind"`
+	Effect    int        `db:"effect"`
+	Version   int        `db:"version"`
+	User      string     `db:"user"`
+	CreatedAt time.Time  `db:"created_at"`
+}
+
+const (
+	sqlCreateChanges = `
+CREATE TABLE IF NOT EXISTS changes (
+	seq INTEGER PRIMARY KEY AUTOINCREMENT,
+	kind TEXT,
+	effect INTEGER,
+	version INTEGER,
+	user TEXT,
+	created_at TIMESTAMP
+)
+`
+
+	sqlInsertChange = `
+INSERT INTO changes (
+	kind,
+	effect,
+	version,
+	user,
+	created_at
+) VALUES(
+	:kind,
+	:effect,
+	:version,
+	:user,
+	:created_at
+)
+`
+
+	sqlSelectChanges = `
+SELECT * FROM changes
+	WHERE seq > ?
+	ORDER BY seq
+	LIMIT ?
+`
+
+	sqlSelectChangesFeed = `
+SELECT
+	changes.seq,
+	changes.kind,
+	changes.effect,
+	changes.version,
+	CASE WHEN
+		effects.hidden = 0 AND
+		effects.deleted_at IS NULL AND
+		(changes.version < 0 OR versions.hidden = 0)
+	THEN changes.user ELSE '' END AS user,
+	changes.created_at
+	FROM changes
+	LEFT JOIN effects ON effects.id = changes.effect
+	LEFT JOIN versions ON versions.effect = changes.effect AND
+		versions.version = changes.version
+	WHERE changes.seq > ?
+	ORDER BY changes.seq
+	LIMIT ?
+`
+
+	sqlSelectChangesEnd = `
+SELECT COALESCE(MAX(seq), ?) FROM (
+	SELECT seq FROM changes
+		WHERE seq > ?
+		ORDER BY seq
+		LIMIT ?
+)
+`
+
+	sqlSelectChangesPublic = `
+SELECT changes.* FROM changes
+	LEFT JOIN effects ON effects.id = changes.effect
+	LEFT JOIN versions ON versions.effect = changes.effect AND
+		versions.version = changes.version
+	WHERE changes.seq > ? AND changes.seq <= ? AND (
+		changes.kind IN ('hidden', 'deleted', 'purged') OR (
+			changes.kind IN ('created', 'version') AND
+			effects.hidden = 0 AND
+			effects.deleted_at IS NULL AND
+			versions.hidden = 0
+		)
+	)
+	ORDER BY changes.seq
+`
+
+	sqlInsertChangesBackfill = `
+INSERT INTO changes (kind, effect, version, user, created_at)
+	SELECT 'created', id, 0, user, created_at FROM effects
+		WHERE deleted_at IS NULL AND
+			NOT EXISTS (SELECT 1 FROM changes WHERE changes.effect = effects.id)
+		ORDER BY id
+`
+
+	sqlSelectLastChange = `
+SELECT COALESCE(MAX(seq), 0) FROM changes
+`
+)
+
+// addChange records a change inside a transaction.
+func addChange(tx *sqlx.Tx, c Change) error {
+	if c.CreatedAt.IsZero() {
+		c.CreatedAt = time.Now()
+	}
+
+	_, err := tx.NamedExec(sqlInsertChange, c)
+	if err != nil {
+		return fmt.Errorf("could not insert change: %w", err)
+	}
+	return nil
+}
+
+// backfillChanges adds a change for each effect stored before the change
+// sequence existed so readers of the sequence can see all of them. It runs
+// once, and only effects without any change are added as some may have been
+// recorded before the backfill existed.
+func (s *Effects) backfillChanges() error {
+	return migrate(s.db, "changes_backfill", func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(sqlInsertChangesBackfill)
+		if err != nil {
+			return fmt.Errorf("could not backfill changes: %w", err)
+		}
+		return nil
+	})
+}
+
+// Changes returns up to limit changes with sequence number greater than
+// since, oldest first.
+func (s *Effects) Changes(since int, limit int) ([]Change, error) {
+	var list []Change
+	err := s.db.Select(&list, sqlSelectChanges, since, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not get changes: %w", err)
+	}
+	return list, nil
+}
+
+// FeedChanges returns up to limit changes with sequence number greater than
+// since, oldest first, like Changes. The user is left empty when the effect
+// or version is hidden, deleted or purged now.
+func (s *Effects) FeedChanges(since int, limit int) ([]Change, error) {
+	var list []Change
+	err := s.db.Select(&list, sqlSelectChangesFeed, since, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not get changes: %w", err)
+	}
+	return list, nil
+}
+
+// PublicChanges returns the effect creations and new versions among the
+// next limit changes after since that can be shown to the public, that is,
+// their effect and version are not hidden or deleted now. Hide, delete and
+// purge changes are also returned so readers can forget what they showed.
+// It also returns the sequence number of the last change read to continue
+// from it.
+func (s *Effects) PublicChanges(since int, limit int) ([]Change, int, error) {
+	var end int
+	err := s.db.Get(&end, sqlSelectChangesEnd, since, since, limit)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not get changes: %w", err)
+	}
+	if end == since {
+		return nil, since, nil
+	}
+
+	var list []Change
+	err = s.db.Select(&list, sqlSelectChangesPublic, since, end)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not get public changes: %w", err)
+	}
+	return list, end, nil
+}
+
+// LastChange returns the sequence number of the latest change or 0 if there
+// are none.
+func (s *Effects) LastChange() (int, error) {
+	var seq int
+	err := s.db.Get(&seq, sqlSelectLastChange)
+	if err != nil {
+		return 0, fmt.Errorf("could not get last change: %w", err)
+	}
+	return seq, nil
+}
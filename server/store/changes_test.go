@@ -0,0 +1,146 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+func TestChanges(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName, testDatabase)
+	require.NoError(t, err)
+
+	s, err := NewEffects(db)
+	require.NoError(t, err)
+
+	seq, err := s.LastChange()
+	require.NoError(t, err)
+	require.Zero(t, seq)
+
+	id, err := s.Add(-1, -1, "user", "first", Submitter{})
+	require.NoError(t, err)
+	_, err = s.AddVersion(id, "second", Submitter{})
+	require.NoError(t, err)
+	other, err := s.Add(id, 1, "other", "fork", Submitter{})
+	require.NoError(t, err)
+
+	_, err = s.AddVersion(other+1, "missing", Submitter{})
+	require.Error(t, err)
+
+	changes, err := s.Changes(0, 10)
+	require.NoError(t, err)
+	require.Len(t, changes, 3)
+
+	require.Equal(t, 1, changes[0].Seq)
+	require.Equal(t, ChangeKind(ChangeCreated), changes[0].Kind)
+	require.Equal(t, id, changes[0].Effect)
+	require.Equal(t, 0, changes[0].Version)
+	require.Equal(t, "user", changes[0].User)
+	require.False(t, changes[0].CreatedAt.IsZero())
+
+	require.Equal(t, ChangeKind(ChangeVersion), changes[1].Kind)
+	require.Equal(t, id, changes[1].Effect)
+	require.Equal(t, 1, changes[1].Version)
+	require.Equal(t, "user", changes[1].User)
+
+	require.Equal(t, other, changes[2].Effect)
+	require.Equal(t, "other", changes[2].User)
+
+	changes, err = s.Changes(1, 1)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	require.Equal(t, 2, changes[0].Seq)
+
+	seq, err = s.LastChange()
+	require.NoError(t, err)
+	require.Equal(t, 3, seq)
+
+	changes, err = s.Changes(seq, 10)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+
+	kinds := func() []string {
+		changes, err := s.Changes(seq, 100)
+		require.NoError(t, err)
+		var list []string
+		for _, c := range changes {
+			list = append(list, fmt.Sprintf("%s %d %d", c.Kind, c.Effect, c.Version))
+			seq = c.Seq
+		}
+		return list
+	}
+
+	require.NoError(t, s.Hide(id, true))
+	require.NoError(t, s.Hide(id, true))
+	require.NoError(t, s.Hide(id, false))
+	require.NoError(t, s.HideVersion(id, 1, true))
+	require.NoError(t, s.HideVersion(id, 1, true))
+	require.Equal(t, ErrNotFound, s.Hide(other+1, true))
+	require.Equal(t, ErrNotFound, s.HideVersion(id, 5, true))
+	require.Equal(t, []string{
+		fmt.Sprintf("hidden %d -1", id),
+		fmt.Sprintf("unhidden %d -1", id),
+		fmt.Sprintf("hidden %d 1", id),
+	}, kinds())
+
+	n, err := s.HideUser("other", true)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	n, err = s.HideUser("other", true)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.Equal(t, []string{fmt.Sprintf("hidden %d -1", other)}, kinds())
+
+	require.NoError(t, s.Delete(id))
+	require.NoError(t, s.Restore(id))
+	require.NoError(t, s.Delete(id))
+	_, err = s.Purge(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		fmt.Sprintf("deleted %d -1", id),
+		fmt.Sprintf("restored %d -1", id),
+		fmt.Sprintf("deleted %d -1", id),
+		fmt.Sprintf("purged %d -1", id),
+	}, kinds())
+}
+
+func TestChangesBackfill(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName, testDatabase)
+	require.NoError(t, err)
+
+	s, err := NewEffects(db)
+	require.NoError(t, err)
+
+	for _, e := range testEffects {
+		require.NoError(t, s.AddEffect(e))
+	}
+	// a database that recorded changes before the backfill existed
+	last := testEffects[len(testEffects)-1].ID
+	_, err = db.Exec("DELETE FROM changes WHERE effect != ?", last)
+	require.NoError(t, err)
+	_, err = db.Exec("DELETE FROM migrations")
+	require.NoError(t, err)
+
+	s, err = NewEffects(db)
+	require.NoError(t, err)
+
+	changes, err := s.Changes(0, 100)
+	require.NoError(t, err)
+	require.Len(t, changes, len(testEffects))
+	require.Equal(t, last, changes[0].Effect)
+	for i, c := range changes[1:] {
+		require.Equal(t, ChangeCreated, c.Kind)
+		require.Equal(t, testEffects[i].ID, c.Effect)
+		require.Equal(t, testEffects[i].User, c.User)
+	}
+
+	_, err = NewEffects(db)
+	require.NoError(t, err)
+	seq, err := s.LastChange()
+	require.NoError(t, err)
+	require.Equal(t, changes[len(changes)-1].Seq, seq)
+}
@@ -0,0 +1,331 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mrdoob/glsl-sandbox/server/thumb"
+)
+
+const (
+	sqlSelectTables = `
+SELECT name FROM sqlite_master
+	WHERE type = 'table' AND name NOT LIKE 'sqlite_%'
+	ORDER BY name
+`
+
+	sqlSelectOrphanVersions = `
+SELECT DISTINCT effect FROM versions
+	WHERE NOT EXISTS (SELECT 1 FROM effects WHERE effects.id = versions.effect)
+	ORDER BY effect
+`
+
+	sqlSelectEmptyEffects = `
+SELECT id FROM effects
+	WHERE NOT EXISTS (SELECT 1 FROM versions WHERE versions.effect = effects.id)
+	ORDER BY id
+`
+
+	sqlSelectEffectIDs = `
+SELECT id FROM effects ORDER BY id
+`
+
+	sqlDeleteOrphanVersions = `
+DELETE FROM versions
+	WHERE NOT EXISTS (SELECT 1 FROM effects WHERE effects.id = versions.effect)
+`
+)
+
+// TableStats holds the size of a table. Bytes is the approximate size of
+// the data stored in it, without indexes or free space.
+type TableStats struct {
+	Name  string
+	Rows  int64
+	Bytes int64
+}
+
+// DatabaseStats holds the size of the database file and its tables. Free is
+// the space in unused pages that a vacuum gives back.
+type DatabaseStats struct {
+	Size   int64
+	Free   int64
+	Tables []TableStats
+}
+
+// IntegrityCheck runs the SQLite integrity check and returns the problems
+// found. The list is empty when the database is fine.
+func IntegrityCheck(db *sqlx.DB) ([]string, error) {
+	var res []string
+	err := db.Select(&res, "PRAGMA integrity_check")
+	if err != nil {
+		return nil, fmt.Errorf("could not check database: %w", err)
+	}
+
+	if len(res) == 1 && res[0] == "ok" {
+		return nil, nil
+	}
+	return res, nil
+}
+
+// Vacuum rebuilds the database file releasing unused space.
+func Vacuum(db *sqlx.DB) error {
+	_, err := db.Exec("VACUUM")
+	if err != nil {
+		return fmt.Errorf("could not vacuum database: %w", err)
+	}
+	return nil
+}
+
+// Reindex rebuilds all the indexes.
+func Reindex(db *sqlx.DB) error {
+	_, err := db.Exec("REINDEX")
+	if err != nil {
+		return fmt.Errorf("could not reindex database: %w", err)
+	}
+	return nil
+}
+
+// Stats returns the size of the database and the rows and data size of
+// each table.
+func Stats(db *sqlx.DB) (DatabaseStats, error) {
+	var pageSize, pages, free int64
+	for _, p := range []struct {
+		pragma string
+		value  *int64
+	}{
+		{"page_size", &pageSize},
+		{"page_count", &pages},
+		{"freelist_count", &free},
+	} {
+		err := db.Get(p.value, "PRAGMA "+p.pragma)
+		if err != nil {
+			return DatabaseStats{}, fmt.Errorf("could not get %s: %w", p.pragma, err)
+		}
+	}
+
+	stats := DatabaseStats{
+		Size: pages * pageSize,
+		Free: free * pageSize,
+	}
+
+	var tables []string
+	err := db.Select(&tables, sqlSelectTables)
+	if err != nil {
+		return DatabaseStats{}, fmt.Errorf("could not get tables: %w", err)
+	}
+
+	for _, t := range tables {
+		ts, err := tableStats(db, t)
+		if err != nil {
+			return DatabaseStats{}, err
+		}
+		stats.Tables = append(stats.Tables, ts)
+	}
+
+	return stats, nil
+}
+
+// tableStats counts the rows of a table and adds up the length of all its
+// values.
+func tableStats(db *sqlx.DB, table string) (TableStats, error) {
+	var columns []struct {
+		Name string `db:"name"`
+	}
+	err := db.Select(&columns, "SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return TableStats{}, fmt.Errorf("could not get %s columns: %w", table, err)
+	}
+
+	lengths := make([]string, len(columns))
+	for i, c := range columns {
+		lengths[i] = fmt.Sprintf("IFNULL(LENGTH(CAST(%s AS BLOB)), 0)", quoteName(c.Name))
+	}
+	if len(lengths) == 0 {
+		lengths = []string{"0"}
+	}
+
+	ts := TableStats{Name: table}
+	query := fmt.Sprintf("SELECT COUNT(*), IFNULL(SUM(%s), 0) FROM %s",
+		strings.Join(lengths, " + "), quoteName(table))
+	err = db.QueryRowx(query).Scan(&ts.Rows, &ts.Bytes)
+	if err != nil {
+		return TableStats{}, fmt.Errorf("could not get %s size: %w", table, err)
+	}
+
+	return ts, nil
+}
+
+func quoteName(n string) string {
+	return `"` + strings.ReplaceAll(n, `"`, `""`) + `"`
+}
+
+// Orphans holds the inconsistencies between effects, versions and
+// thumbnails.
+type Orphans struct {
+	// Versions has the effect IDs referenced by versions that do not exist.
+	Versions []int
+	// Empty has the effects without versions.
+	Empty []int
+	// Thumbs has the thumbnails that do not belong to any effect.
+	Thumbs []string
+	// Unknown has the files in the thumbnails directory that are not named
+	// like a thumbnail. They are only reported.
+	Unknown []string
+	// MissingThumbs has the effects without thumbnail.
+	MissingThumbs []int
+}
+
+// Found tells if there is any inconsistency.
+func (o Orphans) Found() bool {
+	return len(o.Versions) > 0 ||
+		len(o.Empty) > 0 ||
+		len(o.Thumbs) > 0 ||
+		len(o.Unknown) > 0 ||
+		len(o.MissingThumbs) > 0
+}
+
+// Orphans finds versions without effect, effects without versions and
+// thumbnails without effect or the other way round.
+func (s *Effects) Orphans(thumbs *thumb.Thumbs) (Orphans, error) {
+	var o Orphans
+	err := s.transaction(func(tx *sqlx.Tx) error {
+		var err error
+		o, err = orphans(tx, thumbs)
+		return err
+	})
+	return o, err
+}
+
+// FixOrphans removes the versions without effect, the effects without
+// versions and the thumbnails without effect, and returns what was found.
+// Missing thumbnails can not be recreated and unknown files may not be ours
+// so they are only reported.
+func (s *Effects) FixOrphans(thumbs *thumb.Thumbs) (Orphans, error) {
+	var o Orphans
+	err := s.transaction(func(tx *sqlx.Tx) error {
+		var err error
+		o, err = orphans(tx, thumbs)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(sqlDeleteOrphanVersions)
+		if err != nil {
+			return fmt.Errorf("could not delete orphaned versions: %w", err)
+		}
+
+		err = deleteAllUnusedCode(tx)
+		if err != nil {
+			return err
+		}
+
+		if len(o.Empty) == 0 {
+			return nil
+		}
+
+		query, args, err := sqlx.In(sqlDeleteEffects, o.Empty)
+		if err != nil {
+			return fmt.Errorf("could not construct delete query: %w", err)
+		}
+		_, err = tx.Exec(query, args...)
+		if err != nil {
+			return fmt.Errorf("could not delete empty effects: %w", err)
+		}
+
+		for _, id := range o.Empty {
+			err = addChange(tx, Change{
+				Kind:    ChangePurged,
+				Effect:  id,
+				Version: -1,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return Orphans{}, err
+	}
+
+	// thumbnails of the removed effects are orphans now
+	for _, id := range o.Empty {
+		err = thumbs.Remove(Effect{ID: id}.ImageName())
+		if err != nil {
+			return o, err
+		}
+	}
+	for _, name := range o.Thumbs {
+		err = thumbs.Remove(name)
+		if err != nil {
+			return o, err
+		}
+	}
+
+	return o, nil
+}
+
+func orphans(tx *sqlx.Tx, thumbs *thumb.Thumbs) (Orphans, error) {
+	// Thumbnails are written after their effect is stored. Reading them
+	// before the first query of the transaction makes sure the effect of
+	// every file listed is visible so new thumbnails are not taken as
+	// orphans.
+	entries, err := os.ReadDir(thumbs.Path())
+	if err != nil {
+		return Orphans{}, fmt.Errorf("could not read thumbnails: %w", err)
+	}
+
+	var o Orphans
+	err = tx.Select(&o.Versions, sqlSelectOrphanVersions)
+	if err != nil {
+		return Orphans{}, fmt.Errorf("could not get orphaned versions: %w", err)
+	}
+
+	err = tx.Select(&o.Empty, sqlSelectEmptyEffects)
+	if err != nil {
+		return Orphans{}, fmt.Errorf("could not get empty effects: %w", err)
+	}
+
+	var ids []int
+	err = tx.Select(&ids, sqlSelectEffectIDs)
+	if err != nil {
+		return Orphans{}, fmt.Errorf("could not get effects: %w", err)
+	}
+
+	found := make(map[int]bool)
+	effects := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		effects[id] = true
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() {
+			continue
+		}
+
+		// only files named exactly like the thumbnail of an effect are
+		// removed, anything else could belong to someone else
+		id, err := strconv.Atoi(strings.TrimSuffix(name, ".png"))
+		if err != nil || (Effect{ID: id}).ImageName() != name {
+			o.Unknown = append(o.Unknown, name)
+			continue
+		}
+		if !effects[id] {
+			o.Thumbs = append(o.Thumbs, name)
+			continue
+		}
+		found[id] = true
+	}
+
+	for _, id := range ids {
+		if !found[id] {
+			o.MissingThumbs = append(o.MissingThumbs, id)
+		}
+	}
+
+	return o, nil
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mrdoob/glsl-sandbox/server/thumb"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+func TestCheck(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName, testDatabase)
+	require.NoError(t, err)
+	s, err := NewEffects(db)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	thumbs, err := thumb.NewThumbs(dir)
+	require.NoError(t, err)
+
+	problems, err := IntegrityCheck(db)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+
+	first, err := s.Add(-1, -1, "user", "first", Submitter{})
+	require.NoError(t, err)
+	second, err := s.Add(-1, -1, "user", "second", Submitter{})
+	require.NoError(t, err)
+	require.NoError(t, thumbs.Save(Effect{ID: first}.ImageName(), []byte("png")))
+
+	// versions of an effect that does not exist
+	db.MustExec("INSERT INTO versions (version, effect, code) VALUES (0, 100, 'x')")
+	// effect without versions
+	db.MustExec("DELETE FROM versions WHERE effect = ?", first)
+	require.NoError(t, thumbs.Save("200.png", []byte("png")))
+	require.NoError(t, thumbs.Save("other.png", []byte("png")))
+	require.NoError(t, thumbs.Save("notes.txt", []byte("txt")))
+
+	o, err := s.Orphans(thumbs)
+	require.NoError(t, err)
+	require.True(t, o.Found())
+	require.Equal(t, []int{100}, o.Versions)
+	require.Equal(t, []int{first}, o.Empty)
+	require.Equal(t, []string{"200.png"}, o.Thumbs)
+	require.Equal(t, []string{"notes.txt", "other.png"}, o.Unknown)
+	require.Equal(t, []int{second}, o.MissingThumbs)
+
+	stats, err := Stats(db)
+	require.NoError(t, err)
+	require.Positive(t, stats.Size)
+	for _, ts := range stats.Tables {
+		if ts.Name == "versions" {
+			require.Equal(t, int64(2), ts.Rows)
+			require.Positive(t, ts.Bytes)
+		}
+	}
+
+	fixed, err := s.FixOrphans(thumbs)
+	require.NoError(t, err)
+	require.Equal(t, o, fixed)
+
+	o, err = s.Orphans(thumbs)
+	require.NoError(t, err)
+	require.Equal(t, Orphans{
+		Unknown:       []string{"notes.txt", "other.png"},
+		MissingThumbs: []int{second},
+	}, o)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "notes.txt", entries[0].Name())
+	require.Equal(t, "other.png", entries[1].Name())
+	_, err = os.Stat(filepath.Join(dir, Effect{ID: first}.ImageName()))
+	require.True(t, os.IsNotExist(err))
+
+	changes, err := s.Changes(0, 10)
+	require.NoError(t, err)
+	last := changes[len(changes)-1]
+	require.Equal(t, ChangePurged, last.Kind)
+	require.Equal(t, first, last.Effect)
+
+	require.NoError(t, Reindex(db))
+	require.NoError(t, Vacuum(db))
+}
@@ -0,0 +1,148 @@
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+)
+
+// Deltas describe the code of a version as copies of ranges of the code it
+// is based on and literal inserts. They are stored compressed with flate.
+const (
+	deltaBlock = 16
+
+	deltaInsert byte = 0
+	deltaCopy   byte = 1
+)
+
+var errMalformedDelta = errors.New("malformed delta")
+
+// makeDelta returns the compressed delta that rebuilds target from base.
+func makeDelta(base, target []byte) ([]byte, error) {
+	index := make(map[uint32]int)
+	for i := 0; i+deltaBlock <= len(base); i += deltaBlock {
+		h := blockHash(base[i : i+deltaBlock])
+		if _, ok := index[h]; !ok {
+			index[h] = i
+		}
+	}
+
+	var ops []byte
+	ops = binary.AppendUvarint(ops, uint64(len(target)))
+
+	insertStart := 0
+	i := 0
+	for i+deltaBlock <= len(target) {
+		offset, ok := index[blockHash(target[i:i+deltaBlock])]
+		if !ok || !bytes.Equal(base[offset:offset+deltaBlock], target[i:i+deltaBlock]) {
+			i++
+			continue
+		}
+
+		// extend the match backwards over the pending insert and forwards
+		// as far as both agree
+		for offset > 0 && i > insertStart && base[offset-1] == target[i-1] {
+			offset--
+			i--
+		}
+		n := deltaBlock
+		for offset+n < len(base) && i+n < len(target) && base[offset+n] == target[i+n] {
+			n++
+		}
+
+		ops = appendInsert(ops, target[insertStart:i])
+		ops = append(ops, deltaCopy)
+		ops = binary.AppendUvarint(ops, uint64(offset))
+		ops = binary.AppendUvarint(ops, uint64(n))
+
+		i += n
+		insertStart = i
+	}
+	ops = appendInsert(ops, target[insertStart:])
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, fmt.Errorf("could not create compressor: %w", err)
+	}
+	_, err = w.Write(ops)
+	if err != nil {
+		return nil, fmt.Errorf("could not compress delta: %w", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not compress delta: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// applyDelta rebuilds the code described by a compressed delta.
+func applyDelta(base, delta []byte) ([]byte, error) {
+	ops, err := io.ReadAll(flate.NewReader(bytes.NewReader(delta)))
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress delta: %w", err)
+	}
+
+	size, n := binary.Uvarint(ops)
+	if n <= 0 {
+		return nil, errMalformedDelta
+	}
+	ops = ops[n:]
+
+	target := make([]byte, 0, size)
+	for len(ops) > 0 {
+		op := ops[0]
+		ops = ops[1:]
+
+		switch op {
+		case deltaInsert:
+			l, n := binary.Uvarint(ops)
+			if n <= 0 || l > uint64(len(ops)-n) {
+				return nil, errMalformedDelta
+			}
+			target = append(target, ops[n:n+int(l)]...)
+			ops = ops[n+int(l):]
+
+		case deltaCopy:
+			offset, n := binary.Uvarint(ops)
+			if n <= 0 {
+				return nil, errMalformedDelta
+			}
+			ops = ops[n:]
+			l, n := binary.Uvarint(ops)
+			if n <= 0 || offset > uint64(len(base)) || l > uint64(len(base))-offset {
+				return nil, errMalformedDelta
+			}
+			ops = ops[n:]
+			target = append(target, base[offset:offset+l]...)
+
+		default:
+			return nil, errMalformedDelta
+		}
+	}
+
+	if uint64(len(target)) != size {
+		return nil, errMalformedDelta
+	}
+	return target, nil
+}
+
+func appendInsert(ops []byte, data []byte) []byte {
+	if len(data) == 0 {
+		return ops
+	}
+	ops = append(ops, deltaInsert)
+	ops = binary.AppendUvarint(ops, uint64(len(data)))
+	return append(ops, data...)
+}
+
+func blockHash(b []byte) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write(b)
+	return h.Sum32()
+}
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+// shaderVersions returns the code of n versions of a shader where each
+// version changes a few lines of the previous one.
+func shaderVersions(n int) []string {
+	lines := []string{
+		"#ifdef GL_ES",
+		"precision mediump float;",
+		"#endif",
+		"",
+		"uniform float time;",
+		"uniform vec2 mouse;",
+		"uniform vec2 resolution;",
+		"",
+	}
+	for i := 0; i < 40; i++ {
+		lines = append(lines, fmt.Sprintf(
+			"float f%d(vec2 p) { return sin(p.x * %d.0 + time) * cos(p.y * %d.0); }",
+			i, i, i+1))
+	}
+	lines = append(lines,
+		"void main(void) {",
+		"\tvec2 p = gl_FragCoord.xy / resolution.xy;",
+		"\tgl_FragColor = vec4(f0(p), f1(p), f2(p), 1.0);",
+		"}",
+	)
+
+	versions := make([]string, n)
+	for v := 0; v < n; v++ {
+		l := 8 + (v*7)%40
+		lines[l] = fmt.Sprintf("float f%d(vec2 p) { return %d.0 * p.x; }", l-8, v)
+		versions[v] = strings.Join(lines, "\n")
+	}
+	return versions
+}
+
+func TestDelta(t *testing.T) {
+	codes := shaderVersions(2)
+	tests := []struct {
+		name   string
+		base   string
+		target string
+	}{
+		{name: "empty"},
+		{name: "no base", target: codes[0]},
+		{name: "same", base: codes[0], target: codes[0]},
+		{name: "changed", base: codes[0], target: codes[1]},
+		{name: "prefix", base: codes[0], target: "// new\n" + codes[0]},
+		{name: "removed", base: codes[0], target: codes[0][100:]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delta, err := makeDelta([]byte(test.base), []byte(test.target))
+			require.NoError(t, err)
+			code, err := applyDelta([]byte(test.base), delta)
+			require.NoError(t, err)
+			require.Equal(t, test.target, string(code))
+		})
+	}
+
+	delta, err := makeDelta([]byte(codes[0]), []byte(codes[1]))
+	require.NoError(t, err)
+	require.Less(t, len(delta), len(codes[1])/10)
+
+	_, err = applyDelta([]byte(codes[0][:100]), delta)
+	require.Error(t, err)
+	_, err = applyDelta([]byte(codes[0]), []byte("bad"))
+	require.Error(t, err)
+}
+
+// benchmarkStorage stores an effect with many versions using the snapshot
+// interval. It returns the bytes stored per version.
+func benchmarkStorage(b *testing.B, snapshots int) (*Effects, int, int, float64) {
+	b.Helper()
+	db, err := sqlx.Connect(sqliteshim.ShimName,
+		"file:"+filepath.Join(b.TempDir(), "bench.db"))
+	require.NoError(b, err)
+	b.Cleanup(func() { db.Close() })
+	s, err := NewEffects(db)
+	require.NoError(b, err)
+	s.DeltaSnapshots = snapshots
+
+	codes := shaderVersions(100)
+	id, err := s.Add(-1, -1, "user", codes[0], Submitter{})
+	require.NoError(b, err)
+	for _, c := range codes[1:] {
+		_, err = s.AddVersion(id, c, Submitter{})
+		require.NoError(b, err)
+	}
+
+	stats, err := s.CodeStats()
+	require.NoError(b, err)
+	return s, id, len(codes), float64(stats.Stored) / float64(stats.Versions)
+}
+
+func BenchmarkEffect(b *testing.B) {
+	for _, snapshots := range []int{0, 8, 32, 128} {
+		b.Run(fmt.Sprintf("snapshots=%d", snapshots), func(b *testing.B) {
+			s, id, _, stored := benchmarkStorage(b, snapshots)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := s.Effect(id)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(stored, "stored-B/version")
+		})
+	}
+}
+
+func BenchmarkEffectVersion(b *testing.B) {
+	for _, snapshots := range []int{0, 8, 32, 128} {
+		b.Run(fmt.Sprintf("snapshots=%d", snapshots), func(b *testing.B) {
+			s, id, versions, stored := benchmarkStorage(b, snapshots)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := s.EffectVersion(id, i%versions)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(stored, "stored-B/version")
+		})
+	}
+}
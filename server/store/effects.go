@@ -1,8 +1,13 @@
 package store
 
 import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -16,33 +21,93 @@ type Effect struct {
 	ParentVersion int
 	User          string
 	Hidden        bool
-	Versions      []Version
+	DeletedAt     time.Time
+	// Locked effects do not accept new versions but can still be forked.
+	Locked bool
+	// Review tells if the effect is waiting for a moderator to check it.
+	Review   bool
+	Versions []Version
 }
 
 func (e Effect) ImageName() string {
 	return fmt.Sprintf("%d.png", e.ID)
 }
 
+// Deleted tells if the effect is in the trash. DeletedAt holds the time it
+// was moved there.
+func (e Effect) Deleted() bool {
+	return !e.DeletedAt.IsZero()
+}
+
+// LastVisibleVersion returns the number of the latest version that is not
+// hidden or -1 if all of them are.
+func (e Effect) LastVisibleVersion() int {
+	for i := len(e.Versions) - 1; i >= 0; i-- {
+		if !e.Versions[i].Hidden {
+			return i
+		}
+	}
+	return -1
+}
+
 type Version struct {
 	CreatedAt time.Time
 	Code      string
+	// CodeHash is the hex encoded SHA-256 of Code.
+	CodeHash  string
+	Submitter Submitter
+	// Hidden tells if the version has been moderated.
+	Hidden bool
+	// SpamScore is how likely the version is spam, higher is worse.
+	SpamScore int
+	// SpamReasons lists why the version got its spam score.
+	SpamReasons []string
+}
+
+// CodeHash returns the hash used to identify version code.
+func CodeHash(code string) string {
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
+
+// Submitter holds salted hashes identifying who submitted a version. They
+// are only meant to be shown to moderators and are erased after the
+// retention period.
+type Submitter struct {
+	IP          string
+	UserAgent   string
+	Fingerprint string
 }
 
 type sqliteEffect struct {
-	ID            int       `db:"id"`
-	CreatedAt     time.Time `db:"created_at"`
-	ModifiedAt    time.Time `db:"modified_at"`
-	Parent        int       `db:"parent"`
-	ParentVersion int       `db:"parent_version"`
-	User          string    `db:"user"`
-	Hidden        bool      `db:"hidden"`
+	ID            int          `db:"id"`
+	CreatedAt     time.Time    `db:"created_at"`
+	ModifiedAt    time.Time    `db:"modified_at"`
+	Parent        int          `db:"parent"`
+	ParentVersion int          `db:"parent_version"`
+	User          string       `db:"user"`
+	Hidden        bool         `db:"hidden"`
+	DeletedAt     sql.NullTime `db:"deleted_at"`
+	Locked        bool         `db:"locked"`
+	Review        bool         `db:"review"`
 }
 
 type sqliteVersion struct {
-	Version   int       `db:"version"`
-	Effect    int       `db:"effect"`
-	CreatedAt time.Time `db:"created_at"`
-	Code      string    `db:"code"`
+	Version     int       `db:"version"`
+	Effect      int       `db:"effect"`
+	CreatedAt   time.Time `db:"created_at"`
+	Code        string    `db:"code"`
+	CodeHash    string    `db:"code_hash"`
+	IPHash      string    `db:"ip_hash"`
+	AgentHash   string    `db:"agent_hash"`
+	Fingerprint string    `db:"fingerprint"`
+	Hidden      bool      `db:"hidden"`
+	SpamScore   int       `db:"spam_score"`
+	SpamReasons string    `db:"spam_reasons"`
+	// CodeBase and CodeDelta are only read and are set when the code is
+	// stored as a delta.
+	CodeBase  string `db:"code_base"`
+	CodeDelta []byte `db:"code_delta"`
 }
 
 const (
@@ -54,12 +119,27 @@ CREATE TABLE IF NOT EXISTS effects (
 	parent INTEGER,
 	parent_version INTEGER,
 	user TEXT,
-	hidden INTEGER
+	hidden INTEGER,
+	deleted_at TIMESTAMP,
+	locked INTEGER NOT NULL DEFAULT 0,
+	review INTEGER NOT NULL DEFAULT 0
 )
 `
 
 	sqlIndexEffectsModified = `
 CREATE INDEX IF NOT EXISTS idx_effects_modified ON effects (modified_at)
+`
+
+	sqlIndexEffectsParent = `
+CREATE INDEX IF NOT EXISTS idx_effects_parent ON effects (parent)
+`
+
+	sqlIndexEffectsUser = `
+CREATE INDEX IF NOT EXISTS idx_effects_user ON effects (user)
+`
+
+	sqlIndexEffectsDeleted = `
+CREATE INDEX IF NOT EXISTS idx_effects_deleted ON effects (deleted_at)
 `
 
 	sqlCreateVersions = `
@@ -67,8 +147,19 @@ CREATE TABLE IF NOT EXISTS versions (
 	version STRING,
 	effect INTEGER,
 	created_at TIMESTAMP,
-	code TEXT
+	code TEXT,
+	ip_hash TEXT NOT NULL DEFAULT '',
+	agent_hash TEXT NOT NULL DEFAULT '',
+	fingerprint TEXT NOT NULL DEFAULT '',
+	code_hash TEXT NOT NULL DEFAULT '',
+	hidden INTEGER NOT NULL DEFAULT 0,
+	spam_score INTEGER NOT NULL DEFAULT 0,
+	spam_reasons TEXT NOT NULL DEFAULT ''
 )
+`
+
+	sqlIndexEffectsReview = `
+CREATE INDEX IF NOT EXISTS idx_effects_review ON effects (review)
 `
 
 	sqlIndexVersionEffect = `
@@ -77,11 +168,41 @@ CREATE INDEX IF NOT EXISTS idx_versions_parent ON versions (effect)
 
 	sqlIndexVersionID = `
 CREATE INDEX IF NOT EXISTS idx_versions_id ON versions (effect, version)
+`
+
+	sqlIndexVersionIPHash = `
+CREATE INDEX IF NOT EXISTS idx_versions_ip_hash ON versions (ip_hash)
+`
+
+	sqlIndexVersionFingerprint = `
+CREATE INDEX IF NOT EXISTS idx_versions_fingerprint ON versions (fingerprint)
+`
+
+	sqlIndexVersionCodeHash = `
+CREATE INDEX IF NOT EXISTS idx_versions_code_hash ON versions (code_hash)
+`
+
+	sqlSelectVersionsNoHash = `
+SELECT rowid, code FROM versions
+	WHERE code_hash = ''
+	LIMIT ?
+`
+
+	sqlUpdateVersionHash = `
+UPDATE versions
+	SET code_hash = ?
+	WHERE rowid = ?
 `
 )
 
 type Effects struct {
 	db *sqlx.DB
+	// DeltaSnapshots enables storing the code of new versions as compressed
+	// deltas against the previous version. Every DeltaSnapshots versions the
+	// full code is stored to bound the deltas applied when reading it. Zero
+	// stores all code in full. Code is read the same way in both modes.
+	// Values above MaxDeltaSnapshots are used as MaxDeltaSnapshots.
+	DeltaSnapshots int
 }
 
 func NewEffects(db *sqlx.DB) (*Effects, error) {
@@ -106,11 +227,109 @@ func (s *Effects) init() error {
 		return fmt.Errorf("could not create table versions: %w", err)
 	}
 
+	_, err = s.db.Exec(sqlCreateCodeBlobs)
+	if err != nil {
+		return fmt.Errorf("could not create table code_blobs: %w", err)
+	}
+
+	err = addColumn(s.db, "code_blobs", "base", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = addColumn(s.db, "code_blobs", "delta", "BLOB")
+	if err != nil {
+		return err
+	}
+	err = addColumn(s.db, "code_blobs", "depth", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = addColumn(s.db, "code_blobs", "size", "INTEGER")
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(sqlIndexCodeBlobsBase)
+	if err != nil {
+		return fmt.Errorf("could not create index code_blobs base: %w", err)
+	}
+
+	_, err = s.db.Exec(sqlCreateImports)
+	if err != nil {
+		return fmt.Errorf("could not create table imports: %w", err)
+	}
+
+	_, err = s.db.Exec(sqlCreateImportRenumbered)
+	if err != nil {
+		return fmt.Errorf("could not create table import_renumbered: %w", err)
+	}
+
+	_, err = s.db.Exec(sqlCreateChanges)
+	if err != nil {
+		return fmt.Errorf("could not create table changes: %w", err)
+	}
+
+	columns := []string{
+		"ip_hash", "agent_hash", "fingerprint", "code_hash", "spam_reasons",
+	}
+	for _, c := range columns {
+		err = addColumn(s.db, "versions", c, "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
+	}
+
+	columns = []string{"hidden", "spam_score"}
+	for _, c := range columns {
+		err = addColumn(s.db, "versions", c, "INTEGER NOT NULL DEFAULT 0")
+		if err != nil {
+			return err
+		}
+	}
+
+	err = addColumn(s.db, "effects", "deleted_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+
+	columns = []string{"locked", "review"}
+	for _, c := range columns {
+		err = addColumn(s.db, "effects", c, "INTEGER NOT NULL DEFAULT 0")
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.backfillChanges()
+	if err != nil {
+		return err
+	}
+
 	_, err = s.db.Exec(sqlIndexEffectsModified)
 	if err != nil {
 		return fmt.Errorf("could not create index modified_at: %w", err)
 	}
 
+	_, err = s.db.Exec(sqlIndexEffectsParent)
+	if err != nil {
+		return fmt.Errorf("could not create index parent: %w", err)
+	}
+
+	_, err = s.db.Exec(sqlIndexEffectsUser)
+	if err != nil {
+		return fmt.Errorf("could not create index user: %w", err)
+	}
+
+	_, err = s.db.Exec(sqlIndexEffectsDeleted)
+	if err != nil {
+		return fmt.Errorf("could not create index deleted_at: %w", err)
+	}
+
+	_, err = s.db.Exec(sqlIndexEffectsReview)
+	if err != nil {
+		return fmt.Errorf("could not create index review: %w", err)
+	}
+
 	_, err = s.db.Exec(sqlIndexVersionEffect)
 	if err != nil {
 		return fmt.Errorf("could not create index version effect: %w", err)
@@ -121,7 +340,73 @@ func (s *Effects) init() error {
 		return fmt.Errorf("could not create index version id: %w", err)
 	}
 
-	return nil
+	_, err = s.db.Exec(sqlIndexVersionIPHash)
+	if err != nil {
+		return fmt.Errorf("could not create index version ip hash: %w", err)
+	}
+
+	_, err = s.db.Exec(sqlIndexVersionFingerprint)
+	if err != nil {
+		return fmt.Errorf("could not create index version fingerprint: %w", err)
+	}
+
+	_, err = s.db.Exec(sqlIndexVersionCodeHash)
+	if err != nil {
+		return fmt.Errorf("could not create index version code hash: %w", err)
+	}
+
+	err = s.hashVersions()
+	if err != nil {
+		return err
+	}
+
+	return s.migrateCodeBlobs()
+}
+
+// hashVersions fills the code hash of versions stored before it existed.
+func (s *Effects) hashVersions() error {
+	type noHash struct {
+		rowid int64
+		code  string
+	}
+
+	for {
+		var batch []noHash
+		rows, err := s.db.Query(sqlSelectVersionsNoHash, 1000)
+		if err != nil {
+			return fmt.Errorf("could not get versions: %w", err)
+		}
+		for rows.Next() {
+			var v noHash
+			err = rows.Scan(&v.rowid, &v.code)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("could not read version: %w", err)
+			}
+			batch = append(batch, v)
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			return fmt.Errorf("could not read versions: %w", rows.Err())
+		}
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		err = s.transaction(func(tx *sqlx.Tx) error {
+			for _, v := range batch {
+				_, err := tx.Exec(sqlUpdateVersionHash, CodeHash(v.code), v.rowid)
+				if err != nil {
+					return fmt.Errorf("could not update version hash: %w", err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
 }
 
 const (
@@ -133,7 +418,10 @@ INSERT INTO effects (
 	parent,
 	parent_version,
 	user,
-	hidden
+	hidden,
+	deleted_at,
+	locked,
+	review
 ) VALUES(
 	:id,
 	:created_at,
@@ -141,7 +429,36 @@ INSERT INTO effects (
 	:parent,
 	:parent_version,
 	:user,
-	:hidden
+	:hidden,
+	:deleted_at,
+	:locked,
+	:review
+)
+`
+
+	sqlReplaceEffectID = `
+INSERT OR REPLACE INTO effects (
+	id,
+	created_at,
+	modified_at,
+	parent,
+	parent_version,
+	user,
+	hidden,
+	deleted_at,
+	locked,
+	review
+) VALUES(
+	:id,
+	:created_at,
+	:modified_at,
+	:parent,
+	:parent_version,
+	:user,
+	:hidden,
+	:deleted_at,
+	:locked,
+	:review
 )
 `
 
@@ -168,46 +485,113 @@ INSERT INTO versions (
 	version,
 	effect,
 	created_at,
-	code
+	code,
+	code_hash,
+	ip_hash,
+	agent_hash,
+	fingerprint,
+	hidden,
+	spam_score,
+	spam_reasons
 ) VALUES(
 	:version,
 	:effect,
 	:created_at,
-	:code
+	:code,
+	:code_hash,
+	:ip_hash,
+	:agent_hash,
+	:fingerprint,
+	:hidden,
+	:spam_score,
+	:spam_reasons
 )
 `
 
 	sqlSelectEffects = `
 SELECT * FROM effects
-	WHERE hidden = 0
+	WHERE hidden = 0 AND deleted_at IS NULL
 	ORDER BY modified_at DESC
 	LIMIT ? OFFSET ?
 `
 
 	sqlSelectEffectsAll = `
 SELECT * FROM effects
+	WHERE deleted_at IS NULL
 	ORDER BY modified_at DESC
 	LIMIT ? OFFSET ?
 `
 
 	sqlSelectEffectsSiblings = `
 SELECT * FROM effects
-	WHERE id = ? OR
-		parent = ?
+	WHERE (id = ? OR parent = ?) AND
+		deleted_at IS NULL
 	ORDER BY modified_at DESC
 	LIMIT ? OFFSET ?
 `
 
-	sqlSelectVersions = `
-SELECT * FROM versions
-	WHERE effect = ?
-	ORDER BY version
+	sqlSelectEffectsDeleted = `
+SELECT * FROM effects
+	WHERE deleted_at IS NOT NULL
+	ORDER BY deleted_at DESC
+	LIMIT ? OFFSET ?
 `
 
-	sqlSelectVersionsMulti = `
-SELECT * FROM versions
-	WHERE effect IN (?)
-	ORDER BY version
+	sqlSelectEffectsList = `
+SELECT * FROM effects
+	WHERE %s
+	ORDER BY modified_at DESC
+	LIMIT ? OFFSET ?
+`
+
+	sqlSelectEffectsReview = `
+SELECT * FROM effects
+	WHERE review = 1 AND deleted_at IS NULL
+	ORDER BY modified_at DESC
+	LIMIT ? OFFSET ?
+`
+
+	sqlSelectEffectsExpired = `
+SELECT id FROM effects
+	WHERE deleted_at IS NOT NULL AND deleted_at < ?
+`
+
+	sqlSelectVersionColumns = `
+SELECT
+	versions.version,
+	versions.effect,
+	versions.created_at,
+	COALESCE(code_blobs.code, versions.code) AS code,
+	versions.code_hash,
+	versions.ip_hash,
+	versions.agent_hash,
+	versions.fingerprint,
+	versions.hidden,
+	versions.spam_score,
+	versions.spam_reasons,
+	IFNULL(code_blobs.base, '') AS code_base,
+	code_blobs.delta AS code_delta
+	FROM versions
+	LEFT JOIN code_blobs ON code_blobs.hash = versions.code_hash
+`
+
+	sqlSelectVersions = sqlSelectVersionColumns + `
+	WHERE versions.effect = ?
+	ORDER BY versions.version
+`
+
+	sqlSelectVersionsMulti = sqlSelectVersionColumns + `
+	WHERE versions.effect IN (?)
+	ORDER BY versions.version
+`
+
+	sqlSelectVersion = sqlSelectVersionColumns + `
+	WHERE versions.effect = ? AND versions.version = ?
+`
+
+	sqlSelectVersionCodeHash = `
+SELECT code_hash FROM versions
+	WHERE effect = ? AND version = ?
 `
 
 	sqlSelectEffect = `
@@ -215,11 +599,33 @@ SELECT * FROM effects
 	WHERE id = ?
 `
 
-	sqlSelectMaxVersion = `
-SELECT MAX(version) FROM versions
+	sqlSelectEffectHidden = `
+SELECT hidden FROM effects
+	WHERE id = ?
+`
+
+	sqlSelectVersionHidden = `
+SELECT hidden FROM versions
+	WHERE effect = ? AND version = ?
+`
+
+	sqlSelectEffectUser = `
+SELECT user FROM effects
+	WHERE id = ?
+`
+
+	sqlCountVersions = `
+SELECT COUNT(*) FROM versions
 	WHERE effect = ?
 `
 
+	sqlSelectMaxVersion = `
+SELECT MAX(versions.version), MAX(effects.locked) FROM versions
+	JOIN effects ON effects.id = versions.effect
+	WHERE versions.effect = ? AND
+		effects.deleted_at IS NULL
+`
+
 	sqlUpdateEffectModification = `
 UPDATE effects
 	SET modified_at = ?
@@ -231,33 +637,246 @@ UPDATE effects
 	SET hidden = ?
 	WHERE id = ?
 `
+
+	sqlUpdateEffectParent = `
+UPDATE effects
+	SET parent = ?, parent_version = ?
+	WHERE id = ?
+`
+
+	sqlSelectEffectParent = `
+SELECT parent FROM effects
+	WHERE id = ?
+`
+
+	sqlUpdateEffectLock = `
+UPDATE effects
+	SET locked = ?
+	WHERE id = ?
+`
+
+	sqlUpdateEffectReview = `
+UPDATE effects
+	SET review = ?
+	WHERE id = ?
+`
+
+	sqlUpdateVersionSpam = `
+UPDATE versions
+	SET spam_score = ?, spam_reasons = ?
+	WHERE effect = ? AND version = ?
+`
+
+	sqlCountVersionsCode = `
+SELECT COUNT(*) FROM versions
+	WHERE code_hash = ?
+`
+
+	sqlCountVersionsFingerprint = `
+SELECT COUNT(*) FROM versions
+	WHERE fingerprint = ? AND created_at >= ?
+`
+
+	sqlUpdateEffectDelete = `
+UPDATE effects
+	SET deleted_at = ?
+	WHERE id = ? AND deleted_at IS NULL
+`
+
+	sqlUpdateEffectRestore = `
+UPDATE effects
+	SET deleted_at = NULL
+	WHERE id = ? AND deleted_at IS NOT NULL
+`
+
+	sqlDeleteEffects = `
+DELETE FROM effects
+	WHERE id IN (?)
+`
+
+	sqlDeleteVersions = `
+DELETE FROM versions
+	WHERE effect IN (?)
+`
+
+	sqlUpdateVersionHide = `
+UPDATE versions
+	SET hidden = ?
+	WHERE effect = ? AND version = ?
+`
+
+	sqlSelectEffectsHideMany = `
+SELECT id FROM effects
+	WHERE COALESCE(hidden, 0) != ? AND (%s)
+`
+
+	sqlUpdateEffectsHide = `
+UPDATE effects
+	SET hidden = ?
+	WHERE id IN (?)
+`
+
+	sqlWhereHideSubmitter = `
+id IN (
+	SELECT effect FROM versions
+		WHERE ip_hash = ? OR fingerprint = ?
+)
+`
+
+	sqlWhereHideUser = `
+user = ?
+`
+
+	sqlWhereHideForks = `
+id IN (
+	WITH RECURSIVE forks(id) AS (
+		SELECT id FROM effects WHERE parent = ?
+		UNION
+		SELECT effects.id FROM effects
+			JOIN forks ON effects.parent = forks.id
+	)
+	SELECT id FROM forks
+)
+`
+
+	sqlWhereHideCreated = `
+created_at >= ? AND created_at < ?
+`
+
+	sqlWhereHideCode = `
+id IN (
+	SELECT effect FROM versions
+		WHERE code_hash = ?
+)
+`
+
+	sqlUpdateVersionExpireSubmitter = `
+UPDATE versions
+	SET ip_hash = '', agent_hash = '', fingerprint = ''
+	WHERE created_at < ? AND
+		(ip_hash != '' OR agent_hash != '' OR fingerprint != '')
+`
 )
 
 func (s *Effects) AddEffect(e Effect) error {
 	return s.transaction(func(tx *sqlx.Tx) error {
-		effect := sqliteFromEffect(e)
-		_, err := tx.NamedExec(sqlInsertEffectID, effect)
+		return addEffect(tx, e, s.DeltaSnapshots)
+	})
+}
+
+// addEffect stores an effect keeping its ID.
+func addEffect(tx *sqlx.Tx, e Effect, snapshots int) error {
+	_, err := tx.NamedExec(sqlInsertEffectID, sqliteFromEffect(e))
+	if err != nil {
+		return fmt.Errorf("could not insert effect: %w", err)
+	}
+
+	err = insertVersions(tx, e, snapshots)
+	if err != nil {
+		return err
+	}
+
+	return addChange(tx, Change{
+		Kind:      ChangeCreated,
+		Effect:    e.ID,
+		User:      e.User,
+		CreatedAt: e.CreatedAt,
+	})
+}
+
+// PutEffect stores a copy of an effect, replacing the effect with the same
+// ID and its versions. It is used to replicate effects from other
+// instances. A change is recorded for the effect if it is new and for each
+// version not stored before.
+func (s *Effects) PutEffect(e Effect) error {
+	return s.transaction(func(tx *sqlx.Tx) error {
+		return putEffect(tx, e, s.DeltaSnapshots)
+	})
+}
+
+func putEffect(tx *sqlx.Tx, e Effect, snapshots int) error {
+	var count int
+	err := tx.Get(&count, sqlCountVersions, e.ID)
+	if err != nil {
+		return fmt.Errorf("could not count versions: %w", err)
+	}
+
+	_, err = tx.NamedExec(sqlReplaceEffectID, sqliteFromEffect(e))
+	if err != nil {
+		return fmt.Errorf("could not replace effect: %w", err)
+	}
+
+	hashes, err := versionsCodeHash(tx, []int{e.ID})
+	if err != nil {
+		return err
+	}
+
+	query, args, err := sqlx.In(sqlDeleteVersions, []int{e.ID})
+	if err != nil {
+		return fmt.Errorf("could not construct delete query: %w", err)
+	}
+	_, err = tx.Exec(query, args...)
+	if err != nil {
+		return fmt.Errorf("could not delete versions: %w", err)
+	}
+
+	err = insertVersions(tx, e, snapshots)
+	if err != nil {
+		return err
+	}
+
+	err = deleteUnusedCode(tx, hashes)
+	if err != nil {
+		return err
+	}
+
+	for i := count; i < len(e.Versions); i++ {
+		c := Change{
+			Kind:      ChangeVersion,
+			Effect:    e.ID,
+			Version:   i,
+			User:      e.User,
+			CreatedAt: e.Versions[i].CreatedAt,
+		}
+		if i == 0 {
+			c.Kind = ChangeCreated
+		}
+
+		err = addChange(tx, c)
 		if err != nil {
-			return fmt.Errorf("could not insert effect: %w", err)
+			return err
 		}
+	}
 
-		for i, v := range e.Versions {
-			version := sqliteFromversion(v)
-			version.Version = i
-			version.Effect = effect.ID
+	return nil
+}
 
-			_, err := tx.NamedExec(sqlInsertVersion, version)
-			if err != nil {
-				return fmt.Errorf("could not insert version: %w", err)
-			}
+// insertVersions stores all the versions of an effect. With snapshots
+// greater than zero the code of each version is stored as a delta against
+// the previous one.
+func insertVersions(tx *sqlx.Tx, e Effect, snapshots int) error {
+	var base string
+	for i, v := range e.Versions {
+		version := sqliteFromversion(v)
+		version.Version = i
+		version.Effect = e.ID
+
+		err := insertVersion(tx, version, snapshots, base)
+		if err != nil {
+			return err
 		}
+		base = version.CodeHash
+	}
 
-		return nil
-	})
+	return nil
 }
 
 func (s *Effects) Add(
-	parent int, parentVersion int, user string, version string,
+	parent int,
+	parentVersion int,
+	user string,
+	version string,
+	submitter Submitter,
 ) (int, error) {
 	var lastID int
 	err := s.transaction(func(tx *sqlx.Tx) error {
@@ -281,29 +900,47 @@ func (s *Effects) Add(
 		}
 		lastID = int(id)
 
-		v := sqliteVersion{
-			Version:   0,
-			Effect:    int(id),
+		// forks are stored as deltas against the version they come from
+		var base string
+		if s.DeltaSnapshots > 0 && parent >= 0 {
+			err = tx.Get(&base, sqlSelectVersionCodeHash, parent, parentVersion)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("could not get parent code hash: %w", err)
+			}
+		}
+
+		v := sqliteFromversion(Version{
 			CreatedAt: t,
 			Code:      version,
-		}
-		_, err = tx.NamedExec(sqlInsertVersion, v)
+			Submitter: submitter,
+		})
+		v.Effect = int(id)
+		err = insertVersion(tx, v, s.DeltaSnapshots, base)
 		if err != nil {
-			return fmt.Errorf("could not insert version: %w", err)
+			return err
 		}
-		return nil
+
+		return addChange(tx, Change{
+			Kind:      ChangeCreated,
+			Effect:    lastID,
+			User:      user,
+			CreatedAt: t,
+		})
 	})
 
 	return lastID, err
 }
 
-func (s *Effects) AddVersion(id int, code string) (int, error) {
+func (s *Effects) AddVersion(
+	id int, code string, submitter Submitter,
+) (int, error) {
 	var lastVersion int
 	err := s.transaction(func(tx *sqlx.Tx) error {
 		t := time.Now()
 		var maxVersion *int
+		var locked *bool
 		r := tx.QueryRowx(sqlSelectMaxVersion, id)
-		err := r.Scan(&maxVersion)
+		err := r.Scan(&maxVersion, &locked)
 		if err != nil {
 			return fmt.Errorf("could not get max version: %w", err)
 		}
@@ -311,16 +948,29 @@ func (s *Effects) AddVersion(id int, code string) (int, error) {
 		if maxVersion == nil {
 			return ErrNotFound
 		}
+		if locked != nil && *locked {
+			return ErrLocked
+		}
+
+		version := sqliteFromversion(Version{
+			CreatedAt: t,
+			Code:      code,
+			Submitter: submitter,
+		})
+		version.Version = *maxVersion + 1
+		version.Effect = id
+
+		var base string
+		if s.DeltaSnapshots > 0 {
+			err = tx.Get(&base, sqlSelectVersionCodeHash, id, *maxVersion)
+			if err != nil {
+				return fmt.Errorf("could not get previous code hash: %w", err)
+			}
+		}
 
-		version := sqliteVersion{
-			Version:   *maxVersion + 1,
-			Effect:    id,
-			CreatedAt: t,
-			Code:      code,
-		}
-		_, err = tx.NamedExec(sqlInsertVersion, version)
+		err = insertVersion(tx, version, s.DeltaSnapshots, base)
 		if err != nil {
-			return fmt.Errorf("could not insert version: %w", err)
+			return err
 		}
 		lastVersion = version.Version
 
@@ -329,7 +979,19 @@ func (s *Effects) AddVersion(id int, code string) (int, error) {
 			return fmt.Errorf("could not update effect: %w", err)
 		}
 
-		return nil
+		var user string
+		err = tx.Get(&user, sqlSelectEffectUser, id)
+		if err != nil {
+			return fmt.Errorf("could not get effect user: %w", err)
+		}
+
+		return addChange(tx, Change{
+			Kind:      ChangeVersion,
+			Effect:    id,
+			Version:   version.Version,
+			User:      user,
+			CreatedAt: t,
+		})
 	})
 
 	return lastVersion, err
@@ -350,6 +1012,50 @@ func (s *Effects) PageSiblings(num int, size int, parent int) ([]Effect, error)
 	return s.page(query, []interface{}{parent, parent, size, num * size})
 }
 
+// Deleted returns a page of the effects in the trash, most recently deleted
+// first.
+func (s *Effects) Deleted(num int, size int) ([]Effect, error) {
+	return s.page(sqlSelectEffectsDeleted, []interface{}{size, num * size})
+}
+
+// Reviews returns a page of the effects waiting for moderation, most
+// recently modified first.
+func (s *Effects) Reviews(num int, size int) ([]Effect, error) {
+	return s.page(sqlSelectEffectsReview, []interface{}{size, num * size})
+}
+
+// ListOptions filters the effects returned by List.
+type ListOptions struct {
+	// User only lists the effects created with this user string.
+	User string
+	// Since only lists the effects modified from this time.
+	Since time.Time
+	// Hidden only lists hidden effects.
+	Hidden bool
+}
+
+// List returns a page of the effects not in the trash that match the
+// options, hidden or not, most recently modified first.
+func (s *Effects) List(opts ListOptions, num int, size int) ([]Effect, error) {
+	where := []string{"deleted_at IS NULL"}
+	var args []interface{}
+	if opts.User != "" {
+		where = append(where, "user = ?")
+		args = append(args, opts.User)
+	}
+	if !opts.Since.IsZero() {
+		where = append(where, "modified_at >= ?")
+		args = append(args, sqlTime(opts.Since))
+	}
+	if opts.Hidden {
+		where = append(where, "hidden = 1")
+	}
+
+	query := fmt.Sprintf(sqlSelectEffectsList, strings.Join(where, " AND "))
+	args = append(args, size, num*size)
+	return s.page(query, args)
+}
+
 func (s *Effects) page(query string, qargs []interface{}) ([]Effect, error) {
 	iter, err := s.db.Queryx(query, qargs...)
 	if err != nil {
@@ -399,10 +1105,18 @@ func (s *Effects) page(query string, qargs []interface{}) ([]Effect, error) {
 		return nil, fmt.Errorf("could not iterate versions: %w", err)
 	}
 
+	resolver := newCodeResolver(s.db)
 	for _, e := range versions {
 		sort.Slice(e, func(i, j int) bool {
 			return e[i].Version < e[j].Version
 		})
+
+		for i := range e {
+			err = resolver.version(&e[i])
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	for i, e := range effects {
@@ -423,7 +1137,7 @@ func (s *Effects) versions(id int) ([]Version, error) {
 	}
 	defer iter.Close()
 
-	var versions []Version
+	var rows []sqliteVersion
 	for iter.Next() {
 		var v sqliteVersion
 		err = iter.StructScan(&v)
@@ -431,6 +1145,19 @@ func (s *Effects) versions(id int) ([]Version, error) {
 			return nil, fmt.Errorf("could not retrieve version: %w", err)
 		}
 
+		rows = append(rows, v)
+	}
+	if iter.Err() != nil {
+		return nil, fmt.Errorf("could not iterate versions: %w", iter.Err())
+	}
+
+	resolver := newCodeResolver(s.db)
+	var versions []Version
+	for _, v := range rows {
+		err = resolver.version(&v)
+		if err != nil {
+			return nil, err
+		}
 		versions = append(versions, sqliteToVersion(v))
 	}
 
@@ -456,8 +1183,151 @@ func (s *Effects) Effect(id int) (Effect, error) {
 	return effect, nil
 }
 
+// EffectVersion returns an effect with only the version asked in Versions.
+// It returns ErrNotFound if the effect does not have that version.
+func (s *Effects) EffectVersion(id int, version int) (Effect, error) {
+	var e sqliteEffect
+	r := s.db.QueryRowx(sqlSelectEffect, id)
+	err := r.StructScan(&e)
+	if err != nil {
+		return Effect{}, fmt.Errorf("could not get effect: %w", err)
+	}
+
+	var v sqliteVersion
+	err = s.db.QueryRowx(sqlSelectVersion, id, version).StructScan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Effect{}, ErrNotFound
+	}
+	if err != nil {
+		return Effect{}, fmt.Errorf("could not get version: %w", err)
+	}
+
+	err = newCodeResolver(s.db).version(&v)
+	if err != nil {
+		return Effect{}, err
+	}
+
+	effect := sqliteToEffect(e)
+	effect.Versions = []Version{sqliteToVersion(v)}
+
+	return effect, nil
+}
+
+// Hide sets the hidden state of an effect. A change is recorded when the
+// state is different.
 func (s *Effects) Hide(id int, hidden bool) error {
-	r, err := s.db.Exec(sqlUpdateEffectHide, hidden, id)
+	return s.transaction(func(tx *sqlx.Tx) error {
+		var current *bool
+		err := tx.Get(&current, sqlSelectEffectHidden, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("could not get effect: %w", err)
+		}
+		if current != nil && *current == hidden {
+			return nil
+		}
+
+		_, err = tx.Exec(sqlUpdateEffectHide, hidden, id)
+		if err != nil {
+			return fmt.Errorf("could not update effect: %w", err)
+		}
+
+		return addChange(tx, Change{
+			Kind:    hideKind(hidden),
+			Effect:  id,
+			Version: -1,
+		})
+	})
+}
+
+// Lock sets the locked state of an effect. Locked effects refuse new
+// versions.
+func (s *Effects) Lock(id int, locked bool) error {
+	r, err := s.db.Exec(sqlUpdateEffectLock, locked, id)
+	if err != nil {
+		return fmt.Errorf("could not update effect: %w", err)
+	}
+
+	n, err := r.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not update effect: %w", err)
+	}
+	if n < 1 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// SetParent changes the effect an effect was forked from. Parent -1 makes
+// it an original effect. The parent must exist and have the version, and
+// the effect can not be one of its ancestors.
+func (s *Effects) SetParent(id int, parent int, parentVersion int) error {
+	if parent < 0 {
+		parent, parentVersion = -1, -1
+	}
+
+	return s.transaction(func(tx *sqlx.Tx) error {
+		var current int
+		err := tx.Get(&current, sqlSelectEffectParent, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("could not get effect: %w", err)
+		}
+
+		if parent >= 0 {
+			var versions int
+			err = tx.Get(&versions, sqlCountVersions, parent)
+			if err != nil {
+				return fmt.Errorf("could not get parent versions: %w", err)
+			}
+			if versions == 0 {
+				return fmt.Errorf("%w: parent effect %d not found", ErrInvalid, parent)
+			}
+			if parentVersion < 0 || parentVersion >= versions {
+				return fmt.Errorf("%w: parent effect %d has no version %d",
+					ErrInvalid, parent, parentVersion)
+			}
+
+			// walk up the ancestors looking for the effect, seen stops
+			// on loops already in the database
+			seen := make(map[int]bool)
+			for p := parent; p >= 0 && !seen[p]; {
+				if p == id {
+					return fmt.Errorf("%w: effect %d is an ancestor of %d", ErrInvalid, id, parent)
+				}
+				seen[p] = true
+
+				err = tx.Get(&p, sqlSelectEffectParent, p)
+				if errors.Is(err, sql.ErrNoRows) {
+					break
+				}
+				if err != nil {
+					return fmt.Errorf("could not get parent: %w", err)
+				}
+			}
+		}
+
+		_, err = tx.Exec(sqlUpdateEffectParent, parent, parentVersion, id)
+		if err != nil {
+			return fmt.Errorf("could not update effect: %w", err)
+		}
+
+		return addChange(tx, Change{
+			Kind:    ChangeParent,
+			Effect:  id,
+			Version: -1,
+		})
+	})
+}
+
+// Review sets if an effect is waiting for moderation.
+func (s *Effects) Review(id int, review bool) error {
+	r, err := s.db.Exec(sqlUpdateEffectReview, review, id)
 	if err != nil {
 		return fmt.Errorf("could not update effect: %w", err)
 	}
@@ -465,7 +1335,27 @@ func (s *Effects) Hide(id int, hidden bool) error {
 	n, err := r.RowsAffected()
 	if err != nil {
 		return fmt.Errorf("could not update effect: %w", err)
+	}
+	if n < 1 {
+		return ErrNotFound
+	}
+
+	return nil
+}
 
+// SetSpam stores the spam score of a version and the reasons for it.
+func (s *Effects) SetSpam(
+	id int, version int, score int, reasons []string,
+) error {
+	r, err := s.db.Exec(sqlUpdateVersionSpam,
+		score, strings.Join(reasons, ","), id, version)
+	if err != nil {
+		return fmt.Errorf("could not update version: %w", err)
+	}
+
+	n, err := r.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not update version: %w", err)
 	}
 	if n < 1 {
 		return ErrNotFound
@@ -474,6 +1364,278 @@ func (s *Effects) Hide(id int, hidden bool) error {
 	return nil
 }
 
+// CountCode returns the number of versions with the given code hash.
+func (s *Effects) CountCode(hash string) (int, error) {
+	var n int
+	err := s.db.Get(&n, sqlCountVersionsCode, hash)
+	if err != nil {
+		return 0, fmt.Errorf("could not count versions: %w", err)
+	}
+	return n, nil
+}
+
+// CountSubmitter returns the number of versions sent by the submitter with
+// the given fingerprint since a time.
+func (s *Effects) CountSubmitter(fingerprint string, since time.Time) (int, error) {
+	if fingerprint == "" {
+		return 0, nil
+	}
+
+	var n int
+	err := s.db.Get(&n, sqlCountVersionsFingerprint, fingerprint, sqlTime(since))
+	if err != nil {
+		return 0, fmt.Errorf("could not count versions: %w", err)
+	}
+	return n, nil
+}
+
+// Delete moves an effect to the trash. It is no longer listed or accepts
+// new versions but can be restored until it is purged.
+func (s *Effects) Delete(id int) error {
+	return s.transaction(func(tx *sqlx.Tx) error {
+		return deleteEffect(tx, id)
+	})
+}
+
+// deleteEffect moves an effect to the trash. It returns ErrNotFound if the
+// effect does not exist or is already deleted.
+func deleteEffect(tx *sqlx.Tx, id int) error {
+	r, err := tx.Exec(sqlUpdateEffectDelete, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("could not delete effect: %w", err)
+	}
+
+	n, err := r.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not delete effect: %w", err)
+	}
+	if n < 1 {
+		return ErrNotFound
+	}
+
+	return addChange(tx, Change{
+		Kind:    ChangeDeleted,
+		Effect:  id,
+		Version: -1,
+	})
+}
+
+// Restore takes an effect out of the trash.
+func (s *Effects) Restore(id int) error {
+	return s.transaction(func(tx *sqlx.Tx) error {
+		r, err := tx.Exec(sqlUpdateEffectRestore, id)
+		if err != nil {
+			return fmt.Errorf("could not restore effect: %w", err)
+		}
+
+		n, err := r.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("could not restore effect: %w", err)
+		}
+		if n < 1 {
+			return ErrNotFound
+		}
+
+		return addChange(tx, Change{
+			Kind:    ChangeRestored,
+			Effect:  id,
+			Version: -1,
+		})
+	})
+}
+
+// Purge permanently removes the effects deleted before the given time and
+// all their versions. It returns the identifiers of the removed effects so
+// their thumbnails can be deleted.
+func (s *Effects) Purge(before time.Time) ([]int, error) {
+	var ids []int
+	err := s.transaction(func(tx *sqlx.Tx) error {
+		err := tx.Select(&ids, sqlSelectEffectsExpired, sqlTime(before))
+		if err != nil {
+			return fmt.Errorf("could not get expired effects: %w", err)
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		hashes, err := versionsCodeHash(tx, ids)
+		if err != nil {
+			return err
+		}
+
+		for _, q := range []string{sqlDeleteVersions, sqlDeleteEffects} {
+			query, args, err := sqlx.In(q, ids)
+			if err != nil {
+				return fmt.Errorf("could not construct purge query: %w", err)
+			}
+			_, err = tx.Exec(query, args...)
+			if err != nil {
+				return fmt.Errorf("could not purge effects: %w", err)
+			}
+		}
+
+		err = deleteUnusedCode(tx, hashes)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			err = addChange(tx, Change{
+				Kind:    ChangePurged,
+				Effect:  id,
+				Version: -1,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// HideVersion hides or unhides a single version of an effect.
+func (s *Effects) HideVersion(id int, version int, hidden bool) error {
+	return s.transaction(func(tx *sqlx.Tx) error {
+		var current bool
+		err := tx.Get(&current, sqlSelectVersionHidden, id, version)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("could not get version: %w", err)
+		}
+		if current == hidden {
+			return nil
+		}
+
+		_, err = tx.Exec(sqlUpdateVersionHide, hidden, id, version)
+		if err != nil {
+			return fmt.Errorf("could not update version: %w", err)
+		}
+
+		return addChange(tx, Change{
+			Kind:    hideKind(hidden),
+			Effect:  id,
+			Version: version,
+		})
+	})
+}
+
+// HideSubmitter hides or unhides all the effects with any version sent by
+// the submitter with the given IP hash or fingerprint. It returns the number
+// of effects changed.
+func (s *Effects) HideSubmitter(hash string, hidden bool) (int, error) {
+	if hash == "" {
+		return 0, fmt.Errorf("empty submitter hash")
+	}
+
+	return s.hideMany(sqlWhereHideSubmitter, hidden, hash, hash)
+}
+
+// HideUser hides or unhides all the effects created with the given user
+// string. It returns the number of effects changed.
+func (s *Effects) HideUser(user string, hidden bool) (int, error) {
+	if user == "" {
+		return 0, fmt.Errorf("empty user")
+	}
+
+	return s.hideMany(sqlWhereHideUser, hidden, user)
+}
+
+// HideForks hides or unhides all the forks of an effect, including forks of
+// forks. The effect itself is not changed. It returns the number of effects
+// changed.
+func (s *Effects) HideForks(id int, hidden bool) (int, error) {
+	return s.hideMany(sqlWhereHideForks, hidden, id)
+}
+
+// HideCreated hides or unhides all the effects created between from
+// (inclusive) and to (exclusive). It returns the number of effects changed.
+func (s *Effects) HideCreated(from, to time.Time, hidden bool) (int, error) {
+	if !from.Before(to) {
+		return 0, fmt.Errorf("%w: invalid time window", ErrInvalid)
+	}
+
+	return s.hideMany(sqlWhereHideCreated,
+		hidden, sqlTime(from), sqlTime(to))
+}
+
+// HideCode hides or unhides all the effects with any version whose code
+// hash is the given one. It returns the number of effects changed.
+func (s *Effects) HideCode(hash string, hidden bool) (int, error) {
+	if hash == "" {
+		return 0, fmt.Errorf("empty code hash")
+	}
+
+	return s.hideMany(sqlWhereHideCode, hidden, hash)
+}
+
+// hideMany sets the hidden state of the effects matching the condition
+// that do not have it already and records a change for each of them.
+func (s *Effects) hideMany(
+	cond string, hidden bool, args ...interface{},
+) (int, error) {
+	var ids []int
+	err := s.transaction(func(tx *sqlx.Tx) error {
+		err := tx.Select(&ids, fmt.Sprintf(sqlSelectEffectsHideMany, cond),
+			append([]interface{}{hidden}, args...)...)
+		if err != nil {
+			return fmt.Errorf("could not get effects: %w", err)
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		query, qargs, err := sqlx.In(sqlUpdateEffectsHide, hidden, ids)
+		if err != nil {
+			return fmt.Errorf("could not construct hide query: %w", err)
+		}
+		_, err = tx.Exec(query, qargs...)
+		if err != nil {
+			return fmt.Errorf("could not update effects: %w", err)
+		}
+
+		for _, id := range ids {
+			err = addChange(tx, Change{
+				Kind:    hideKind(hidden),
+				Effect:  id,
+				Version: -1,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(ids), nil
+}
+
+// ExpireSubmitters erases the submitter information of versions created
+// before the given time. It returns the number of versions changed.
+func (s *Effects) ExpireSubmitters(before time.Time) (int, error) {
+	r, err := s.db.Exec(sqlUpdateVersionExpireSubmitter, sqlTime(before))
+	if err != nil {
+		return 0, fmt.Errorf("could not update versions: %w", err)
+	}
+
+	n, err := r.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("could not update versions: %w", err)
+	}
+
+	return int(n), nil
+}
+
 func (s *Effects) transaction(f func(*sqlx.Tx) error) error {
 	tx, err := s.db.Beginx()
 	if err != nil {
@@ -503,6 +1665,9 @@ func sqliteToEffect(e sqliteEffect) Effect {
 		ParentVersion: e.ParentVersion,
 		User:          e.User,
 		Hidden:        e.Hidden,
+		DeletedAt:     e.DeletedAt.Time,
+		Locked:        e.Locked,
+		Review:        e.Review,
 	}
 	return n
 }
@@ -511,6 +1676,17 @@ func sqliteToVersion(v sqliteVersion) Version {
 	n := Version{
 		CreatedAt: v.CreatedAt,
 		Code:      v.Code,
+		CodeHash:  v.CodeHash,
+		Hidden:    v.Hidden,
+		Submitter: Submitter{
+			IP:          v.IPHash,
+			UserAgent:   v.AgentHash,
+			Fingerprint: v.Fingerprint,
+		},
+		SpamScore: v.SpamScore,
+	}
+	if v.SpamReasons != "" {
+		n.SpamReasons = strings.Split(v.SpamReasons, ",")
 	}
 	return n
 }
@@ -524,14 +1700,27 @@ func sqliteFromEffect(e Effect) sqliteEffect {
 		ParentVersion: e.ParentVersion,
 		User:          e.User,
 		Hidden:        e.Hidden,
+		DeletedAt: sql.NullTime{
+			Time:  e.DeletedAt,
+			Valid: !e.DeletedAt.IsZero(),
+		},
+		Locked: e.Locked,
+		Review: e.Review,
 	}
 	return n
 }
 
 func sqliteFromversion(e Version) sqliteVersion {
 	n := sqliteVersion{
-		CreatedAt: e.CreatedAt,
-		Code:      e.Code,
+		CreatedAt:   e.CreatedAt,
+		Code:        e.Code,
+		CodeHash:    CodeHash(e.Code),
+		Hidden:      e.Hidden,
+		IPHash:      e.Submitter.IP,
+		AgentHash:   e.Submitter.UserAgent,
+		Fingerprint: e.Submitter.Fingerprint,
+		SpamScore:   e.SpamScore,
+		SpamReasons: strings.Join(e.SpamReasons, ","),
 	}
 	return n
 }
@@ -2,6 +2,7 @@ package store
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -22,6 +23,14 @@ var tests = []helper{
 	{"add version", testAddVersion},
 	{"hide", testHide},
 	{"siblings", testSiblings},
+	{"submitter", testSubmitter},
+	{"bulk hide", testBulkHide},
+	{"hide version", testHideVersion},
+	{"delete", testDelete},
+	{"lock", testLock},
+	{"spam", testSpam},
+	{"list", testList},
+	{"set parent", testSetParent},
 }
 
 func TestEffects(t *testing.T) {
@@ -86,7 +95,7 @@ func testHidden(t *testing.T, s *Effects) {
 }
 
 func testAddVersion(t *testing.T, s *Effects) {
-	id, err := s.Add(10, 5, "user", "first")
+	id, err := s.Add(10, 5, "user", "first", Submitter{})
 	require.NoError(t, err)
 	require.Equal(t, 1, id)
 
@@ -109,7 +118,7 @@ func testAddVersion(t *testing.T, s *Effects) {
 	require.True(t, v.CreatedAt.Before(time.Now()))
 	require.False(t, v.CreatedAt.IsZero())
 
-	vid, err := s.AddVersion(1, "second")
+	vid, err := s.AddVersion(1, "second", Submitter{})
 	require.NoError(t, err)
 	require.Equal(t, 1, vid)
 
@@ -120,13 +129,13 @@ func testAddVersion(t *testing.T, s *Effects) {
 	require.Len(t, e.Versions, 2)
 	require.Equal(t, "second", e.Versions[1].Code)
 
-	_, err = s.AddVersion(2, "invalid")
+	_, err = s.AddVersion(2, "invalid", Submitter{})
 	require.Error(t, err)
 	require.Equal(t, err, ErrNotFound)
 }
 
 func testHide(t *testing.T, s *Effects) {
-	id, err := s.Add(10, 5, "user", "first")
+	id, err := s.Add(10, 5, "user", "first", Submitter{})
 	require.NoError(t, err)
 	require.Equal(t, 1, id)
 
@@ -152,18 +161,18 @@ func testHide(t *testing.T, s *Effects) {
 }
 
 func testSiblings(t *testing.T, s *Effects) {
-	pid, err := s.Add(-1, -1, "user", "parent")
+	pid, err := s.Add(-1, -1, "user", "parent", Submitter{})
 	require.NoError(t, err)
 
 	expected := []int{pid}
 	for i := 0; i < 10; i++ {
-		id, err := s.Add(pid, 0, "user", "child")
+		id, err := s.Add(pid, 0, "user", "child", Submitter{})
 		require.NoError(t, err)
 		expected = append(expected, id)
 	}
 
 	for i := 0; i < 10; i++ {
-		_, err = s.Add(-1, -1, "user", "no")
+		_, err = s.Add(-1, -1, "user", "no", Submitter{})
 		require.NoError(t, err)
 	}
 
@@ -183,3 +192,408 @@ func testSiblings(t *testing.T, s *Effects) {
 
 	require.ElementsMatch(t, expected, ids)
 }
+
+func testSubmitter(t *testing.T, s *Effects) {
+	vandal := Submitter{IP: "ip1", UserAgent: "agent1", Fingerprint: "fp1"}
+	other := Submitter{IP: "ip2", UserAgent: "agent1", Fingerprint: "fp2"}
+
+	id1, err := s.Add(-1, -1, "user", "first", vandal)
+	require.NoError(t, err)
+	id2, err := s.Add(-1, -1, "user", "second", other)
+	require.NoError(t, err)
+	_, err = s.AddVersion(id2, "vandalized", vandal)
+	require.NoError(t, err)
+	id3, err := s.Add(-1, -1, "user", "third", other)
+	require.NoError(t, err)
+
+	e, err := s.Effect(id2)
+	require.NoError(t, err)
+	require.Equal(t, other, e.Versions[0].Submitter)
+	require.Equal(t, vandal, e.Versions[1].Submitter)
+
+	_, err = s.HideSubmitter("", true)
+	require.Error(t, err)
+
+	n, err := s.HideSubmitter("fp1", true)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	es, err := s.Page(0, 10, false)
+	require.NoError(t, err)
+	require.Len(t, es, 1)
+	require.Equal(t, id3, es[0].ID)
+
+	n, err = s.HideSubmitter("ip1", false)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	e, err = s.Effect(id1)
+	require.NoError(t, err)
+	require.False(t, e.Hidden)
+
+	n, err = s.ExpireSubmitters(time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	n, err = s.ExpireSubmitters(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 4, n)
+
+	e, err = s.Effect(id2)
+	require.NoError(t, err)
+	require.Equal(t, Submitter{}, e.Versions[1].Submitter)
+}
+
+func testBulkHide(t *testing.T, s *Effects) {
+	hidden := func() []int {
+		es, err := s.Page(0, 50, true)
+		require.NoError(t, err)
+		var ids []int
+		for _, e := range es {
+			if e.Hidden {
+				ids = append(ids, e.ID)
+			}
+		}
+		return ids
+	}
+	unhideAll := func() {
+		for i := 1; i <= 6; i++ {
+			require.NoError(t, s.Hide(i, false))
+		}
+	}
+
+	root, err := s.Add(-1, -1, "alice", "root", Submitter{})
+	require.NoError(t, err)
+	fork, err := s.Add(root, 0, "bob", "spam", Submitter{})
+	require.NoError(t, err)
+	forkFork, err := s.Add(fork, 0, "bob", "fork", Submitter{})
+	require.NoError(t, err)
+	other, err := s.Add(-1, -1, "carol", "other", Submitter{})
+	require.NoError(t, err)
+	_, err = s.AddVersion(other, "spam", Submitter{})
+	require.NoError(t, err)
+
+	err = s.AddEffect(Effect{
+		ID:        5,
+		CreatedAt: time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC),
+		User:      "dave",
+		Versions:  []Version{{Code: "old"}},
+	})
+	require.NoError(t, err)
+	err = s.AddEffect(Effect{
+		ID:        6,
+		CreatedAt: time.Date(2020, time.February, 1, 0, 0, 0, 0, time.UTC),
+		User:      "dave",
+		Versions:  []Version{{Code: "old"}},
+	})
+	require.NoError(t, err)
+
+	_, err = s.HideUser("", true)
+	require.Error(t, err)
+	n, err := s.HideUser("bob", true)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.ElementsMatch(t, []int{fork, forkFork}, hidden())
+	n, err = s.HideUser("bob", false)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Empty(t, hidden())
+
+	n, err = s.HideForks(root, true)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.ElementsMatch(t, []int{fork, forkFork}, hidden())
+	unhideAll()
+
+	_, err = s.HideCode("", true)
+	require.Error(t, err)
+	n, err = s.HideCode(CodeHash("spam"), true)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.ElementsMatch(t, []int{fork, other}, hidden())
+	unhideAll()
+
+	from := time.Date(2019, time.December, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2020, time.January, 15, 0, 0, 0, 0, time.UTC)
+	_, err = s.HideCreated(to, from, true)
+	require.True(t, errors.Is(err, ErrInvalid))
+	n, err = s.HideCreated(from, to, true)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.ElementsMatch(t, []int{5}, hidden())
+}
+
+func testHideVersion(t *testing.T, s *Effects) {
+	id, err := s.Add(-1, -1, "user", "first", Submitter{})
+	require.NoError(t, err)
+	_, err = s.AddVersion(id, "second", Submitter{})
+	require.NoError(t, err)
+
+	e, err := s.Effect(id)
+	require.NoError(t, err)
+	require.Equal(t, 1, e.LastVisibleVersion())
+
+	err = s.HideVersion(id, 1, true)
+	require.NoError(t, err)
+
+	e, err = s.Effect(id)
+	require.NoError(t, err)
+	require.False(t, e.Versions[0].Hidden)
+	require.True(t, e.Versions[1].Hidden)
+	require.Equal(t, 0, e.LastVisibleVersion())
+
+	err = s.HideVersion(id, 0, true)
+	require.NoError(t, err)
+
+	es, err := s.Page(0, 10, false)
+	require.NoError(t, err)
+	require.Len(t, es, 1)
+	require.Equal(t, -1, es[0].LastVisibleVersion())
+
+	err = s.HideVersion(id, 1, false)
+	require.NoError(t, err)
+	e, err = s.Effect(id)
+	require.NoError(t, err)
+	require.Equal(t, 1, e.LastVisibleVersion())
+
+	err = s.HideVersion(id, 2, true)
+	require.Equal(t, ErrNotFound, err)
+	err = s.HideVersion(id+1, 0, true)
+	require.Equal(t, ErrNotFound, err)
+}
+
+func testDelete(t *testing.T, s *Effects) {
+	id, err := s.Add(-1, -1, "user", "first", Submitter{})
+	require.NoError(t, err)
+	fork, err := s.Add(id, 0, "user", "fork", Submitter{})
+	require.NoError(t, err)
+
+	err = s.Delete(id)
+	require.NoError(t, err)
+	err = s.Delete(id)
+	require.Equal(t, ErrNotFound, err)
+
+	e, err := s.Effect(id)
+	require.NoError(t, err)
+	require.True(t, e.Deleted())
+
+	es, err := s.Page(0, 10, true)
+	require.NoError(t, err)
+	require.Len(t, es, 1)
+	require.Equal(t, fork, es[0].ID)
+
+	es, err = s.PageSiblings(0, 10, id)
+	require.NoError(t, err)
+	require.Len(t, es, 1)
+
+	es, err = s.Deleted(0, 10)
+	require.NoError(t, err)
+	require.Len(t, es, 1)
+	require.Equal(t, id, es[0].ID)
+
+	_, err = s.AddVersion(id, "second", Submitter{})
+	require.Equal(t, ErrNotFound, err)
+
+	err = s.Restore(id)
+	require.NoError(t, err)
+	err = s.Restore(id)
+	require.Equal(t, ErrNotFound, err)
+
+	e, err = s.Effect(id)
+	require.NoError(t, err)
+	require.False(t, e.Deleted())
+	_, err = s.AddVersion(id, "second", Submitter{})
+	require.NoError(t, err)
+
+	err = s.Delete(id)
+	require.NoError(t, err)
+
+	ids, err := s.Purge(time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	require.Empty(t, ids)
+
+	ids, err = s.Purge(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, []int{id}, ids)
+
+	_, err = s.Effect(id)
+	require.Error(t, err)
+	versions, err := s.versions(id)
+	require.NoError(t, err)
+	require.Empty(t, versions)
+
+	e, err = s.Effect(fork)
+	require.NoError(t, err)
+	require.Len(t, e.Versions, 1)
+}
+
+func testLock(t *testing.T, s *Effects) {
+	id, err := s.Add(-1, -1, "user", "first", Submitter{})
+	require.NoError(t, err)
+
+	err = s.Lock(id+1, true)
+	require.Equal(t, ErrNotFound, err)
+
+	err = s.Lock(id, true)
+	require.NoError(t, err)
+
+	e, err := s.Effect(id)
+	require.NoError(t, err)
+	require.True(t, e.Locked)
+
+	_, err = s.AddVersion(id, "second", Submitter{})
+	require.Equal(t, ErrLocked, err)
+
+	fork, err := s.Add(id, 0, "other", "fork", Submitter{})
+	require.NoError(t, err)
+	e, err = s.Effect(fork)
+	require.NoError(t, err)
+	require.False(t, e.Locked)
+
+	err = s.Lock(id, false)
+	require.NoError(t, err)
+	v, err := s.AddVersion(id, "second", Submitter{})
+	require.NoError(t, err)
+	require.Equal(t, 1, v)
+}
+
+func testList(t *testing.T, s *Effects) {
+	first, err := s.Add(-1, -1, "user", "first", Submitter{})
+	require.NoError(t, err)
+	second, err := s.Add(-1, -1, "other", "second", Submitter{})
+	require.NoError(t, err)
+	third, err := s.Add(-1, -1, "user", "third", Submitter{})
+	require.NoError(t, err)
+	deleted, err := s.Add(-1, -1, "user", "deleted", Submitter{})
+	require.NoError(t, err)
+	require.NoError(t, s.Hide(third, true))
+	require.NoError(t, s.Delete(deleted))
+
+	ids := func(es []Effect) []int {
+		var r []int
+		for _, e := range es {
+			r = append(r, e.ID)
+		}
+		return r
+	}
+
+	es, err := s.List(ListOptions{}, 0, 10)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []int{first, second, third}, ids(es))
+	require.Len(t, es[0].Versions, 1)
+
+	es, err = s.List(ListOptions{User: "user"}, 0, 10)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []int{first, third}, ids(es))
+
+	es, err = s.List(ListOptions{User: "user", Hidden: true}, 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, []int{third}, ids(es))
+
+	es, err = s.List(ListOptions{Since: time.Now().Add(time.Hour)}, 0, 10)
+	require.NoError(t, err)
+	require.Empty(t, es)
+
+	es, err = s.List(ListOptions{}, 1, 2)
+	require.NoError(t, err)
+	require.Len(t, es, 1)
+}
+
+func testSetParent(t *testing.T, s *Effects) {
+	root, err := s.Add(-1, -1, "user", "root", Submitter{})
+	require.NoError(t, err)
+	_, err = s.AddVersion(root, "root 1", Submitter{})
+	require.NoError(t, err)
+	child, err := s.Add(-1, -1, "user", "child", Submitter{})
+	require.NoError(t, err)
+	grandchild, err := s.Add(child, 0, "user", "grandchild", Submitter{})
+	require.NoError(t, err)
+
+	err = s.SetParent(child, root, 1)
+	require.NoError(t, err)
+	e, err := s.Effect(child)
+	require.NoError(t, err)
+	require.Equal(t, root, e.Parent)
+	require.Equal(t, 1, e.ParentVersion)
+
+	err = s.SetParent(child, root, 2)
+	require.True(t, errors.Is(err, ErrInvalid))
+	err = s.SetParent(child, 100, 0)
+	require.True(t, errors.Is(err, ErrInvalid))
+	err = s.SetParent(100, root, 0)
+	require.Equal(t, ErrNotFound, err)
+	err = s.SetParent(root, grandchild, 0)
+	require.True(t, errors.Is(err, ErrInvalid))
+	err = s.SetParent(child, child, 0)
+	require.True(t, errors.Is(err, ErrInvalid))
+
+	err = s.SetParent(child, -1, 0)
+	require.NoError(t, err)
+	e, err = s.Effect(child)
+	require.NoError(t, err)
+	require.Equal(t, -1, e.Parent)
+	require.Equal(t, -1, e.ParentVersion)
+
+	changes, err := s.Changes(0, 100)
+	require.NoError(t, err)
+	last := changes[len(changes)-1]
+	require.Equal(t, ChangeParent, last.Kind)
+	require.Equal(t, child, last.Effect)
+}
+
+func testSpam(t *testing.T, s *Effects) {
+	sub := Submitter{Fingerprint: "fingerprint"}
+	id, err := s.Add(-1, -1, "user", "code", sub)
+	require.NoError(t, err)
+	_, err = s.Add(-1, -1, "user", "code", Submitter{})
+	require.NoError(t, err)
+	_, err = s.AddVersion(id, "other", sub)
+	require.NoError(t, err)
+
+	n, err := s.CountCode(CodeHash("code"))
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	n, err = s.CountCode(CodeHash("missing"))
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	n, err = s.CountSubmitter("fingerprint", time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	n, err = s.CountSubmitter("fingerprint", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	n, err = s.CountSubmitter("", time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	err = s.SetSpam(id, 1, 60, []string{"duplicate", "blank"})
+	require.NoError(t, err)
+	err = s.SetSpam(id, 2, 60, nil)
+	require.Equal(t, ErrNotFound, err)
+
+	e, err := s.Effect(id)
+	require.NoError(t, err)
+	require.Equal(t, 0, e.Versions[0].SpamScore)
+	require.Empty(t, e.Versions[0].SpamReasons)
+	require.Equal(t, 60, e.Versions[1].SpamScore)
+	require.Equal(t, []string{"duplicate", "blank"}, e.Versions[1].SpamReasons)
+
+	es, err := s.Reviews(0, 10)
+	require.NoError(t, err)
+	require.Empty(t, es)
+
+	err = s.Review(id, true)
+	require.NoError(t, err)
+	es, err = s.Reviews(0, 10)
+	require.NoError(t, err)
+	require.Len(t, es, 1)
+	require.Equal(t, id, es[0].ID)
+	require.True(t, es[0].Review)
+
+	err = s.Review(id, false)
+	require.NoError(t, err)
+	es, err = s.Reviews(0, 10)
+	require.NoError(t, err)
+	require.Empty(t, es)
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"time"
+)
+
+const exportBatch = 100
+
+const (
+	sqlSelectEffectsExport = `
+SELECT * FROM effects
+	WHERE id > ? AND
+		deleted_at IS NULL AND
+		(? OR hidden = 0) AND
+		modified_at >= ?
+	ORDER BY id
+	LIMIT ?
+`
+)
+
+// ExportOptions selects the effects written by Export.
+type ExportOptions struct {
+	// Since exports only the effects modified from this time.
+	Since time.Time
+	// Hidden also exports hidden effects and the code of hidden versions.
+	Hidden bool
+}
+
+// NewJSONDate converts a time into a BSON dump date.
+func NewJSONDate(t time.Time) JSONDate {
+	return JSONDate{Date: t.UnixMilli()}
+}
+
+// ConvertJSON converts an Effect into the BSON dump structure.
+func ConvertJSON(e Effect) JSONEffect {
+	j := JSONEffect{
+		ID:            e.ID,
+		CreatedAt:     NewJSONDate(e.CreatedAt),
+		ImageURL:      path.Join("/thumbs", e.ImageName()),
+		ModifiedAt:    NewJSONDate(e.ModifiedAt),
+		Parent:        e.Parent,
+		ParentVersion: e.ParentVersion,
+		User:          e.User,
+		Hidden:        e.Hidden,
+		Versions:      make([]JSONVersion, 0, len(e.Versions)),
+	}
+
+	for _, v := range e.Versions {
+		j.Versions = append(j.Versions, JSONVersion{
+			CreatedAt: NewJSONDate(v.CreatedAt),
+			Code:      v.Code,
+			Hidden:    v.Hidden,
+		})
+	}
+
+	return j
+}
+
+// Export writes the effects of a store as a BSON dump that can be read by
+// Import and returns the number of effects written. Deleted effects are
+// never exported. Unless hidden ones are requested hidden versions are
+// written without code so version numbers are kept.
+func Export(w io.Writer, s *Effects, opts ExportOptions) (int, error) {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+
+	count := 0
+	last := 0
+	for {
+		effects, err := s.page(sqlSelectEffectsExport, []interface{}{
+			last, opts.Hidden, sqlTime(opts.Since), exportBatch,
+		})
+		if err != nil {
+			return count, err
+		}
+
+		for _, e := range effects {
+			if !opts.Hidden {
+				for i := range e.Versions {
+					if e.Versions[i].Hidden {
+						e.Versions[i].Code = ""
+					}
+				}
+			}
+
+			err = enc.Encode(ConvertJSON(e))
+			if err != nil {
+				return count, fmt.Errorf("could not write effect %d: %w", e.ID, err)
+			}
+			count++
+			last = e.ID
+		}
+
+		if len(effects) < exportBatch {
+			return count, nil
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+func exportEffects() []Effect {
+	t := time.Date(2022, time.March, 1, 10, 20, 30, 123000000, time.UTC)
+	return []Effect{
+		{
+			ID:            1,
+			CreatedAt:     t,
+			ModifiedAt:    t.Add(time.Hour),
+			Parent:        -1,
+			ParentVersion: -1,
+			User:          "user",
+			Versions: []Version{
+				{CreatedAt: t, Code: "first <code> & more"},
+				{CreatedAt: t.Add(time.Minute), Code: "moderated", Hidden: true},
+				{CreatedAt: t.Add(time.Hour), Code: "third"},
+			},
+		},
+		{
+			ID:            5,
+			CreatedAt:     t.Add(24 * time.Hour),
+			ModifiedAt:    t.Add(24 * time.Hour),
+			Parent:        1,
+			ParentVersion: 2,
+			User:          "fork",
+			Versions: []Version{
+				{CreatedAt: t.Add(24 * time.Hour), Code: "fork"},
+			},
+		},
+		{
+			ID:            7,
+			CreatedAt:     t.Add(48 * time.Hour),
+			ModifiedAt:    t.Add(48 * time.Hour),
+			Parent:        -1,
+			ParentVersion: -1,
+			User:          "hidden",
+			Hidden:        true,
+			Versions: []Version{
+				{CreatedAt: t.Add(48 * time.Hour), Code: "hidden"},
+			},
+		},
+	}
+}
+
+func TestExport(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName, testDatabase)
+	require.NoError(t, err)
+	s, err := NewEffects(db)
+	require.NoError(t, err)
+
+	effects := exportEffects()
+	for _, e := range effects {
+		require.NoError(t, s.AddEffect(e))
+	}
+	deleted, err := s.Add(-1, -1, "deleted", "deleted", Submitter{})
+	require.NoError(t, err)
+	require.NoError(t, s.Delete(deleted))
+
+	var buf bytes.Buffer
+	n, err := Export(&buf, s, ExportOptions{Hidden: true})
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	line := strings.SplitN(buf.String(), "\n", 2)[0]
+	var j JSONEffect
+	require.NoError(t, json.Unmarshal([]byte(line), &j))
+	require.Equal(t, "/thumbs/1.png", j.ImageURL)
+	require.Contains(t, line, "first <code> & more")
+
+	db, err = sqlx.Connect(sqliteshim.ShimName, testDatabase)
+	require.NoError(t, err)
+	imported, err := NewEffects(db)
+	require.NoError(t, err)
+	require.NoError(t, Import(&buf, imported))
+
+	for _, e := range effects {
+		i, err := imported.Effect(e.ID)
+		require.NoError(t, err)
+
+		require.True(t, e.CreatedAt.Equal(i.CreatedAt))
+		require.True(t, e.ModifiedAt.Equal(i.ModifiedAt))
+		require.Equal(t, e.Parent, i.Parent)
+		require.Equal(t, e.ParentVersion, i.ParentVersion)
+		require.Equal(t, e.User, i.User)
+		require.Equal(t, e.Hidden, i.Hidden)
+		require.Len(t, i.Versions, len(e.Versions))
+		for k, v := range e.Versions {
+			require.True(t, v.CreatedAt.Equal(i.Versions[k].CreatedAt))
+			require.Equal(t, v.Code, i.Versions[k].Code)
+			require.Equal(t, CodeHash(v.Code), i.Versions[k].CodeHash)
+			require.Equal(t, v.Hidden, i.Versions[k].Hidden)
+		}
+	}
+	_, err = imported.Effect(deleted)
+	require.Error(t, err)
+
+	buf.Reset()
+	n, err = Export(&buf, s, ExportOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.NotContains(t, buf.String(), "moderated")
+	require.NotContains(t, buf.String(), `"user":"hidden"`)
+
+	buf.Reset()
+	n, err = Export(&buf, s, ExportOptions{
+		Since:  effects[1].ModifiedAt,
+		Hidden: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.NoError(t, json.Unmarshal(buf.Bytes()[:bytes.IndexByte(buf.Bytes(), '\n')], &j))
+	require.Equal(t, 5, j.ID)
+}
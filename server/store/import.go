@@ -2,9 +2,21 @@ package store
 
 import (
 	"bufio"
+	"bytes"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
 	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mrdoob/glsl-sandbox/server/thumb"
 )
 
 // JSONEffect contains the BSON dump structure.
@@ -20,9 +32,32 @@ type JSONEffect struct {
 	Versions      []JSONVersion `json:"versions"`
 }
 
+// UnmarshalJSON also reads the integer fields as Extended JSON number
+// wrappers.
+func (j *JSONEffect) UnmarshalJSON(b []byte) error {
+	type plain JSONEffect
+	var e struct {
+		plain
+		ID            JSONInt `json:"_id"`
+		Parent        JSONInt `json:"parent"`
+		ParentVersion JSONInt `json:"parent_version"`
+	}
+	err := json.Unmarshal(b, &e)
+	if err != nil {
+		return err
+	}
+
+	*j = JSONEffect(e.plain)
+	j.ID = int(e.ID)
+	j.Parent = int(e.Parent)
+	j.ParentVersion = int(e.ParentVersion)
+	return nil
+}
+
 type JSONVersion struct {
 	CreatedAt JSONDate `json:"created_at"`
 	Code      string   `json:"code"`
+	Hidden    bool     `json:"hidden,omitempty"`
 }
 
 type JSONDate struct {
@@ -35,6 +70,96 @@ func (j JSONDate) Time() time.Time {
 	return time.Unix(seconds, milis*1000000)
 }
 
+// JSONInt is an integer that can also be read from Extended JSON number
+// wrappers like {"$numberLong": "1"}.
+type JSONInt int
+
+func (j *JSONInt) UnmarshalJSON(b []byte) error {
+	i, err := jsonInt64(b)
+	if err != nil {
+		return err
+	}
+	*j = JSONInt(i)
+	return nil
+}
+
+// jsonInt64 reads a JSON number or an Extended JSON number wrapper.
+func jsonInt64(b []byte) (int64, error) {
+	var wrapper struct {
+		Int    *string `json:"$numberInt"`
+		Long   *string `json:"$numberLong"`
+		Double *string `json:"$numberDouble"`
+	}
+
+	var number json.Number
+	switch {
+	case bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")):
+		err := json.Unmarshal(b, &wrapper)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case wrapper.Int != nil:
+			number = json.Number(*wrapper.Int)
+		case wrapper.Long != nil:
+			number = json.Number(*wrapper.Long)
+		case wrapper.Double != nil:
+			number = json.Number(*wrapper.Double)
+		default:
+			return 0, fmt.Errorf("malformed number %s", b)
+		}
+	case bytes.Equal(b, []byte("null")):
+		return 0, nil
+	default:
+		err := json.Unmarshal(b, &number)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	i, err := number.Int64()
+	if err != nil {
+		f, ferr := number.Float64()
+		if ferr != nil || f != math.Trunc(f) {
+			return 0, fmt.Errorf("malformed integer %s", number)
+		}
+		i = int64(f)
+	}
+
+	return i, nil
+}
+
+// UnmarshalJSON reads the date in milliseconds, as a
+// {"$numberLong": "..."} wrapper or as an ISO 8601 string.
+func (j *JSONDate) UnmarshalJSON(b []byte) error {
+	var date struct {
+		Date json.RawMessage `json:"$date"`
+	}
+	err := json.Unmarshal(b, &date)
+	if err != nil {
+		return err
+	}
+	if len(date.Date) == 0 {
+		return nil
+	}
+
+	var iso string
+	if json.Unmarshal(date.Date, &iso) == nil {
+		t, err := time.Parse(time.RFC3339Nano, iso)
+		if err != nil {
+			return fmt.Errorf("malformed date: %w", err)
+		}
+		j.Date = t.UnixMilli()
+		return nil
+	}
+
+	j.Date, err = jsonInt64(date.Date)
+	if err != nil {
+		return fmt.Errorf("malformed date: %w", err)
+	}
+	return nil
+}
+
 // Convert a BSON struct into Effect.
 func Convert(j JSONEffect) Effect {
 	e := Effect{
@@ -57,35 +182,623 @@ func Convert(j JSONEffect) Effect {
 		e.Versions = append(e.Versions, Version{
 			CreatedAt: v.CreatedAt.Time(),
 			Code:      v.Code,
+			Hidden:    v.Hidden,
 		})
 	}
 
 	return e
 }
 
-// Import a BSON dump to a store.
+// Conflict is the policy used when an imported effect ID already exists.
+type Conflict string
+
+const (
+	// ConflictSkip keeps the stored effect.
+	ConflictSkip Conflict = "skip"
+	// ConflictOverwrite replaces the stored effect with the imported one.
+	ConflictOverwrite Conflict = "overwrite"
+	// ConflictRenumber stores the imported effect with the next free ID,
+	// which can make later effects of the dump conflict too. Forks of
+	// effects renumbered in the same import, including resumed ones,
+	// point to the new ID.
+	ConflictRenumber Conflict = "renumber"
+
+	importBatch   = 1000
+	importMaxLine = 64 * 1024 * 1024
+)
+
+const (
+	sqlCreateImports = `
+CREATE TABLE IF NOT EXISTS imports (
+	name TEXT PRIMARY KEY,
+	line INTEGER,
+	offset INTEGER,
+	updated_at TIMESTAMP
+)
+`
+
+	sqlCreateImportRenumbered = `
+CREATE TABLE IF NOT EXISTS import_renumbered (
+	name TEXT,
+	source INTEGER,
+	id INTEGER,
+	PRIMARY KEY (name, source)
+)
+`
+
+	sqlSelectImport = `
+SELECT line, offset FROM imports
+	WHERE name = ?
+`
+
+	sqlUpsertImport = `
+INSERT INTO imports (name, line, offset, updated_at)
+	VALUES(?, ?, ?, ?)
+	ON CONFLICT(name) DO UPDATE
+		SET line = excluded.line,
+			offset = excluded.offset,
+			updated_at = excluded.updated_at
+`
+
+	sqlDeleteImport = `
+DELETE FROM imports
+	WHERE name = ?
+`
+
+	sqlSelectImportRenumbered = `
+SELECT source, id FROM import_renumbered
+	WHERE name = ?
+`
+
+	sqlUpsertImportRenumbered = `
+INSERT INTO import_renumbered (name, source, id)
+	VALUES(?, ?, ?)
+	ON CONFLICT(name, source) DO UPDATE
+		SET id = excluded.id
+`
+
+	sqlDeleteImportRenumbered = `
+DELETE FROM import_renumbered
+	WHERE name = ?
+`
+
+	sqlSelectEffectExists = `
+SELECT COUNT(*) FROM effects
+	WHERE id = ?
+`
+)
+
+// ImportOptions configures ImportWith.
+type ImportOptions struct {
+	// Batch is the number of effects stored in each transaction.
+	Batch int
+	// Conflict is the policy for effects with an ID already stored. It
+	// defaults to ConflictSkip.
+	Conflict Conflict
+	// Checkpoint names the saved position of the import. When set, the
+	// position and the IDs renumbered in the batch are saved with each
+	// batch and an import with the same checkpoint continues after the last
+	// stored batch. Use CheckpointName to get it from a file path.
+	Checkpoint string
+	// Progress is called after each batch is stored.
+	Progress func(ImportStats)
+	// Error is called for each line that could not be imported.
+	Error func(ImportError)
+	// Thumbs is where the thumbnails of the imported effects are copied.
+	// They are read from the ThumbsSource directory using the file name of
+	// the image_url of each effect.
+	Thumbs       *thumb.Thumbs
+	ThumbsSource string
+	// MissingThumb is called for each imported effect without a valid
+	// thumbnail in ThumbsSource.
+	MissingThumb func(ImportError)
+	// ThumbsOnly stores no effects and copies the thumbnails of the
+	// effects of the dump already stored that have none. The IDs
+	// renumbered by the import saved in Checkpoint are used but its
+	// position is not read or changed.
+	ThumbsOnly bool
+}
+
+// ImportStats has the counters of an import.
+type ImportStats struct {
+	// Line is the number of the last line or BSON document read.
+	Line int
+	// Imported is the number of effects stored with their ID.
+	Imported int
+	// Overwritten is the number of stored effects replaced.
+	Overwritten int
+	// Renumbered is the number of effects stored with a new ID.
+	Renumbered int
+	// Skipped is the number of effects already stored and not imported.
+	Skipped int
+	// Failed is the number of lines with errors.
+	Failed int
+	// Thumbs is the number of thumbnails copied.
+	Thumbs int
+	// MissingThumbs is the number of effects without a valid thumbnail.
+	MissingThumbs int
+}
+
+// ImportError is an error in a line of the dump.
+type ImportError struct {
+	Line int
+	Err  error
+}
+
+func (e ImportError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err.Error())
+}
+
+func (e ImportError) Unwrap() error {
+	return e.Err
+}
+
+// Import a BSON dump to a store. Effects already stored are skipped. It
+// returns the first line error if any line could not be imported.
 func Import(r io.Reader, s *Effects) error {
-	sb := make([]byte, 16*1024*1024) // initial line buffer of 16 Mb
-	scanner := bufio.NewScanner(r)
-	scanner.Buffer(sb, 64*1024*1024)
+	var first error
+	stats, err := ImportWith(r, s, ImportOptions{
+		Error: func(e ImportError) {
+			if first == nil {
+				first = e
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if first != nil {
+		return fmt.Errorf("could not import %d lines: %w", stats.Failed, first)
+	}
 
-	var j JSONEffect
-	for scanner.Scan() {
-		b := scanner.Bytes()
-		if len(b) < 3 {
-			continue
+	return nil
+}
+
+// ImportWith imports a BSON dump to a store in batches. The dump can be
+// Extended JSON lines or the BSON documents written by mongodump, the
+// format is detected from its first bytes. Malformed lines are reported and
+// skipped.
+func ImportWith(r io.Reader, s *Effects, opts ImportOptions) (ImportStats, error) {
+	if opts.Batch < 1 {
+		opts.Batch = importBatch
+	}
+	switch opts.Conflict {
+	case "":
+		opts.Conflict = ConflictSkip
+	case ConflictSkip, ConflictOverwrite, ConflictRenumber:
+	default:
+		return ImportStats{}, fmt.Errorf("unknown conflict policy %q", opts.Conflict)
+	}
+	if opts.ThumbsOnly && opts.Thumbs == nil {
+		return ImportStats{}, fmt.Errorf("thumbnails only import without thumbnails directory")
+	}
+
+	var stats ImportStats
+	var offset int64
+	renumbered := make(map[int]int)
+	if opts.Checkpoint != "" {
+		line, position, err := s.importPosition(opts.Checkpoint, renumbered)
+		if err != nil {
+			return stats, err
+		}
+		if !opts.ThumbsOnly {
+			stats.Line, offset = line, position
+			err = skipTo(r, offset)
+			if err != nil {
+				return stats, err
+			}
 		}
+	}
 
-		err := json.Unmarshal(b, &j)
+	type line struct {
+		num int
+		// id is the effect ID in the dump
+		id     int
+		effect Effect
+		image  string
+	}
+
+	reader := bufio.NewReaderSize(r, 1024*1024)
+	var batch []line
+	var batchEnd int64
+	// thumbs has the lines of the stored effects, their thumbnails are
+	// copied once the batch is committed
+	var thumbs []line
+
+	flush := func() error {
+		thumbs = thumbs[:0]
+		err := s.transaction(func(tx *sqlx.Tx) error {
+			for _, l := range batch {
+				var id int
+				var err error
+				if opts.ThumbsOnly {
+					id, err = missingThumb(tx, l.effect.ID, opts.Thumbs, renumbered, &stats)
+				} else {
+					before := stats.Renumbered
+					id, err = importEffect(tx, l.effect, opts.Conflict, s.DeltaSnapshots, renumbered, &stats)
+					if err == nil && opts.Checkpoint != "" && stats.Renumbered > before {
+						_, err = tx.Exec(sqlUpsertImportRenumbered, opts.Checkpoint, l.id, id)
+						if err != nil {
+							err = fmt.Errorf("could not save renumbered effect: %w", err)
+						}
+					}
+				}
+				if err != nil {
+					return fmt.Errorf("line %d: %w", l.num, err)
+				}
+
+				if id > 0 && opts.Thumbs != nil {
+					l.effect.ID = id
+					thumbs = append(thumbs, l)
+				}
+			}
+
+			if opts.Checkpoint == "" || opts.ThumbsOnly {
+				return nil
+			}
+			_, err := tx.Exec(sqlUpsertImport,
+				opts.Checkpoint, stats.Line, batchEnd, time.Now())
+			if err != nil {
+				return fmt.Errorf("could not save import checkpoint: %w", err)
+			}
+			return nil
+		})
 		if err != nil {
 			return err
 		}
 
-		err = s.AddEffect(Convert(j))
+		for _, l := range thumbs {
+			err = importThumb(opts, l.num, l.id, l.effect.ID, l.image, &stats)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", l.num, err)
+			}
+		}
+
+		batch = batch[:0]
+		if opts.Progress != nil {
+			opts.Progress(stats)
+		}
+		return nil
+	}
+
+	bson := isBSON(reader)
+	for {
+		var b []byte
+		var n int64
+		var err error
+		var lerr error
+		if bson {
+			b, err = readBSON(reader)
+			n = int64(len(b))
+		} else {
+			b, n, err = readLine(reader, importMaxLine)
+			if errors.Is(err, errLineTooLong) {
+				lerr = err
+				err = nil
+			}
+		}
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			return err
+			return stats, fmt.Errorf("could not read line %d: %w", stats.Line+1, err)
+		}
+
+		stats.Line++
+		offset += n
+
+		if lerr != nil || bson || len(bytes.TrimSpace(b)) >= 3 {
+			var j JSONEffect
+			if lerr == nil {
+				j, lerr = decodeEffect(b, bson)
+			}
+			if lerr != nil {
+				stats.Failed++
+				if opts.Error != nil {
+					opts.Error(ImportError{Line: stats.Line, Err: lerr})
+				}
+			} else {
+				batch = append(batch, line{
+					num:    stats.Line,
+					id:     j.ID,
+					effect: Convert(j),
+					image:  j.ImageURL,
+				})
+			}
 		}
+
+		batchEnd = offset
+		if len(batch) >= opts.Batch {
+			err := flush()
+			if err != nil {
+				return stats, err
+			}
+		}
+
+	}
+
+	return stats, flush()
+}
+
+var errLineTooLong = errors.New("line too long")
+
+// readLine reads a line keeping at most max bytes in memory. It also
+// returns the number of bytes consumed. Longer lines are discarded and
+// return errLineTooLong.
+func readLine(r *bufio.Reader, max int) ([]byte, int64, error) {
+	var line []byte
+	var n int64
+	for {
+		chunk, err := r.ReadSlice('\n')
+		n += int64(len(chunk))
+		if n <= int64(max) {
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		if err == nil && n > int64(max) {
+			return nil, n, errLineTooLong
+		}
+		return line, n, err
+	}
+}
+
+// decodeEffect reads an effect from a JSON line or a BSON document.
+func decodeEffect(b []byte, bson bool) (JSONEffect, error) {
+	var j JSONEffect
+	if bson {
+		var err error
+		b, err = bsonToJSON(b)
+		if err != nil {
+			return j, err
+		}
+	}
+
+	err := json.Unmarshal(b, &j)
+	if err != nil {
+		return j, err
+	}
+	if j.ID < 1 {
+		return j, fmt.Errorf("malformed effect id %d", j.ID)
+	}
+
+	return j, nil
+}
+
+// ResetImport removes the saved position and renumbered IDs of an import
+// so it starts from the beginning.
+func (s *Effects) ResetImport(checkpoint string) error {
+	return s.transaction(func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(sqlDeleteImport, checkpoint)
+		if err != nil {
+			return fmt.Errorf("could not reset import checkpoint: %w", err)
+		}
+		_, err = tx.Exec(sqlDeleteImportRenumbered, checkpoint)
+		if err != nil {
+			return fmt.Errorf("could not reset renumbered effects: %w", err)
+		}
+		return nil
+	})
+}
+
+// CheckpointName returns the checkpoint name of an import file, its
+// absolute path, so the same file resumes the same import from any
+// directory.
+func CheckpointName(file string) (string, error) {
+	name, err := filepath.Abs(file)
+	if err != nil {
+		return "", fmt.Errorf("malformed file path: %w", err)
+	}
+	return name, nil
+}
+
+// importPosition returns the line and byte offset saved for an import and
+// loads the IDs renumbered before them.
+func (s *Effects) importPosition(checkpoint string, renumbered map[int]int) (int, int64, error) {
+	var line int
+	var offset int64
+	err := s.db.QueryRow(sqlSelectImport, checkpoint).Scan(&line, &offset)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not get import checkpoint: %w", err)
 	}
 
+	rows, err := s.db.Query(sqlSelectImportRenumbered, checkpoint)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not get renumbered effects: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var source, id int
+		err = rows.Scan(&source, &id)
+		if err != nil {
+			return 0, 0, fmt.Errorf("could not read renumbered effect: %w", err)
+		}
+		renumbered[source] = id
+	}
+	if err = rows.Err(); err != nil {
+		return 0, 0, fmt.Errorf("could not read renumbered effects: %w", err)
+	}
+
+	return line, offset, nil
+}
+
+// skipTo moves the reader to a byte offset, seeking when possible.
+func skipTo(r io.Reader, offset int64) error {
+	if offset == 0 {
+		return nil
+	}
+
+	if seeker, ok := r.(io.Seeker); ok {
+		_, err := seeker.Seek(offset, io.SeekStart)
+		if err != nil {
+			return fmt.Errorf("could not seek to checkpoint: %w", err)
+		}
+		return nil
+	}
+
+	_, err := io.CopyN(io.Discard, r, offset)
+	if err != nil {
+		return fmt.Errorf("could not skip to checkpoint: %w", err)
+	}
 	return nil
 }
+
+// importEffect stores an imported effect following the conflict policy. It
+// returns the ID used to store the effect or 0 when it was skipped.
+func importEffect(
+	tx *sqlx.Tx,
+	e Effect,
+	conflict Conflict,
+	snapshots int,
+	renumbered map[int]int,
+	stats *ImportStats,
+) (int, error) {
+	if id, ok := renumbered[e.Parent]; ok {
+		e.Parent = id
+	}
+
+	var exists int
+	err := tx.Get(&exists, sqlSelectEffectExists, e.ID)
+	if err != nil {
+		return 0, fmt.Errorf("could not check effect: %w", err)
+	}
+
+	if exists == 0 {
+		stats.Imported++
+		return e.ID, addEffect(tx, e, snapshots)
+	}
+
+	switch conflict {
+	case ConflictOverwrite:
+		stats.Overwritten++
+		return e.ID, putEffect(tx, e, snapshots)
+
+	case ConflictRenumber:
+		r, err := tx.NamedExec(sqlInsertEffect, sqliteFromEffect(e))
+		if err != nil {
+			return 0, fmt.Errorf("could not insert effect: %w", err)
+		}
+		id, err := r.LastInsertId()
+		if err != nil {
+			return 0, fmt.Errorf("could not get effect id: %w", err)
+		}
+
+		renumbered[e.ID] = int(id)
+		e.ID = int(id)
+		err = insertVersions(tx, e, snapshots)
+		if err != nil {
+			return 0, err
+		}
+
+		stats.Renumbered++
+		return e.ID, addChange(tx, Change{
+			Kind:      ChangeCreated,
+			Effect:    e.ID,
+			User:      e.User,
+			CreatedAt: e.CreatedAt,
+		})
+
+	default:
+		stats.Skipped++
+		return 0, nil
+	}
+}
+
+// missingThumb returns the stored ID of an effect of the dump without a
+// thumbnail, or 0 when it is not stored or already has one.
+func missingThumb(
+	tx *sqlx.Tx,
+	id int,
+	thumbs *thumb.Thumbs,
+	renumbered map[int]int,
+	stats *ImportStats,
+) (int, error) {
+	if r, ok := renumbered[id]; ok {
+		id = r
+	}
+
+	var exists int
+	err := tx.Get(&exists, sqlSelectEffectExists, id)
+	if err != nil {
+		return 0, fmt.Errorf("could not check effect: %w", err)
+	}
+	if exists == 0 {
+		stats.Skipped++
+		return 0, nil
+	}
+
+	_, err = os.Stat(filepath.Join(thumbs.Path(), Effect{ID: id}.ImageName()))
+	if err == nil {
+		stats.Skipped++
+		return 0, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("could not check thumbnail: %w", err)
+	}
+
+	return id, nil
+}
+
+// importThumb copies the thumbnail of an imported effect normalized like
+// uploaded ones. Missing and invalid thumbnails are reported and do not
+// stop the import.
+func importThumb(
+	opts ImportOptions,
+	line int,
+	source int,
+	id int,
+	imageURL string,
+	stats *ImportStats,
+) error {
+	name := thumbName(imageURL, source)
+	p := filepath.Join(opts.ThumbsSource, name)
+	info, err := os.Stat(p)
+	if err == nil && info.Size() > thumb.MaxBytes {
+		err = fmt.Errorf("file too big")
+	}
+	var data []byte
+	if err == nil {
+		data, err = os.ReadFile(p)
+	}
+	if err == nil {
+		data, err = thumb.Normalize(data)
+	}
+	if err != nil {
+		stats.MissingThumbs++
+		if opts.MissingThumb != nil {
+			opts.MissingThumb(ImportError{
+				Line: line,
+				Err:  fmt.Errorf("effect %d thumbnail %s: %w", id, name, err),
+			})
+		}
+		return nil
+	}
+
+	err = opts.Thumbs.Save(Effect{ID: id}.ImageName(), data)
+	if err != nil {
+		return err
+	}
+	stats.Thumbs++
+	return nil
+}
+
+// thumbName returns the file name of a legacy thumbnail from its URL. When
+// the URL has no usable name the default name for the effect is used.
+func thumbName(imageURL string, id int) string {
+	u, err := url.Parse(imageURL)
+	if err == nil && imageURL != "" {
+		name := path.Base(u.Path)
+		if name != "." && name != "/" && name != ".." {
+			return name
+		}
+	}
+	return Effect{ID: id}.ImageName()
+}
@@ -0,0 +1,316 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mrdoob/glsl-sandbox/server/thumb"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+func dumpLine(id int, parent int, user string) string {
+	return fmt.Sprintf(`{"_id":%d,"created_at":{"$date":1374639571037},`+
+		`"modified_at":{"$date":1374639571037},"parent":%d,"parent_version":0,`+
+		`"user":%q,"versions":[{"created_at":{"$date":1374639571037},"code":"code %d"}]}`,
+		id, parent, user, id)
+}
+
+var importDump = strings.Join([]string{
+	dumpLine(1, 0, "one"),
+	`{"_id": 2, "broken`,
+	dumpLine(2, 1, "two"),
+	"",
+	dumpLine(3, 2, "three"),
+}, "\n") + "\n"
+
+func newImportStore(t *testing.T) *Effects {
+	db, err := sqlx.Connect(sqliteshim.ShimName, testDatabase)
+	require.NoError(t, err)
+	s, err := NewEffects(db)
+	require.NoError(t, err)
+
+	err = s.AddEffect(Effect{
+		ID:       2,
+		User:     "stored",
+		Versions: []Version{{Code: "stored"}},
+	})
+	require.NoError(t, err)
+	return s
+}
+
+func TestImportConflicts(t *testing.T) {
+	s := newImportStore(t)
+	var lines []int
+	var progress []ImportStats
+	stats, err := ImportWith(strings.NewReader(importDump), s, ImportOptions{
+		Batch: 2,
+		Error: func(e ImportError) {
+			lines = append(lines, e.Line)
+		},
+		Progress: func(p ImportStats) {
+			progress = append(progress, p)
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, ImportStats{Line: 5, Imported: 2, Skipped: 1, Failed: 1}, stats)
+	require.Equal(t, []int{2}, lines)
+	require.Len(t, progress, 2)
+	require.Equal(t, 3, progress[0].Line)
+
+	e, err := s.Effect(2)
+	require.NoError(t, err)
+	require.Equal(t, "stored", e.User)
+
+	s = newImportStore(t)
+	stats, err = ImportWith(strings.NewReader(importDump), s, ImportOptions{
+		Conflict: ConflictOverwrite,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.Overwritten)
+	e, err = s.Effect(2)
+	require.NoError(t, err)
+	require.Equal(t, "two", e.User)
+	require.Equal(t, "code 2", e.Versions[0].Code)
+
+	s = newImportStore(t)
+	stats, err = ImportWith(strings.NewReader(importDump), s, ImportOptions{
+		Conflict: ConflictRenumber,
+	})
+	require.NoError(t, err)
+	e, err = s.Effect(2)
+	require.NoError(t, err)
+	require.Equal(t, "stored", e.User)
+	// 2 takes the next free ID and pushes 3 to a new one too
+	require.Equal(t, 2, stats.Renumbered)
+	e, err = s.Effect(3)
+	require.NoError(t, err)
+	require.Equal(t, "two", e.User)
+	require.Equal(t, 1, e.Parent)
+	e, err = s.Effect(4)
+	require.NoError(t, err)
+	require.Equal(t, "three", e.User)
+	require.Equal(t, 3, e.Parent)
+
+	_, err = ImportWith(strings.NewReader(importDump), s, ImportOptions{
+		Conflict: "bad",
+	})
+	require.Error(t, err)
+
+	err = Import(strings.NewReader(importDump), newImportStore(t))
+	var ie ImportError
+	require.True(t, errors.As(err, &ie))
+	require.Equal(t, 2, ie.Line)
+}
+
+// failReader fails after reading n bytes.
+type failReader struct {
+	r io.Reader
+	n int
+}
+
+func (f *failReader) Read(p []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, errors.New("interrupted")
+	}
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= n
+	return n, err
+}
+
+func TestImportCheckpoint(t *testing.T) {
+	s := newImportStore(t)
+	opts := ImportOptions{
+		Batch:      1,
+		Checkpoint: "dump.json",
+	}
+
+	// interrupt in the middle of the fifth line
+	cut := strings.LastIndex(importDump, "three")
+	_, err := ImportWith(&failReader{
+		r: strings.NewReader(importDump),
+		n: cut,
+	}, s, opts)
+	require.Error(t, err)
+
+	_, err = s.Effect(3)
+	require.Error(t, err)
+
+	stats, err := ImportWith(strings.NewReader(importDump), s, opts)
+	require.NoError(t, err)
+	require.Equal(t, 5, stats.Line)
+	require.Equal(t, 1, stats.Imported)
+	require.Zero(t, stats.Failed)
+	e, err := s.Effect(3)
+	require.NoError(t, err)
+	require.Equal(t, "three", e.User)
+
+	stats, err = ImportWith(io.NopCloser(strings.NewReader(importDump)), s, opts)
+	require.NoError(t, err)
+	require.Equal(t, ImportStats{Line: 5}, stats)
+
+	require.NoError(t, s.ResetImport("dump.json"))
+	stats, err = ImportWith(strings.NewReader(importDump), s, opts)
+	require.NoError(t, err)
+	require.Equal(t, 3, stats.Skipped)
+	require.Equal(t, 1, stats.Failed)
+}
+
+func TestImportCheckpointRenumber(t *testing.T) {
+	s := newImportStore(t)
+	opts := ImportOptions{
+		Batch:      1,
+		Conflict:   ConflictRenumber,
+		Checkpoint: "dump.json",
+	}
+
+	first := dumpLine(2, 0, "two") + "\n"
+	dump := first + dumpLine(5, 2, "fork") + "\n"
+
+	// interrupt after storing the renumbered effect
+	_, err := ImportWith(&failReader{
+		r: strings.NewReader(dump),
+		n: len(first) + 10,
+	}, s, opts)
+	require.Error(t, err)
+
+	stats, err := ImportWith(strings.NewReader(dump), s, opts)
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.Imported)
+	e, err := s.Effect(5)
+	require.NoError(t, err)
+	require.Equal(t, 3, e.Parent)
+
+	// each mapping is stored once and goes with the checkpoint
+	var n int
+	require.NoError(t, s.db.Get(&n, "SELECT COUNT(*) FROM import_renumbered"))
+	require.Equal(t, 1, n)
+	require.NoError(t, s.ResetImport("dump.json"))
+	require.NoError(t, s.db.Get(&n, "SELECT COUNT(*) FROM import_renumbered"))
+	require.Zero(t, n)
+}
+
+func TestReadLine(t *testing.T) {
+	long := strings.Repeat("a", 100)
+	r := bufio.NewReaderSize(strings.NewReader(long+"\nshort\n"+long), 16)
+
+	_, n, err := readLine(r, 50)
+	require.ErrorIs(t, err, errLineTooLong)
+	require.Equal(t, int64(101), n)
+
+	line, n, err := readLine(r, 50)
+	require.NoError(t, err)
+	require.Equal(t, "short\n", string(line))
+	require.Equal(t, int64(6), n)
+
+	line, n, err = readLine(r, 200)
+	require.NoError(t, err)
+	require.Equal(t, long, string(line))
+	require.Equal(t, int64(100), n)
+
+	_, _, err = readLine(r, 200)
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestImportThumbs(t *testing.T) {
+	source := t.TempDir()
+	var img bytes.Buffer
+	require.NoError(t, png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 20, 10))))
+	normalized, err := thumb.Normalize(img.Bytes())
+	require.NoError(t, err)
+
+	files := map[string][]byte{
+		"1.png":      img.Bytes(),
+		"legacy.png": img.Bytes(),
+		"3.png":      []byte("not a png"),
+	}
+	for name, data := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(source, name), data, 0600))
+	}
+
+	line := func(id int, image string) string {
+		return fmt.Sprintf(`{"_id":%d,"image_url":%q,"user":"u","versions":[{"code":"c"}]}`,
+			id, image)
+	}
+	dump := strings.Join([]string{
+		line(1, "/thumbs/1.png"),
+		line(3, "/thumbs/3.png"),
+		line(4, "/thumbs/4.png"),
+		line(5, "/thumbs/1.png"),
+		line(2, "http://glslsandbox.com/thumbs/legacy.png"),
+	}, "\n")
+
+	s := newImportStore(t)
+	dest := t.TempDir()
+	thumbs, err := thumb.NewThumbs(dest)
+	require.NoError(t, err)
+
+	var missing []int
+	stats, err := ImportWith(strings.NewReader(dump), s, ImportOptions{
+		Conflict:     ConflictRenumber,
+		Checkpoint:   "dump.json",
+		Thumbs:       thumbs,
+		ThumbsSource: source,
+		MissingThumb: func(e ImportError) {
+			missing = append(missing, e.Line)
+		},
+	})
+	require.NoError(t, err)
+	require.Zero(t, stats.Failed)
+	require.Equal(t, 3, stats.Thumbs)
+	require.Equal(t, 2, stats.MissingThumbs)
+	require.Equal(t, []int{2, 3}, missing)
+
+	// 2 already exists and is renumbered to 6
+	for _, name := range []string{"1.png", "6.png", "5.png"} {
+		data, err := os.ReadFile(filepath.Join(dest, name))
+		require.NoError(t, err, name)
+		require.Equal(t, normalized, data)
+	}
+	for _, name := range []string{"2.png", "3.png", "4.png"} {
+		_, err := os.Stat(filepath.Join(dest, name))
+		require.True(t, os.IsNotExist(err), name)
+	}
+
+	// copy the thumbnail added to the source after the import
+	require.NoError(t, os.WriteFile(filepath.Join(source, "4.png"), img.Bytes(), 0600))
+	stats, err = ImportWith(strings.NewReader(dump), s, ImportOptions{
+		Checkpoint:   "dump.json",
+		Thumbs:       thumbs,
+		ThumbsSource: source,
+		ThumbsOnly:   true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, ImportStats{
+		Line:          5,
+		Skipped:       3,
+		Thumbs:        1,
+		MissingThumbs: 1,
+	}, stats)
+	_, err = os.Stat(filepath.Join(dest, "4.png"))
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dest, "2.png"))
+	require.True(t, os.IsNotExist(err))
+
+	// the position of the import is kept
+	pos, _, err := s.importPosition("dump.json", map[int]int{})
+	require.NoError(t, err)
+	require.Equal(t, 5, pos)
+
+	require.Equal(t, "legacy.png", thumbName("legacy.png", 7))
+	require.Equal(t, "7.png", thumbName("", 7))
+	require.Equal(t, "7.png", thumbName("/thumbs/..", 7))
+}
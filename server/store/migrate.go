@@ -0,0 +1,106 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	sqlCreateMigrations = `
+CREATE TABLE IF NOT EXISTS migrations (
+	name TEXT PRIMARY KEY,
+	created_at TIMESTAMP
+)
+`
+
+	sqlSelectMigration = `
+SELECT COUNT(*) FROM migrations
+	WHERE name = ?
+`
+
+	sqlInsertMigration = `
+INSERT OR IGNORE INTO migrations (name, created_at)
+	VALUES (?, ?)
+`
+)
+
+// migrate runs a data migration once. The migration is recorded in the same
+// transaction as its changes.
+func migrate(db *sqlx.DB, name string, f func(*sqlx.Tx) error) error {
+	_, err := db.Exec(sqlCreateMigrations)
+	if err != nil {
+		return fmt.Errorf("could not create table migrations: %w", err)
+	}
+
+	var done int
+	err = db.Get(&done, sqlSelectMigration, name)
+	if err != nil {
+		return fmt.Errorf("could not check migration %s: %w", name, err)
+	}
+	if done > 0 {
+		return nil
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("could not create transaction: %w", err)
+	}
+
+	err = f(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(sqlInsertMigration, name, time.Now())
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("could not record migration %s: %w", name, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+	return nil
+}
+
+// addColumn adds a column to an existing table if it is not already there.
+// It is used to upgrade databases created before the column existed.
+func addColumn(db *sqlx.DB, table, column, definition string) error {
+	rows, err := db.Queryx(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("could not get %s columns: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		c, err := rows.SliceScan()
+		if err != nil {
+			return fmt.Errorf("could not read %s columns: %w", table, err)
+		}
+		if len(c) > 1 && fmt.Sprint(c[1]) == column {
+			return nil
+		}
+	}
+	if rows.Err() != nil {
+		return fmt.Errorf("could not read %s columns: %w", table, rows.Err())
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf(
+		"ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("could not add column %s.%s: %w", table, column, err)
+	}
+
+	return nil
+}
+
+// sqlTime converts a time to the representation used when storing rows so
+// it can be compared with stored timestamps.
+func sqlTime(t time.Time) time.Time {
+	return t.Local().Round(0)
+}
@@ -0,0 +1,41 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+const sqlCreateVersionsV1 = `
+CREATE TABLE versions (
+	version STRING,
+	effect INTEGER,
+	created_at TIMESTAMP,
+	code TEXT
+)
+`
+
+func TestMigrateVersions(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName, testDatabase)
+	require.NoError(t, err)
+
+	_, err = db.Exec(sqlCreateVersionsV1)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO versions VALUES (0, 1, ?, 'old')`, testTime)
+	require.NoError(t, err)
+
+	s, err := NewEffects(db)
+	require.NoError(t, err)
+	// Initializing twice must not fail.
+	s, err = NewEffects(db)
+	require.NoError(t, err)
+
+	versions, err := s.versions(1)
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	require.Equal(t, "old", versions[0].Code)
+	require.Equal(t, CodeHash("old"), versions[0].CodeHash)
+	require.Equal(t, Submitter{}, versions[0].Submitter)
+}
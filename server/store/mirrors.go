@@ -0,0 +1,82 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	sqlCreateMirrors = `
+CREATE TABLE IF NOT EXISTS mirrors (
+	source TEXT PRIMARY KEY,
+	seq INTEGER,
+	updated_at TIMESTAMP
+)
+`
+)
+
+// Mirrors keeps the position in the change sequence of each instance
+// replicated by this one so mirroring can resume where it stopped.
+type Mirrors struct {
+	db *sqlx.DB
+}
+
+func NewMirrors(db *sqlx.DB) (*Mirrors, error) {
+	m := &Mirrors{
+		db: db,
+	}
+	err := m.Init()
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (s *Mirrors) Init() error {
+	_, err := s.db.Exec(sqlCreateMirrors)
+	if err != nil {
+		return fmt.Errorf("could not create table mirrors: %w", err)
+	}
+	return nil
+}
+
+const (
+	sqlSelectMirrorPosition = `
+SELECT seq FROM mirrors
+	WHERE source = ?
+`
+
+	sqlUpsertMirrorPosition = `
+INSERT INTO mirrors (source, seq, updated_at)
+	VALUES(?, ?, ?)
+	ON CONFLICT(source) DO UPDATE
+		SET seq = excluded.seq, updated_at = excluded.updated_at
+`
+)
+
+// Position returns the last change sequence number read from source or 0
+// if it was never mirrored.
+func (s *Mirrors) Position(source string) (int, error) {
+	var seq int
+	err := s.db.Get(&seq, sqlSelectMirrorPosition, source)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not get mirror position: %w", err)
+	}
+	return seq, nil
+}
+
+// SetPosition stores the last change sequence number read from source.
+func (s *Mirrors) SetPosition(source string, seq int) error {
+	_, err := s.db.Exec(sqlUpsertMirrorPosition, source, seq, time.Now())
+	if err != nil {
+		return fmt.Errorf("could not set mirror position: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+func TestMirrors(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName, testDatabase)
+	require.NoError(t, err)
+
+	m, err := NewMirrors(db)
+	require.NoError(t, err)
+
+	seq, err := m.Position("http://example.com")
+	require.NoError(t, err)
+	require.Zero(t, seq)
+
+	require.NoError(t, m.SetPosition("http://example.com", 10))
+	require.NoError(t, m.SetPosition("http://example.com", 42))
+	require.NoError(t, m.SetPosition("http://other.com", 5))
+
+	seq, err = m.Position("http://example.com")
+	require.NoError(t, err)
+	require.Equal(t, 42, seq)
+	seq, err = m.Position("http://other.com")
+	require.NoError(t, err)
+	require.Equal(t, 5, seq)
+}
+
+func TestPutEffect(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName, testDatabase)
+	require.NoError(t, err)
+
+	s, err := NewEffects(db)
+	require.NoError(t, err)
+
+	created := time.Date(2022, time.March, 1, 0, 0, 0, 0, time.UTC)
+	e := Effect{
+		ID:            100,
+		CreatedAt:     created,
+		ModifiedAt:    created,
+		Parent:        -1,
+		ParentVersion: -1,
+		User:          "user",
+		Versions: []Version{
+			{CreatedAt: created, Code: "first"},
+		},
+	}
+	require.NoError(t, s.PutEffect(e))
+
+	e.Versions = append(e.Versions,
+		Version{CreatedAt: created.Add(time.Hour), Hidden: true},
+		Version{CreatedAt: created.Add(2 * time.Hour), Code: "third"},
+	)
+	e.ModifiedAt = created.Add(2 * time.Hour)
+	require.NoError(t, s.PutEffect(e))
+	require.NoError(t, s.PutEffect(e))
+
+	stored, err := s.Effect(100)
+	require.NoError(t, err)
+	require.Equal(t, "user", stored.User)
+	require.Len(t, stored.Versions, 3)
+	require.Equal(t, "first", stored.Versions[0].Code)
+	require.True(t, stored.Versions[1].Hidden)
+	require.Equal(t, "third", stored.Versions[2].Code)
+	require.Equal(t, CodeHash("third"), stored.Versions[2].CodeHash)
+	require.True(t, stored.ModifiedAt.Equal(e.ModifiedAt))
+
+	changes, err := s.Changes(0, 10)
+	require.NoError(t, err)
+	require.Len(t, changes, 3)
+	for i, c := range changes {
+		require.Equal(t, 100, c.Effect)
+		require.Equal(t, i, c.Version)
+	}
+	require.Equal(t, ChangeCreated, changes[0].Kind)
+	require.Equal(t, ChangeVersion, changes[2].Kind)
+
+	id, err := s.Add(-1, -1, "other", "code", Submitter{})
+	require.NoError(t, err)
+	require.Equal(t, 101, id)
+}
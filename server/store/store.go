@@ -6,4 +6,7 @@ import (
 
 var (
 	ErrNotFound = fmt.Errorf("not found")
+	ErrLocked   = fmt.Errorf("effect is locked")
+	// ErrInvalid wraps the errors caused by bad values passed by the caller.
+	ErrInvalid = fmt.Errorf("invalid input")
 )
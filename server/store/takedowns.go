@@ -0,0 +1,391 @@
+package store
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Takedown records the removal of an effect for legal reasons.
+type Takedown struct {
+	ID        int       `db:"id"`
+	Effect    int       `db:"effect"`
+	Reason    string    `db:"reason"`
+	Requester string    `db:"requester"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type BlockKind string
+
+const (
+	BlockHash  = "hash"
+	BlockRegex = "regex"
+)
+
+// Block rejects submitted code. Value is a normalized code hash or a
+// regular expression depending on Kind. Takedown is the takedown that
+// created the block or 0 if it was added by hand.
+type Block struct {
+	ID        int       `db:"id"`
+	Kind      BlockKind `db:"kind"`
+	Value     string    `db:"value"`
+	Takedown  int       `db:"takedown"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// NormalizedHash returns a hash of the code that does not change when
+// comments or whitespace are modified.
+func NormalizedHash(code string) string {
+	h := sha256.Sum256([]byte(normalizeCode(code)))
+	return hex.EncodeToString(h[:])
+}
+
+func normalizeCode(code string) string {
+	var b strings.Builder
+	for i := 0; i < len(code); i++ {
+		switch {
+		case strings.HasPrefix(code[i:], "//"):
+			end := strings.IndexByte(code[i:], '\n')
+			if end < 0 {
+				return b.String()
+			}
+			i += end
+		case strings.HasPrefix(code[i:], "/*"):
+			end := strings.Index(code[i+2:], "*/")
+			if end < 0 {
+				return b.String()
+			}
+			i += end + 3
+		case unicode.IsSpace(rune(code[i])):
+		default:
+			b.WriteByte(code[i])
+		}
+	}
+	return b.String()
+}
+
+const (
+	sqlCreateTakedowns = `
+CREATE TABLE IF NOT EXISTS takedowns (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	effect INTEGER,
+	reason TEXT,
+	requester TEXT,
+	created_at TIMESTAMP
+)
+`
+
+	sqlCreateBlocks = `
+CREATE TABLE IF NOT EXISTS blocks (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	kind TEXT,
+	value TEXT,
+	takedown INTEGER,
+	created_at TIMESTAMP
+)
+`
+)
+
+type Takedowns struct {
+	db *sqlx.DB
+
+	// regexps keeps the compiled expressions of the regex blocks.
+	mu      sync.Mutex
+	regexps map[string]*regexp.Regexp
+}
+
+func NewTakedowns(db *sqlx.DB) (*Takedowns, error) {
+	t := &Takedowns{
+		db:      db,
+		regexps: make(map[string]*regexp.Regexp),
+	}
+	err := t.Init()
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *Takedowns) Init() error {
+	_, err := s.db.Exec(sqlCreateTakedowns)
+	if err != nil {
+		return fmt.Errorf("could not create table takedowns: %w", err)
+	}
+
+	_, err = s.db.Exec(sqlCreateBlocks)
+	if err != nil {
+		return fmt.Errorf("could not create table blocks: %w", err)
+	}
+	return nil
+}
+
+const (
+	sqlSelectTakedowns = `
+SELECT * FROM takedowns
+	ORDER BY id DESC
+`
+
+	sqlInsertTakedown = `
+INSERT INTO takedowns (
+	effect,
+	reason,
+	requester,
+	created_at
+) VALUES(
+	:effect,
+	:reason,
+	:requester,
+	:created_at
+)
+`
+
+	sqlSelectBlocks = `
+SELECT * FROM blocks
+	ORDER BY id
+`
+
+	sqlInsertBlock = `
+INSERT INTO blocks (
+	kind,
+	value,
+	takedown,
+	created_at
+) VALUES(
+	:kind,
+	:value,
+	:takedown,
+	:created_at
+)
+`
+
+	sqlDeleteBlock = `
+DELETE FROM blocks
+	WHERE id = ?
+`
+)
+
+// TakeDown moves the effect to the trash, records the takedown and blocks
+// the code of its versions so it can not be posted again. Code inherited
+// from the parent version is not blocked as it belongs to other effects.
+// It returns the takedown identifier.
+func (s *Takedowns) TakeDown(effects *Effects, t Takedown) (int, error) {
+	if t.Requester == "" || t.Reason == "" {
+		return 0, fmt.Errorf("%w: takedown needs requester and reason", ErrInvalid)
+	}
+
+	e, err := effects.Effect(t.Effect)
+	if err != nil {
+		return 0, err
+	}
+
+	hashes := make(map[string]struct{})
+	if e.Parent >= 0 {
+		p, err := effects.EffectVersion(e.Parent, e.ParentVersion)
+		switch {
+		case err == nil:
+			hashes[NormalizedHash(p.Versions[0].Code)] = struct{}{}
+		case errors.Is(err, ErrNotFound), errors.Is(err, sql.ErrNoRows):
+		default:
+			return 0, fmt.Errorf("could not get parent version: %w", err)
+		}
+	}
+
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = time.Now()
+	}
+
+	var id int
+	err = s.transaction(func(tx *sqlx.Tx) error {
+		if !e.Deleted() {
+			err := deleteEffect(tx, t.Effect)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return fmt.Errorf("could not delete effect: %w", err)
+			}
+		}
+
+		r, err := tx.NamedExec(sqlInsertTakedown, t)
+		if err != nil {
+			return fmt.Errorf("could not add takedown: %w", err)
+		}
+		i, err := r.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("could not get takedown id: %w", err)
+		}
+		id = int(i)
+
+		for _, v := range e.Versions {
+			hash := NormalizedHash(v.Code)
+			if _, ok := hashes[hash]; ok {
+				continue
+			}
+			hashes[hash] = struct{}{}
+
+			_, err = tx.NamedExec(sqlInsertBlock, Block{
+				Kind:      BlockHash,
+				Value:     hash,
+				Takedown:  id,
+				CreatedAt: t.CreatedAt,
+			})
+			if err != nil {
+				return fmt.Errorf("could not add block: %w", err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// Takedowns returns all the takedowns, newest first.
+func (s *Takedowns) Takedowns() ([]Takedown, error) {
+	var list []Takedown
+	err := s.db.Select(&list, sqlSelectTakedowns)
+	if err != nil {
+		return nil, fmt.Errorf("could not get takedowns: %w", err)
+	}
+	return list, nil
+}
+
+// AddBlock stores a new block and returns its identifier.
+func (s *Takedowns) AddBlock(b Block) (int, error) {
+	b.Value = strings.TrimSpace(b.Value)
+	if b.Value == "" {
+		return 0, fmt.Errorf("%w: empty block value", ErrInvalid)
+	}
+
+	switch b.Kind {
+	case BlockHash:
+	case BlockRegex:
+		_, err := regexp.Compile(b.Value)
+		if err != nil {
+			return 0, fmt.Errorf("%w: invalid regular expression: %s", ErrInvalid, err.Error())
+		}
+	default:
+		return 0, fmt.Errorf("%w: invalid block kind: %s", ErrInvalid, b.Kind)
+	}
+
+	if b.CreatedAt.IsZero() {
+		b.CreatedAt = time.Now()
+	}
+
+	r, err := s.db.NamedExec(sqlInsertBlock, b)
+	if err != nil {
+		return 0, fmt.Errorf("could not add block: %w", err)
+	}
+	id, err := r.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("could not get block id: %w", err)
+	}
+	return int(id), nil
+}
+
+// Blocks returns all the blocks.
+func (s *Takedowns) Blocks() ([]Block, error) {
+	var list []Block
+	err := s.db.Select(&list, sqlSelectBlocks)
+	if err != nil {
+		return nil, fmt.Errorf("could not get blocks: %w", err)
+	}
+	return list, nil
+}
+
+// RemoveBlock deletes a block.
+func (s *Takedowns) RemoveBlock(id int) error {
+	r, err := s.db.Exec(sqlDeleteBlock, id)
+	if err != nil {
+		return fmt.Errorf("could not delete block: %w", err)
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not get affected rows: %w", err)
+	}
+	if n < 1 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Check returns the first block that rejects the code. ErrNotFound is
+// returned when the code is allowed.
+func (s *Takedowns) Check(code string) (Block, error) {
+	blocks, err := s.Blocks()
+	if err != nil {
+		return Block{}, err
+	}
+
+	regexps := s.compile(blocks)
+	hash := NormalizedHash(code)
+	for _, b := range blocks {
+		switch b.Kind {
+		case BlockHash:
+			if b.Value == hash {
+				return b, nil
+			}
+		case BlockRegex:
+			r := regexps[b.Value]
+			if r != nil && r.MatchString(code) {
+				return b, nil
+			}
+		}
+	}
+
+	return Block{}, ErrNotFound
+}
+
+// compile returns the compiled expressions of the regex blocks. Expressions
+// are only compiled the first time they are seen and the ones of removed
+// blocks are forgotten.
+func (s *Takedowns) compile(blocks []Block) map[string]*regexp.Regexp {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	regexps := make(map[string]*regexp.Regexp)
+	for _, b := range blocks {
+		if b.Kind != BlockRegex {
+			continue
+		}
+
+		r, ok := s.regexps[b.Value]
+		if !ok {
+			// invalid expressions are rejected by AddBlock
+			r, _ = regexp.Compile(b.Value)
+		}
+		regexps[b.Value] = r
+	}
+	s.regexps = regexps
+
+	return regexps
+}
+
+func (s *Takedowns) transaction(f func(*sqlx.Tx) error) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("could not create transaction: %w", err)
+	}
+
+	err = f(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+
+	return nil
+}
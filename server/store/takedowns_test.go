@@ -0,0 +1,124 @@
+package store
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+func TestNormalizedHash(t *testing.T) {
+	code := "void main() {\n\tgl_FragColor = vec4(1.0);\n}\n"
+	same := []string{
+		"void main(){gl_FragColor=vec4(1.0);}",
+		"// header\nvoid main() {\n  gl_FragColor = vec4(1.0); // red\n}",
+		"/* c */void main() { /* multi\nline */ gl_FragColor = vec4(1.0); }\n",
+	}
+	for _, s := range same {
+		require.Equal(t, NormalizedHash(code), NormalizedHash(s), s)
+	}
+
+	require.NotEqual(t, NormalizedHash(code),
+		NormalizedHash("void main() { gl_FragColor = vec4(0.0); }"))
+}
+
+func TestTakedowns(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName, testDatabase)
+	require.NoError(t, err)
+
+	effects, err := NewEffects(db)
+	require.NoError(t, err)
+	takedowns, err := NewTakedowns(db)
+	require.NoError(t, err)
+
+	id, err := effects.Add(-1, -1, "user", "void main() { red(); }", Submitter{})
+	require.NoError(t, err)
+	_, err = effects.AddVersion(id, "void main() { blue(); }", Submitter{})
+	require.NoError(t, err)
+	_, err = effects.AddVersion(id, "void main() { blue(); } // again", Submitter{})
+	require.NoError(t, err)
+
+	_, err = takedowns.Check("void main() { red(); }")
+	require.True(t, errors.Is(err, ErrNotFound))
+
+	_, err = takedowns.TakeDown(effects, Takedown{Effect: id})
+	require.True(t, errors.Is(err, ErrInvalid))
+	_, err = takedowns.TakeDown(effects, Takedown{
+		Effect:    id + 1,
+		Requester: "requester",
+		Reason:    "reason",
+	})
+	require.Error(t, err)
+
+	tid, err := takedowns.TakeDown(effects, Takedown{
+		Effect:    id,
+		Requester: "requester",
+		Reason:    "reason",
+	})
+	require.NoError(t, err)
+
+	e, err := effects.Effect(id)
+	require.NoError(t, err)
+	require.True(t, e.Deleted())
+
+	list, err := takedowns.Takedowns()
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.Equal(t, tid, list[0].ID)
+	require.Equal(t, id, list[0].Effect)
+	require.Equal(t, "requester", list[0].Requester)
+	require.False(t, list[0].CreatedAt.IsZero())
+
+	blocks, err := takedowns.Blocks()
+	require.NoError(t, err)
+	require.Len(t, blocks, 2)
+
+	b, err := takedowns.Check("void main(){\n  red();\n}")
+	require.NoError(t, err)
+	require.Equal(t, tid, b.Takedown)
+	_, err = takedowns.Check("void main() { blue(); }")
+	require.NoError(t, err)
+	_, err = takedowns.Check("void main() { green(); }")
+	require.True(t, errors.Is(err, ErrNotFound))
+
+	// taking down a fork does not block the code it inherited
+	original, err := effects.Add(-1, -1, "user", "void main() { yellow(); }", Submitter{})
+	require.NoError(t, err)
+	fork, err := effects.Add(original, 0, "user", "void main() { yellow(); }", Submitter{})
+	require.NoError(t, err)
+	_, err = effects.AddVersion(fork, "void main() { purple(); }", Submitter{})
+	require.NoError(t, err)
+	_, err = takedowns.TakeDown(effects, Takedown{
+		Effect:    fork,
+		Requester: "requester",
+		Reason:    "reason",
+	})
+	require.NoError(t, err)
+	_, err = takedowns.Check("void main() { yellow(); }")
+	require.True(t, errors.Is(err, ErrNotFound))
+	_, err = takedowns.Check("void main() { purple(); }")
+	require.NoError(t, err)
+	e, err = effects.Effect(original)
+	require.NoError(t, err)
+	require.False(t, e.Deleted())
+
+	_, err = takedowns.AddBlock(Block{Kind: BlockRegex, Value: "("})
+	require.True(t, errors.Is(err, ErrInvalid))
+	_, err = takedowns.AddBlock(Block{Kind: "other", Value: "x"})
+	require.True(t, errors.Is(err, ErrInvalid))
+	rid, err := takedowns.AddBlock(Block{Kind: BlockRegex, Value: `https?://spam\.`})
+	require.NoError(t, err)
+
+	b, err = takedowns.Check("// visit http://spam.example\nvoid main() {}")
+	require.NoError(t, err)
+	require.Equal(t, rid, b.ID)
+
+	err = takedowns.RemoveBlock(rid)
+	require.NoError(t, err)
+	err = takedowns.RemoveBlock(rid)
+	require.True(t, errors.Is(err, ErrNotFound))
+	_, err = takedowns.Check("// visit http://spam.example\nvoid main() {}")
+	require.True(t, errors.Is(err, ErrNotFound))
+}
@@ -0,0 +1,349 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Webhook is a URL notified of effect events. Events is a comma separated
+// list of event names to send, empty sends all of them.
+type Webhook struct {
+	ID        int       `db:"id"`
+	URL       string    `db:"url"`
+	Secret    string    `db:"secret"`
+	Events    string    `db:"events"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// Wants checks if the webhook is interested in an event.
+func (w Webhook) Wants(event string) bool {
+	if strings.TrimSpace(w.Events) == "" {
+		return true
+	}
+	for _, e := range strings.Split(w.Events, ",") {
+		if strings.TrimSpace(e) == event {
+			return true
+		}
+	}
+	return false
+}
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Delivery is a queued webhook call. Failed calls are retried at NextAttempt
+// until the status is DeliveryFailed.
+type Delivery struct {
+	ID           int            `db:"id"`
+	Webhook      int            `db:"webhook"`
+	URL          string         `db:"url"`
+	Secret       string         `db:"secret"`
+	Event        string         `db:"event"`
+	Payload      string         `db:"payload"`
+	Status       DeliveryStatus `db:"status"`
+	Attempts     int            `db:"attempts"`
+	ResponseCode int            `db:"response_code"`
+	LastError    string         `db:"last_error"`
+	CreatedAt    time.Time      `db:"created_at"`
+	NextAttempt  time.Time      `db:"next_attempt"`
+	DeliveredAt  sql.NullTime   `db:"delivered_at"`
+}
+
+const (
+	sqlCreateWebhooks = `
+CREATE TABLE IF NOT EXISTS webhooks (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	url TEXT,
+	secret TEXT,
+	events TEXT,
+	created_at TIMESTAMP
+)
+`
+
+	sqlCreateDeliveries = `
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	webhook INTEGER,
+	event TEXT,
+	payload TEXT,
+	status TEXT,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	response_code INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP,
+	next_attempt TIMESTAMP,
+	delivered_at TIMESTAMP
+)
+`
+
+	sqlIndexDeliveriesStatus = `
+CREATE INDEX IF NOT EXISTS idx_deliveries_status
+	ON webhook_deliveries (status, next_attempt)
+`
+)
+
+type Webhooks struct {
+	db *sqlx.DB
+}
+
+func NewWebhooks(db *sqlx.DB) (*Webhooks, error) {
+	w := &Webhooks{
+		db: db,
+	}
+	err := w.Init()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (s *Webhooks) Init() error {
+	_, err := s.db.Exec(sqlCreateWebhooks)
+	if err != nil {
+		return fmt.Errorf("could not create table webhooks: %w", err)
+	}
+
+	_, err = s.db.Exec(sqlCreateDeliveries)
+	if err != nil {
+		return fmt.Errorf("could not create table webhook_deliveries: %w", err)
+	}
+
+	_, err = s.db.Exec(sqlIndexDeliveriesStatus)
+	if err != nil {
+		return fmt.Errorf("could not create index deliveries status: %w", err)
+	}
+	return nil
+}
+
+const (
+	sqlSelectWebhooks = `
+SELECT * FROM webhooks
+	ORDER BY id
+`
+
+	sqlInsertWebhook = `
+INSERT INTO webhooks (
+	url,
+	secret,
+	events,
+	created_at
+) VALUES(
+	:url,
+	:secret,
+	:events,
+	:created_at
+)
+`
+
+	sqlDeleteWebhook = `
+DELETE FROM webhooks
+	WHERE id = ?
+`
+
+	sqlDeleteWebhookDeliveries = `
+DELETE FROM webhook_deliveries
+	WHERE webhook = ?
+`
+
+	sqlInsertDelivery = `
+INSERT INTO webhook_deliveries (
+	webhook,
+	event,
+	payload,
+	status,
+	created_at,
+	next_attempt
+) VALUES(?, ?, ?, ?, ?, ?)
+`
+
+	sqlSelectDeliveries = `
+SELECT webhook_deliveries.*, webhooks.url, webhooks.secret
+	FROM webhook_deliveries
+	JOIN webhooks ON webhooks.id = webhook_deliveries.webhook
+`
+
+	sqlSelectDeliveriesDue = sqlSelectDeliveries + `
+	WHERE status = 'pending' AND next_attempt <= ?
+	ORDER BY next_attempt
+	LIMIT ?
+`
+
+	sqlSelectDeliveriesLog = sqlSelectDeliveries + `
+	ORDER BY webhook_deliveries.id DESC
+	LIMIT ?
+`
+
+	sqlUpdateDeliveryDelivered = `
+UPDATE webhook_deliveries
+	SET status = 'delivered',
+		attempts = attempts + 1,
+		response_code = ?,
+		last_error = '',
+		delivered_at = ?
+	WHERE id = ?
+`
+
+	sqlDeleteDeliveriesDone = `
+DELETE FROM webhook_deliveries
+	WHERE status != 'pending' AND created_at < ?
+`
+
+	sqlUpdateDeliveryFailed = `
+UPDATE webhook_deliveries
+	SET status = ?,
+		attempts = attempts + 1,
+		response_code = ?,
+		last_error = ?,
+		next_attempt = ?
+	WHERE id = ?
+`
+)
+
+// Add stores a new webhook and returns its identifier.
+func (s *Webhooks) Add(w Webhook) (int, error) {
+	w.URL = strings.TrimSpace(w.URL)
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return 0, fmt.Errorf("invalid webhook url: %s", w.URL)
+	}
+
+	if w.CreatedAt.IsZero() {
+		w.CreatedAt = time.Now()
+	}
+
+	r, err := s.db.NamedExec(sqlInsertWebhook, w)
+	if err != nil {
+		return 0, fmt.Errorf("could not add webhook: %w", err)
+	}
+	id, err := r.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("could not get webhook id: %w", err)
+	}
+	return int(id), nil
+}
+
+// Webhooks returns all the webhooks.
+func (s *Webhooks) Webhooks() ([]Webhook, error) {
+	var list []Webhook
+	err := s.db.Select(&list, sqlSelectWebhooks)
+	if err != nil {
+		return nil, fmt.Errorf("could not get webhooks: %w", err)
+	}
+	return list, nil
+}
+
+// Remove deletes a webhook and its deliveries.
+func (s *Webhooks) Remove(id int) error {
+	r, err := s.db.Exec(sqlDeleteWebhook, id)
+	if err != nil {
+		return fmt.Errorf("could not delete webhook: %w", err)
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not get affected rows: %w", err)
+	}
+	if n < 1 {
+		return ErrNotFound
+	}
+
+	_, err = s.db.Exec(sqlDeleteWebhookDeliveries, id)
+	if err != nil {
+		return fmt.Errorf("could not delete deliveries: %w", err)
+	}
+	return nil
+}
+
+// Enqueue queues a delivery of the payload for every webhook interested in
+// the event. It returns the number of deliveries created.
+func (s *Webhooks) Enqueue(event string, payload []byte) (int, error) {
+	hooks, err := s.Webhooks()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	n := 0
+	for _, w := range hooks {
+		if !w.Wants(event) {
+			continue
+		}
+
+		_, err = s.db.Exec(sqlInsertDelivery,
+			w.ID, event, string(payload), DeliveryPending, now, now)
+		if err != nil {
+			return n, fmt.Errorf("could not add delivery: %w", err)
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// Due returns up to limit pending deliveries whose next attempt is before
+// the given time.
+func (s *Webhooks) Due(now time.Time, limit int) ([]Delivery, error) {
+	var list []Delivery
+	err := s.db.Select(&list, sqlSelectDeliveriesDue, sqlTime(now), limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not get deliveries: %w", err)
+	}
+	return list, nil
+}
+
+// Deliveries returns the latest deliveries, newest first.
+func (s *Webhooks) Deliveries(limit int) ([]Delivery, error) {
+	var list []Delivery
+	err := s.db.Select(&list, sqlSelectDeliveriesLog, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not get deliveries: %w", err)
+	}
+	return list, nil
+}
+
+// Delivered marks a delivery as done.
+func (s *Webhooks) Delivered(id int, code int) error {
+	_, err := s.db.Exec(sqlUpdateDeliveryDelivered, code, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("could not update delivery: %w", err)
+	}
+	return nil
+}
+
+// PruneDeliveries removes the delivered and failed deliveries created
+// before the given time. It returns the number of deliveries removed.
+func (s *Webhooks) PruneDeliveries(before time.Time) (int, error) {
+	r, err := s.db.Exec(sqlDeleteDeliveriesDone, sqlTime(before))
+	if err != nil {
+		return 0, fmt.Errorf("could not delete deliveries: %w", err)
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("could not get affected rows: %w", err)
+	}
+	return int(n), nil
+}
+
+// Failed records an unsuccessful attempt. The delivery is retried at next
+// unless next is zero, then it is marked as failed.
+func (s *Webhooks) Failed(id int, code int, reason string, next time.Time) error {
+	status := DeliveryPending
+	if next.IsZero() {
+		status = DeliveryFailed
+	}
+
+	_, err := s.db.Exec(sqlUpdateDeliveryFailed, status, code, reason, next, id)
+	if err != nil {
+		return fmt.Errorf("could not update delivery: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+func TestWebhooks(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName, testDatabase)
+	require.NoError(t, err)
+
+	s, err := NewWebhooks(db)
+	require.NoError(t, err)
+
+	_, err = s.Add(Webhook{URL: "ftp://example.com"})
+	require.Error(t, err)
+	_, err = s.Add(Webhook{URL: "not a url"})
+	require.Error(t, err)
+
+	all, err := s.Add(Webhook{URL: "http://example.com/all", Secret: "secret"})
+	require.NoError(t, err)
+	some, err := s.Add(Webhook{
+		URL:    "https://example.com/some",
+		Events: "effect.created, effect.hidden",
+	})
+	require.NoError(t, err)
+
+	n, err := s.Enqueue("effect.created", []byte(`{"id":1}`))
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	n, err = s.Enqueue("version.added", []byte(`{"id":2}`))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	due, err := s.Due(time.Now(), 10)
+	require.NoError(t, err)
+	require.Len(t, due, 3)
+	require.Equal(t, "http://example.com/all", due[0].URL)
+	require.Equal(t, "secret", due[0].Secret)
+	require.Equal(t, DeliveryStatus(DeliveryPending), due[0].Status)
+
+	_, err = s.Due(time.Now(), 1)
+	require.NoError(t, err)
+
+	err = s.Delivered(due[0].ID, 200)
+	require.NoError(t, err)
+	err = s.Failed(due[1].ID, 500, "server error", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	err = s.Failed(due[2].ID, 0, "timeout", time.Time{})
+	require.NoError(t, err)
+
+	due, err = s.Due(time.Now(), 10)
+	require.NoError(t, err)
+	require.Empty(t, due)
+	due, err = s.Due(time.Now().Add(2*time.Hour), 10)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	require.Equal(t, 1, due[0].Attempts)
+	require.Equal(t, "server error", due[0].LastError)
+
+	log, err := s.Deliveries(10)
+	require.NoError(t, err)
+	require.Len(t, log, 3)
+	require.Equal(t, DeliveryStatus(DeliveryFailed), log[0].Status)
+	require.Equal(t, DeliveryStatus(DeliveryDelivered), log[2].Status)
+	require.True(t, log[2].DeliveredAt.Valid)
+
+	err = s.Remove(some)
+	require.NoError(t, err)
+	err = s.Remove(some)
+	require.True(t, errors.Is(err, ErrNotFound))
+
+	log, err = s.Deliveries(10)
+	require.NoError(t, err)
+	require.Len(t, log, 2)
+	require.Equal(t, all, log[0].Webhook)
+
+	done := 0
+	for _, l := range log {
+		if l.Status != DeliveryPending {
+			done++
+		}
+	}
+	require.NotZero(t, done)
+	n, err = s.PruneDeliveries(time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	require.Zero(t, n)
+	n, err = s.PruneDeliveries(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, done, n)
+	log, err = s.Deliveries(10)
+	require.NoError(t, err)
+	require.Len(t, log, 2-done)
+	for _, l := range log {
+		require.Equal(t, DeliveryStatus(DeliveryPending), l.Status)
+	}
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrdoob/glsl-sandbox/server/store"
+)
+
+const (
+	streamBatch     = 100
+	streamKeepalive = 15 * time.Second
+	// streamHistory is the number of events kept for streams that fall
+	// behind.
+	streamHistory = 1000
+)
+
+// broker wakes up the streams when there are new changes. It also keeps
+// the latest public events so each change is read and filtered once for all
+// the streams.
+type broker struct {
+	mu sync.Mutex
+	ch chan struct{}
+
+	feedMu sync.Mutex
+	// first and last are the change sequence numbers covered by events,
+	// first excluded. last is -1 until the first stream reads events, then
+	// both start at the last change.
+	first  int
+	last   int
+	events []streamItem
+}
+
+// streamItem is an encoded stream event and its change sequence number.
+type streamItem struct {
+	seq     int
+	effect  int
+	version int
+	data    []byte
+}
+
+func newBroker() *broker {
+	return &broker{
+		ch:   make(chan struct{}),
+		last: -1,
+	}
+}
+
+// wait returns a channel closed on the next notification.
+func (b *broker) wait() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ch
+}
+
+// notify wakes up all the waiting streams.
+func (b *broker) notify() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	close(b.ch)
+	b.ch = make(chan struct{})
+}
+
+// streamEvent is the data of the effect events sent by the stream.
+type streamEvent struct {
+	ID      int    `json:"id"`
+	Version int    `json:"version"`
+	User    string `json:"user"`
+	Image   string `json:"image"`
+	URL     string `json:"url"`
+}
+
+// streamHandler sends new effects and versions as Server-Sent Events. The
+// event id is the change sequence number so clients can resume with the
+// Last-Event-ID header. Without it only new changes are sent. Ids after the
+// last change resume from the last change.
+func (s *Server) streamHandler(c echo.Context) error {
+	last, err := s.effects.LastChange()
+	if err != nil {
+		c.Logger().Errorf("could not get last change: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "")
+	}
+
+	if id := c.Request().Header.Get("Last-Event-ID"); id != "" {
+		resume, err := strconv.Atoi(id)
+		if err != nil || resume < 0 {
+			return c.String(http.StatusBadRequest, "malformed Last-Event-ID")
+		}
+		if resume < last {
+			last = resume
+		}
+	}
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set(echo.HeaderConnection, "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+
+	ctx := c.Request().Context()
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		wait := s.stream.wait()
+
+		items, next, more, err := s.streamEvents(last)
+		if err != nil {
+			c.Logger().Errorf("could not get changes: %s", err.Error())
+			return nil
+		}
+
+		for _, it := range items {
+			_, err = fmt.Fprintf(w, "id: %d\nevent: effect\ndata: %s\n\n", it.seq, it.data)
+			if err != nil {
+				return nil
+			}
+		}
+		w.Flush()
+		last = next
+
+		if more {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-wait:
+		case <-keepalive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+			if err != nil {
+				return nil
+			}
+			w.Flush()
+		}
+	}
+}
+
+// streamEvents returns up to streamBatch public events after the change
+// sequence number, the sequence number to continue from and whether there
+// are more events ready. New changes are read once into the broker history
+// and shared by all the streams. Streams older than the history read their
+// events directly a page at a time.
+func (s *Server) streamEvents(after int) ([]streamItem, int, bool, error) {
+	b := s.stream
+	b.feedMu.Lock()
+	defer b.feedMu.Unlock()
+
+	if b.last < 0 {
+		last, err := s.effects.LastChange()
+		if err != nil {
+			return nil, 0, false, err
+		}
+		b.first, b.last = last, last
+	}
+
+	if after < b.first {
+		changes, end, err := s.effects.PublicChanges(after, streamBatch)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		items, err := streamItems(nil, changes)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		return items, end, end != after, nil
+	}
+
+	// read at most a history worth of changes while holding the lock, the
+	// rest is read in the next calls
+	current := false
+	for i := 0; i < streamHistory/streamBatch; i++ {
+		changes, end, err := s.effects.PublicChanges(b.last, streamBatch)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if end == b.last {
+			current = true
+			break
+		}
+
+		events, err := streamItems(b.events, changes)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		b.events = events
+		b.last = end
+	}
+
+	if n := len(b.events) - streamHistory; n > 0 {
+		b.first = b.events[n-1].seq
+		b.events = append([]streamItem(nil), b.events[n:]...)
+	}
+
+	if after > b.last {
+		// the history has not reached the stream yet
+		return nil, after, !current, nil
+	}
+
+	i := sort.Search(len(b.events), func(i int) bool {
+		return b.events[i].seq > after
+	})
+	// the history is changed in place so the stream gets a copy
+	n := len(b.events) - i
+	if n > streamBatch {
+		n = streamBatch
+	}
+	items := append([]streamItem(nil), b.events[i:i+n]...)
+	if i+n < len(b.events) {
+		return items, items[n-1].seq, true, nil
+	}
+
+	return items, b.last, !current, nil
+}
+
+// streamItems appends to items the stream events of the public changes.
+// Hide, delete and purge changes remove the events of the effect or version
+// they affect.
+func streamItems(items []streamItem, changes []store.Change) ([]streamItem, error) {
+	for _, ch := range changes {
+		switch ch.Kind {
+		case store.ChangeHidden, store.ChangeDeleted, store.ChangePurged:
+			kept := items[:0]
+			for _, it := range items {
+				if it.effect != ch.Effect || (ch.Version >= 0 && it.version != ch.Version) {
+					kept = append(kept, it)
+				}
+			}
+			items = kept
+			continue
+		}
+
+		data, err := json.Marshal(streamEvent{
+			ID:      ch.Effect,
+			Version: ch.Version,
+			User:    ch.User,
+			Image:   path.Join("/thumbs", store.Effect{ID: ch.Effect}.ImageName()),
+			URL:     fmt.Sprintf("/e#%d.%d", ch.Effect, ch.Version),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not encode stream event: %w", err)
+		}
+		items = append(items, streamItem{
+			seq:     ch.Seq,
+			effect:  ch.Effect,
+			version: ch.Version,
+			data:    data,
+		})
+	}
+	return items, nil
+}
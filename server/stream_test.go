@@ -0,0 +1,185 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/mrdoob/glsl-sandbox/server/store"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+type sseEvent struct {
+	id   string
+	data streamEvent
+}
+
+func readEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	var e sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == "" && e.id != "":
+			return e
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e.data)
+			require.NoError(t, err)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName, ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	effects, err := store.NewEffects(db)
+	require.NoError(t, err)
+
+	s := &Server{
+		echo:    echo.New(),
+		effects: effects,
+		stream:  newBroker(),
+	}
+	s.echo.GET("/api/stream", s.streamHandler)
+	srv := httptest.NewServer(s.echo)
+	defer srv.Close()
+
+	first, err := effects.Add(-1, -1, "user", "first", store.Submitter{})
+	require.NoError(t, err)
+	hidden, err := effects.Add(-1, -1, "user", "hidden", store.Submitter{})
+	require.NoError(t, err)
+	require.NoError(t, effects.Hide(hidden, true))
+	_, err = effects.AddVersion(first, "second", store.Submitter{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/stream", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "1")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, "text/event-stream", res.Header.Get(echo.HeaderContentType))
+
+	r := bufio.NewReader(res.Body)
+	e := readEvent(t, r)
+	require.Equal(t, "4", e.id)
+	require.Equal(t, first, e.data.ID)
+	require.Equal(t, 1, e.data.Version)
+	require.Equal(t, "user", e.data.User)
+	require.Equal(t, "/thumbs/1.png", e.data.Image)
+
+	id, err := effects.Add(-1, -1, "other", "third", store.Submitter{})
+	require.NoError(t, err)
+	s.stream.notify()
+
+	e = readEvent(t, r)
+	require.Equal(t, "5", e.id)
+	require.Equal(t, id, e.data.ID)
+	require.Equal(t, "other", e.data.User)
+
+	// hidden effects leave the shared history
+	require.NoError(t, effects.Hide(id, true))
+	items, next, more, err := s.streamEvents(4)
+	require.NoError(t, err)
+	require.False(t, more)
+	require.Equal(t, 6, next)
+	require.Empty(t, items)
+
+	// streams older than the history read the changes themselves
+	items, next, more, err = s.streamEvents(0)
+	require.NoError(t, err)
+	require.True(t, more)
+	require.Equal(t, 6, next)
+	require.Len(t, items, 2)
+	require.Equal(t, 1, items[0].seq)
+	require.Equal(t, 4, items[1].seq)
+	s.stream.feedMu.Lock()
+	require.Equal(t, 4, s.stream.first)
+	s.stream.feedMu.Unlock()
+}
+
+func TestStreamLastEventID(t *testing.T) {
+	db, err := sqlx.Connect(sqliteshim.ShimName, ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	effects, err := store.NewEffects(db)
+	require.NoError(t, err)
+
+	s := &Server{
+		echo:    echo.New(),
+		effects: effects,
+		stream:  newBroker(),
+	}
+	s.echo.GET("/api/stream", s.streamHandler)
+	srv := httptest.NewServer(s.echo)
+	defer srv.Close()
+
+	first, err := effects.Add(-1, -1, "user", "first", store.Submitter{})
+	require.NoError(t, err)
+
+	stream := func(id string) (*http.Response, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/stream", nil)
+		require.NoError(t, err)
+		req.Header.Set("Last-Event-ID", id)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return res, cancel
+	}
+
+	history := func() (int, int) {
+		s.stream.feedMu.Lock()
+		defer s.stream.feedMu.Unlock()
+		return s.stream.last, len(s.stream.events)
+	}
+
+	res, cancel := stream("-1")
+	res.Body.Close()
+	cancel()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// an id after the last change does not stop the shared history
+	res, cancel = stream("1000000")
+	defer cancel()
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Eventually(t, func() bool {
+		last, _ := history()
+		return last == 1
+	}, time.Second, time.Millisecond)
+
+	// an id of zero reads the whole feed in pages
+	all, cancelAll := stream("0")
+	defer cancelAll()
+	defer all.Body.Close()
+	e := readEvent(t, bufio.NewReader(all.Body))
+	require.Equal(t, "1", e.id)
+	require.Equal(t, first, e.data.ID)
+	last, events := history()
+	require.Equal(t, 1, last)
+	require.Zero(t, events)
+
+	id, err := effects.Add(-1, -1, "other", "second", store.Submitter{})
+	require.NoError(t, err)
+	s.stream.notify()
+
+	e = readEvent(t, bufio.NewReader(res.Body))
+	require.Equal(t, "2", e.id)
+	require.Equal(t, id, e.data.ID)
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrdoob/glsl-sandbox/server/store"
+)
+
+// hash returns a salted hash of the values or an empty string if all of
+// them are empty.
+func (s *Server) hash(values ...string) string {
+	empty := true
+	h := sha256.New()
+	h.Write([]byte(s.salt))
+	for _, v := range values {
+		if v != "" {
+			empty = false
+		}
+		h.Write([]byte{0})
+		h.Write([]byte(v))
+	}
+	if empty {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// submitter returns the hashed information identifying the client that
+// sends the request. The fingerprint only uses headers that are stable for
+// a browser so it does not change with the address.
+func (s *Server) submitter(c echo.Context) store.Submitter {
+	r := c.Request()
+	ip := c.RealIP()
+	agent := r.UserAgent()
+	return store.Submitter{
+		IP:        s.hash(ip),
+		UserAgent: s.hash(agent),
+		Fingerprint: s.hash(
+			agent,
+			r.Header.Get("Accept-Language"),
+			r.Header.Get("Accept-Encoding"),
+		),
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrdoob/glsl-sandbox/server/store"
+)
+
+// takedownItem has information about each takedown displayed in the
+// takedowns page.
+type takedownItem struct {
+	// ID is the takedown identifier.
+	ID int
+	// Effect is the removed effect identifier.
+	Effect int
+	// Reason is the legal reason of the removal.
+	Reason string
+	// Requester is who asked for the removal.
+	Requester string
+	// CreatedAt is the date of the takedown.
+	CreatedAt string
+}
+
+// blockItem has information about each block displayed in the takedowns
+// page.
+type blockItem struct {
+	// ID is the block identifier.
+	ID int
+	// Kind is "hash" or "regex".
+	Kind string
+	// Value is the normalized code hash or regular expression.
+	Value string
+	// Takedown is the takedown that created the block or 0.
+	Takedown int
+	// CreatedAt is the date the block was added.
+	CreatedAt string
+}
+
+// takedownsData has information about the takedowns page.
+type takedownsData struct {
+	// Takedowns is the list of all takedowns.
+	Takedowns []takedownItem
+	// Blocks is the list of all blocks.
+	Blocks []blockItem
+}
+
+func (s *Server) takedownsHandler(c echo.Context) error {
+	list, err := s.takedowns.Takedowns()
+	if err != nil {
+		c.Logger().Errorf("could not get takedowns: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "error")
+	}
+
+	blocks, err := s.takedowns.Blocks()
+	if err != nil {
+		c.Logger().Errorf("could not get blocks: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "error")
+	}
+
+	data := takedownsData{
+		Takedowns: make([]takedownItem, len(list)),
+		Blocks:    make([]blockItem, len(blocks)),
+	}
+	for i, t := range list {
+		data.Takedowns[i] = takedownItem{
+			ID:        t.ID,
+			Effect:    t.Effect,
+			Reason:    t.Reason,
+			Requester: t.Requester,
+			CreatedAt: t.CreatedAt.Format(time.RFC3339),
+		}
+	}
+	for i, b := range blocks {
+		data.Blocks[i] = blockItem{
+			ID:        b.ID,
+			Kind:      string(b.Kind),
+			Value:     b.Value,
+			Takedown:  b.Takedown,
+			CreatedAt: b.CreatedAt.Format(time.RFC3339),
+		}
+	}
+
+	return c.Render(http.StatusOK, "takedowns", data)
+}
+
+func (s *Server) takedownsPostHandler(c echo.Context) error {
+	id, err := strconv.Atoi(strings.TrimSpace(c.FormValue("effect")))
+	if err != nil {
+		c.Logger().Errorf("malformed effect id: %s", err.Error())
+		return c.Redirect(http.StatusSeeOther, "/admin/takedowns")
+	}
+
+	_, err = s.takedowns.TakeDown(s.effects, store.Takedown{
+		Effect:    id,
+		Reason:    strings.TrimSpace(c.FormValue("reason")),
+		Requester: strings.TrimSpace(c.FormValue("requester")),
+	})
+	if err != nil {
+		c.Logger().Errorf("could not take down effect: %s", err.Error())
+	}
+
+	return c.Redirect(http.StatusSeeOther, "/admin/takedowns")
+}
+
+func (s *Server) blocksPostHandler(c echo.Context) error {
+	block := store.Block{
+		Kind:  store.BlockKind(c.FormValue("kind")),
+		Value: c.FormValue("value"),
+	}
+	if c.FormValue("kind") == "code" {
+		block.Kind = store.BlockHash
+		block.Value = store.NormalizedHash(block.Value)
+	}
+
+	_, err := s.takedowns.AddBlock(block)
+	if err != nil {
+		c.Logger().Errorf("could not add block: %s", err.Error())
+	}
+
+	return c.Redirect(http.StatusSeeOther, "/admin/takedowns")
+}
+
+func (s *Server) blocksRemoveHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.FormValue("id"))
+	if err != nil {
+		c.Logger().Errorf("malformed block id: %s", err.Error())
+		return c.Redirect(http.StatusSeeOther, "/admin/takedowns")
+	}
+
+	err = s.takedowns.RemoveBlock(id)
+	if err != nil {
+		c.Logger().Errorf("could not remove block: %s", err.Error())
+	}
+
+	return c.Redirect(http.StatusSeeOther, "/admin/takedowns")
+}
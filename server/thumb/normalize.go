@@ -0,0 +1,108 @@
+package thumb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+)
+
+const (
+	// Width and Height are the size of the stored thumbnails. The editor
+	// renders thumbnails with this size.
+	Width  = 200
+	Height = 100
+
+	// MaxBytes is the maximum size of an uploaded thumbnail.
+	MaxBytes = 1 << 20
+	// MaxWidth and MaxHeight limit the size of the uploaded image so it
+	// can be decoded without using too much memory.
+	MaxWidth  = 1024
+	MaxHeight = 1024
+)
+
+// ErrInvalid is returned when an uploaded thumbnail is not a valid PNG
+// image within the limits.
+var ErrInvalid = errors.New("invalid thumbnail")
+
+// Normalize decodes an uploaded PNG thumbnail and encodes it again with
+// Width and Height. Anything besides the pixels, like metadata chunks or
+// data appended to the file, is discarded.
+func Normalize(data []byte) ([]byte, error) {
+	if len(data) > MaxBytes {
+		return nil, fmt.Errorf("%w: %d bytes is bigger than %d",
+			ErrInvalid, len(data), MaxBytes)
+	}
+
+	cfg, err := png.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalid, err.Error())
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 ||
+		cfg.Width > MaxWidth || cfg.Height > MaxHeight {
+		return nil, fmt.Errorf("%w: size %dx%d is not allowed",
+			ErrInvalid, cfg.Width, cfg.Height)
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalid, err.Error())
+	}
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, resize(img, Width, Height))
+	if err != nil {
+		return nil, fmt.Errorf("could not encode thumbnail: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// resize scales the image to width and height. Each pixel is the average
+// of the source pixels it covers.
+func resize(img image.Image, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	src := img.Bounds()
+	if src.Dx() == width && src.Dy() == height {
+		draw.Draw(dst, dst.Bounds(), img, src.Min, draw.Src)
+		return dst
+	}
+
+	for y := 0; y < height; y++ {
+		y0 := src.Min.Y + y*src.Dy()/height
+		y1 := src.Min.Y + (y+1)*src.Dy()/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < width; x++ {
+			x0 := src.Min.X + x*src.Dx()/width
+			x1 := src.Min.X + (x+1)*src.Dx()/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(b / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,72 @@
+package thumb
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+func TestNormalize(t *testing.T) {
+	small := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 20; x++ {
+			small.Set(x, y, color.RGBA{R: uint8(x * 10), A: 255})
+		}
+	}
+
+	tests := []struct {
+		name string
+		img  image.Image
+	}{
+		{name: "smaller", img: small},
+		{name: "exact", img: image.NewNRGBA(image.Rect(0, 0, Width, Height))},
+		{name: "bigger", img: image.NewGray(image.Rect(0, 0, 800, 300))},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := Normalize(encodePNG(t, test.img))
+			require.NoError(t, err)
+
+			img, err := png.Decode(bytes.NewReader(data))
+			require.NoError(t, err)
+			require.Equal(t, image.Rect(0, 0, Width, Height), img.Bounds())
+		})
+	}
+
+	data, err := Normalize(encodePNG(t, small))
+	require.NoError(t, err)
+	img, err := png.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, color.RGBA{R: 190, A: 255},
+		color.RGBAModel.Convert(img.At(Width-1, 0)))
+
+	// data after the image is dropped
+	data, err = Normalize(append(encodePNG(t, small), []byte("<script>")...))
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "<script>")
+
+	invalid := [][]byte{
+		nil,
+		[]byte("<html></html>"),
+		encodePNG(t, small)[:40],
+		encodePNG(t, image.NewGray(image.Rect(0, 0, MaxWidth+1, 1))),
+		make([]byte, MaxBytes+1),
+	}
+	for _, d := range invalid {
+		_, err = Normalize(d)
+		require.True(t, errors.Is(err, ErrInvalid))
+	}
+}
@@ -59,3 +59,18 @@ func (t Thumbs) Save(n string, d []byte) error {
 
 	return nil
 }
+
+func (t Thumbs) Remove(n string) error {
+	dir, n := path.Split(n)
+	if dir != "" {
+		return fmt.Errorf("malformed path")
+	}
+
+	p := path.Join(t.path, n)
+	err := os.Remove(p)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not remove thumb %s: %w", p, err)
+	}
+
+	return nil
+}
@@ -28,4 +28,15 @@ func TestThumbs(t *testing.T) {
 	require.NoError(t, err)
 
 	require.Equal(t, []byte("data"), data)
+
+	err = thumbs.Remove("../secret")
+	require.Error(t, err)
+
+	err = thumbs.Remove("1.png")
+	require.NoError(t, err)
+	_, err = os.Stat(path.Join(d, "1.png"))
+	require.True(t, os.IsNotExist(err))
+
+	err = thumbs.Remove("1.png")
+	require.NoError(t, err)
 }
@@ -0,0 +1,190 @@
+// Package webhook delivers effect events to the configured webhooks.
+// Events are queued in the database and sent in the background so slow
+// receivers do not block requests.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mrdoob/glsl-sandbox/server/store"
+)
+
+const (
+	EventEffectCreated  = "effect.created"
+	EventVersionAdded   = "version.added"
+	EventEffectHidden   = "effect.hidden"
+	EventEffectUnhidden = "effect.unhidden"
+	// EventEffectsBulkHidden and EventEffectsBulkUnhidden are sent when many
+	// effects change their hidden state at once.
+	EventEffectsBulkHidden   = "effects.bulk_hidden"
+	EventEffectsBulkUnhidden = "effects.bulk_unhidden"
+
+	// HeaderEvent holds the event name.
+	HeaderEvent = "X-Glslsandbox-Event"
+	// HeaderDelivery holds the delivery identifier.
+	HeaderDelivery = "X-Glslsandbox-Delivery"
+	// HeaderSignature holds "sha256=" and the hex encoded HMAC-SHA256 of the
+	// body using the webhook secret.
+	HeaderSignature = "X-Glslsandbox-Signature"
+
+	batchSize   = 50
+	maxAttempts = 8
+	retryBase   = 30 * time.Second
+	interval    = 10 * time.Second
+)
+
+// Payload is the body sent to webhooks.
+type Payload struct {
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// Sign returns the signature header value for the body.
+func Sign(secret string, body []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write(body)
+	return "sha256=" + hex.EncodeToString(m.Sum(nil))
+}
+
+// Dispatcher queues and delivers webhook events.
+type Dispatcher struct {
+	store  *store.Webhooks
+	client *http.Client
+	wake   chan struct{}
+	// Errorf logs delivery errors.
+	Errorf func(format string, args ...interface{})
+}
+
+// New creates a dispatcher that uses the given store as queue.
+func New(s *store.Webhooks) *Dispatcher {
+	return &Dispatcher{
+		store: s,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		wake:   make(chan struct{}, 1),
+		Errorf: func(string, ...interface{}) {},
+	}
+}
+
+// Emit queues an event for all the interested webhooks.
+func (d *Dispatcher) Emit(event string, data interface{}) error {
+	body, err := json.Marshal(Payload{
+		Event:     event,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+	if err != nil {
+		return fmt.Errorf("could not encode payload: %w", err)
+	}
+
+	n, err := d.store.Enqueue(event, body)
+	if err != nil {
+		return err
+	}
+
+	if n > 0 {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Run delivers queued events until the stop channel is closed.
+func (d *Dispatcher) Run(stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		_, err := d.Deliver()
+		if err != nil {
+			d.Errorf("could not deliver webhooks: %s", err.Error())
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// Deliver sends the deliveries that are due and returns how many
+// succeeded.
+func (d *Dispatcher) Deliver() (int, error) {
+	due, err := d.store.Due(time.Now(), batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	ok := 0
+	for _, delivery := range due {
+		code, err := d.send(delivery)
+		if err == nil {
+			ok++
+			err = d.store.Delivered(delivery.ID, code)
+			if err != nil {
+				return ok, err
+			}
+			continue
+		}
+
+		var next time.Time
+		if delivery.Attempts+1 < maxAttempts {
+			next = time.Now().Add(Backoff(delivery.Attempts + 1))
+		}
+		err = d.store.Failed(delivery.ID, code, err.Error(), next)
+		if err != nil {
+			return ok, err
+		}
+	}
+
+	return ok, nil
+}
+
+// Backoff returns the time to wait before retrying a delivery that failed
+// the given number of times.
+func Backoff(attempts int) time.Duration {
+	return retryBase << (attempts - 1)
+}
+
+func (d *Dispatcher) send(delivery store.Delivery) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("could not create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, delivery.Event)
+	req.Header.Set(HeaderDelivery, strconv.Itoa(delivery.ID))
+	if delivery.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(delivery.Secret, body))
+	}
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("could not send request: %w", err)
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("unexpected status: %s", res.Status)
+	}
+
+	return res.StatusCode, nil
+}
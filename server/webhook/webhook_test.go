@@ -0,0 +1,115 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mrdoob/glsl-sandbox/server/store"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+type received struct {
+	event     string
+	signature string
+	body      []byte
+}
+
+func TestDispatcher(t *testing.T) {
+	var mu sync.Mutex
+	var calls []received
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, received{
+			event:     r.Header.Get(HeaderEvent),
+			signature: r.Header.Get(HeaderSignature),
+			body:      body,
+		})
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	db, err := sqlx.Connect(sqliteshim.ShimName, ":memory:")
+	require.NoError(t, err)
+	hooks, err := store.NewWebhooks(db)
+	require.NoError(t, err)
+
+	_, err = hooks.Add(store.Webhook{
+		URL:    srv.URL,
+		Secret: "secret",
+		Events: EventEffectCreated,
+	})
+	require.NoError(t, err)
+
+	d := New(hooks)
+	err = d.Emit(EventVersionAdded, map[string]int{"id": 1})
+	require.NoError(t, err)
+	err = d.Emit(EventEffectCreated, map[string]int{"id": 2})
+	require.NoError(t, err)
+
+	n, err := d.Deliver()
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.Len(t, calls, 1)
+
+	c := calls[0]
+	require.Equal(t, EventEffectCreated, c.event)
+	require.Equal(t, Sign("secret", c.body), c.signature)
+
+	var p struct {
+		Event string         `json:"event"`
+		Data  map[string]int `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(c.body, &p))
+	require.Equal(t, EventEffectCreated, p.Event)
+	require.Equal(t, 2, p.Data["id"])
+
+	log, err := hooks.Deliveries(10)
+	require.NoError(t, err)
+	require.Len(t, log, 1)
+	require.Equal(t, http.StatusServiceUnavailable, log[0].ResponseCode)
+	require.Equal(t, store.DeliveryStatus(store.DeliveryPending), log[0].Status)
+	require.Equal(t, 1, log[0].Attempts)
+
+	n, err = d.Deliver()
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.Len(t, calls, 1)
+
+	due, err := hooks.Due(time.Now().Add(Backoff(1)+time.Second), 10)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+
+	fail = false
+	_, err = db.Exec("UPDATE webhook_deliveries SET next_attempt = ?", time.Now().Add(-time.Second))
+	require.NoError(t, err)
+
+	n, err = d.Deliver()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Len(t, calls, 2)
+
+	log, err = hooks.Deliveries(10)
+	require.NoError(t, err)
+	require.Equal(t, store.DeliveryStatus(store.DeliveryDelivered), log[0].Status)
+	require.Equal(t, 2, log[0].Attempts)
+}
+
+func TestBackoff(t *testing.T) {
+	require.Equal(t, retryBase, Backoff(1))
+	require.Equal(t, 2*retryBase, Backoff(2))
+	require.Equal(t, 64*retryBase, Backoff(7))
+}
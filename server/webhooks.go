@@ -0,0 +1,248 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrdoob/glsl-sandbox/server/store"
+	"github.com/mrdoob/glsl-sandbox/server/webhook"
+)
+
+const deliveriesLog = 100
+
+// effectEvent is the webhook data for events about one effect. Version is
+// nil when the event is about the whole effect.
+type effectEvent struct {
+	ID      int    `json:"id"`
+	Version *int   `json:"version,omitempty"`
+	URL     string `json:"url,omitempty"`
+	Image   string `json:"image,omitempty"`
+}
+
+// bulkEvent is the webhook data for bulk moderation events. It is only
+// sent with the bulk events.
+type bulkEvent struct {
+	Bulk  string `json:"bulk"`
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// emit queues a webhook event. Errors are logged and do not affect the
+// request.
+func (s *Server) emit(c echo.Context, event string, data interface{}) {
+	if s.webhooks == nil {
+		return
+	}
+
+	err := s.webhooks.Emit(event, data)
+	if err != nil {
+		c.Logger().Errorf("could not queue webhook: %s", err.Error())
+	}
+}
+
+// emitSave queues the event for a saved effect or version.
+func (s *Server) emitSave(c echo.Context, id int, version int) {
+	event := webhook.EventVersionAdded
+	if version == 0 {
+		event = webhook.EventEffectCreated
+	}
+
+	s.emit(c, event, effectEvent{
+		ID:      id,
+		Version: &version,
+		URL:     s.absoluteURL(c, fmt.Sprintf("/e#%d.%d", id, version)),
+		Image: s.absoluteURL(c,
+			path.Join("/thumbs", store.Effect{ID: id}.ImageName())),
+	})
+}
+
+// absoluteURL returns the URL of a path in the server. It uses the
+// configured base URL, the first TLS domain or the address of the request,
+// in that order.
+func (s *Server) absoluteURL(c echo.Context, p string) string {
+	base := s.baseURL
+	switch {
+	case base != "":
+	case len(s.domains) > 0 && s.domains[0] != "":
+		base = "https://" + s.domains[0]
+	default:
+		base = c.Scheme() + "://" + c.Request().Host
+	}
+	return strings.TrimSuffix(base, "/") + p
+}
+
+// emitHide queues the event for an effect or version that changed its
+// hidden state.
+func (s *Server) emitHide(c echo.Context, id int, version *int, hidden bool) {
+	event := webhook.EventEffectUnhidden
+	if hidden {
+		event = webhook.EventEffectHidden
+	}
+
+	s.emit(c, event, effectEvent{
+		ID:      id,
+		Version: version,
+	})
+}
+
+// setHidden changes the hidden state of an effect and queues a webhook event
+// if it was different.
+func (s *Server) setHidden(c echo.Context, id int, hidden bool) error {
+	e, err := s.effects.Effect(id)
+	if err != nil {
+		return err
+	}
+	if e.Hidden == hidden {
+		return nil
+	}
+
+	err = s.effects.Hide(id, hidden)
+	if err != nil {
+		return err
+	}
+
+	s.emitHide(c, id, nil, hidden)
+	return nil
+}
+
+// webhookItem has information about each webhook displayed in the webhooks
+// page.
+type webhookItem struct {
+	// ID is the webhook identifier.
+	ID int
+	// URL is where events are sent.
+	URL string
+	// Events is the list of events sent, empty for all.
+	Events string
+	// Signed tells if the webhook has a secret.
+	Signed bool
+	// CreatedAt is the date the webhook was added.
+	CreatedAt string
+}
+
+// deliveryItem has information about each delivery displayed in the
+// webhooks page.
+type deliveryItem struct {
+	// ID is the delivery identifier.
+	ID int
+	// URL is the webhook URL.
+	URL string
+	// Event is the event name.
+	Event string
+	// Status is "pending", "delivered" or "failed".
+	Status string
+	// Attempts is the number of times it was sent.
+	Attempts int
+	// ResponseCode is the last HTTP status received.
+	ResponseCode int
+	// LastError is the last error message.
+	LastError string
+	// CreatedAt is the date of the event.
+	CreatedAt string
+	// NextAttempt is the date of the next retry for pending deliveries.
+	NextAttempt string
+}
+
+// webhooksData has information about the webhooks page.
+type webhooksData struct {
+	// Webhooks is the list of all webhooks.
+	Webhooks []webhookItem
+	// Deliveries is the list of the latest deliveries.
+	Deliveries []deliveryItem
+	// Events is the list of available events.
+	Events []string
+}
+
+func (s *Server) webhooksHandler(c echo.Context) error {
+	hooks, err := s.hooks.Webhooks()
+	if err != nil {
+		c.Logger().Errorf("could not get webhooks: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "error")
+	}
+
+	deliveries, err := s.hooks.Deliveries(deliveriesLog)
+	if err != nil {
+		c.Logger().Errorf("could not get deliveries: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "error")
+	}
+
+	d := webhooksData{
+		Webhooks:   make([]webhookItem, len(hooks)),
+		Deliveries: make([]deliveryItem, len(deliveries)),
+		Events: []string{
+			webhook.EventEffectCreated,
+			webhook.EventVersionAdded,
+			webhook.EventEffectHidden,
+			webhook.EventEffectUnhidden,
+			webhook.EventEffectsBulkHidden,
+			webhook.EventEffectsBulkUnhidden,
+		},
+	}
+	for i, w := range hooks {
+		d.Webhooks[i] = webhookItem{
+			ID:        w.ID,
+			URL:       w.URL,
+			Events:    w.Events,
+			Signed:    w.Secret != "",
+			CreatedAt: w.CreatedAt.Format(time.RFC3339),
+		}
+	}
+	for i, l := range deliveries {
+		next := ""
+		if l.Status == store.DeliveryPending {
+			next = l.NextAttempt.Format(time.RFC3339)
+		}
+		d.Deliveries[i] = deliveryItem{
+			ID:           l.ID,
+			URL:          l.URL,
+			Event:        l.Event,
+			Status:       string(l.Status),
+			Attempts:     l.Attempts,
+			ResponseCode: l.ResponseCode,
+			LastError:    l.LastError,
+			CreatedAt:    l.CreatedAt.Format(time.RFC3339),
+			NextAttempt:  next,
+		}
+	}
+
+	return c.Render(http.StatusOK, "webhooks", d)
+}
+
+func (s *Server) webhooksPostHandler(c echo.Context) error {
+	values, err := c.FormParams()
+	if err != nil {
+		c.Logger().Errorf("malformed form: %s", err.Error())
+		return c.Redirect(http.StatusSeeOther, "/admin/webhooks")
+	}
+
+	_, err = s.hooks.Add(store.Webhook{
+		URL:    values.Get("url"),
+		Secret: values.Get("secret"),
+		Events: strings.Join(values["events"], ","),
+	})
+	if err != nil {
+		c.Logger().Errorf("could not add webhook: %s", err.Error())
+	}
+
+	return c.Redirect(http.StatusSeeOther, "/admin/webhooks")
+}
+
+func (s *Server) webhooksRemoveHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.FormValue("id"))
+	if err != nil {
+		c.Logger().Errorf("malformed webhook id: %s", err.Error())
+		return c.Redirect(http.StatusSeeOther, "/admin/webhooks")
+	}
+
+	err = s.hooks.Remove(id)
+	if err != nil {
+		c.Logger().Errorf("could not remove webhook: %s", err.Error())
+	}
+
+	return c.Redirect(http.StatusSeeOther, "/admin/webhooks")
+}